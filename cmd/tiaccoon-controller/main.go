@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"log/slog"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/controller/networkpolicy"
+	"github.com/hiroyaonoe/tiaccoon/pkg/controller/service"
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/version"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func main() {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+
+	var (
+		versionFlag   bool
+		helpFlag      bool
+		logLevelStr   string
+		logSource     bool
+		kubeconfig    string
+		nodeName      string
+		apiSocketPath string
+		apiSocketDir  string
+		unixSocketDir string
+		resync        time.Duration
+	)
+	flag.BoolVar(&versionFlag, "version", false, "Print the version")
+	flag.BoolVar(&helpFlag, "help", false, "Print help information")
+	flag.StringVar(&logLevelStr, "log-level", "info", "Set the log level (debug, info, warn, error)")
+	flag.BoolVar(&logSource, "log-source", false, "Include source information in log output")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to the kubeconfig (empty to use the in-cluster config)")
+	flag.StringVar(&nodeName, "node-name", os.Getenv("NODE_NAME"), "Name of the node whose pods are controlled (default $NODE_NAME)")
+	flag.StringVar(&apiSocketPath, "api-socket", filepath.Join(xdgRuntimeDir, "tiaccoon-api.sock"), "Socket path for the control-plane API of tiaccoon of the node, to which the NetworkPolicy rules are pushed")
+	flag.StringVar(&apiSocketDir, "api-socket-dir", filepath.Join(xdgRuntimeDir, "tiaccoon"), "Directory of the control-plane API sockets named <pod IP>.sock, to which the Service entries are pushed")
+	flag.StringVar(&unixSocketDir, "unix-socket-dir", filepath.Join(xdgRuntimeDir, "tiaccoon-unix"), "Directory of the UNIX sockets which tiaccoon of co-located backends listens on")
+	flag.DurationVar(&resync, "resync", 10*time.Minute, "Interval to compile and push all rules and entries again")
+	flag.Parse()
+
+	if versionFlag {
+		fmt.Println(version.Version)
+		os.Exit(0)
+	}
+
+	if helpFlag {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	var logLevel slog.Level
+	switch logLevelStr {
+	case "debug":
+		logLevel = slog.LevelDebug
+	case "info":
+		logLevel = slog.LevelInfo
+	case "warn":
+		logLevel = slog.LevelWarn
+	case "error":
+		logLevel = slog.LevelError
+	default:
+		logLevel = slog.LevelInfo
+	}
+
+	if nodeName == "" {
+		fmt.Println("--node-name or $NODE_NAME are needed to be set")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	os.Exit(run(logLevel, logSource, kubeconfig, nodeName, apiSocketPath, apiSocketDir, unixSocketDir, resync))
+}
+
+func run(logLevel slog.Level, logSource bool, kubeconfig, nodeName, apiSocketPath, apiSocketDir, unixSocketDir string, resync time.Duration) int {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		AddSource: logSource,
+		Level:     logLevel,
+	}))
+	slog.SetDefault(logger)
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = log.ContextWithLogger(ctx, logger)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		logger.InfoContext(ctx, "Received signal, shutting down")
+		cancel()
+	}()
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to load kubeconfig", "error", err)
+		return 1
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to create kubernetes client", "error", err)
+		return 1
+	}
+
+	factory := informers.NewSharedInformerFactory(client, resync)
+	defer factory.Shutdown()
+
+	npController, err := networkpolicy.NewController(factory, nodeName, apiSocketPath)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to create networkpolicy controller", "error", err)
+		return 1
+	}
+	defer npController.Close(ctx)
+	svcController, err := service.NewController(factory, nodeName, apiSocketDir, unixSocketDir)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to create service controller", "error", err)
+		return 1
+	}
+	defer svcController.Close(ctx)
+
+	factory.Start(ctx.Done())
+
+	// Both controllers run until ctx is done. If one fails, the other is stopped too.
+	errCh := make(chan error, 2)
+	go func() {
+		if err := npController.Start(ctx); err != nil {
+			errCh <- fmt.Errorf("networkpolicy controller: %w", err)
+			return
+		}
+		errCh <- nil
+	}()
+	go func() {
+		if err := svcController.Start(ctx); err != nil {
+			errCh <- fmt.Errorf("service controller: %w", err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	code := 0
+	for range 2 {
+		if err := <-errCh; err != nil {
+			logger.ErrorContext(ctx, "Failed to run controller", "error", err)
+			code = 1
+			cancel()
+		}
+	}
+	return code
+}
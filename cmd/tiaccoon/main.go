@@ -10,11 +10,14 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"log/slog"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/seccomp"
 	"github.com/hiroyaonoe/tiaccoon/pkg/version"
 	"golang.org/x/sys/unix"
 )
@@ -29,18 +32,36 @@ func main() {
 		logLevelStr      string
 		logSource        bool
 		socketPath       string
+		apiSocketPath    string
 		defaultPolicyStr string
 		myVIPStr         string
+		vipAnnotation    bool
 		featureRDMA      bool
+		configPath       string
+		registryPath     string
+		healthCheck      destination.HealthCheckConfig
+		connectTimeout   time.Duration
+		shutdown         seccomp.ShutdownConfig
+		shutdownErrnoStr string
 	)
 	flag.BoolVar(&versionFlag, "version", false, "Print the version")
 	flag.BoolVar(&helpFlag, "help", false, "Print help information")
 	flag.StringVar(&logLevelStr, "log-level", "info", "Set the log level (debug, info, warn, error)")
 	flag.BoolVar(&logSource, "log-source", false, "Include source information in log output")
 	flag.StringVar(&socketPath, "socket", filepath.Join(xdgRuntimeDir, "tiaccoon.sock"), "Socket path for seccomp notify")
+	flag.StringVar(&apiSocketPath, "api-socket", filepath.Join(xdgRuntimeDir, "tiaccoon-api.sock"), "Socket path for the control-plane API (empty to disable)")
 	flag.StringVar(&defaultPolicyStr, "default-policy", "", "Set the default policy (allow, deny)")
-	flag.StringVar(&myVIPStr, "ip", "", "Set the IP of the container")
+	flag.StringVar(&myVIPStr, "ip", "", "Set the VIP of the containers which are not registered by the CNI plugin")
+	flag.BoolVar(&vipAnnotation, "allow-vip-annotation", false, "Accept the VIP of the containers not registered by the CNI plugin from the tiaccoon.io/vip annotation")
 	flag.BoolVar(&featureRDMA, "feature-rdma", false, "Enable feature RDMA")
+	flag.StringVar(&configPath, "config", "", "Path to the config file of access control rules and destination entries (YAML or JSON)")
+	flag.StringVar(&registryPath, "registry-file", filepath.Join(xdgRuntimeDir, "tiaccoon-registry.json"), "Path to the file saving the containers registered by the CNI plugin across restarts (empty to keep them only in memory)")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 3*time.Second, "Default timeout of connecting to a destination entry (0 to wait as long as the kernel)")
+	flag.DurationVar(&healthCheck.Interval, "health-check-interval", 0, "Interval of the health checks of the destination entries (0 to disable)")
+	flag.DurationVar(&healthCheck.Timeout, "health-check-timeout", time.Second, "Timeout of a health check of a destination entry")
+	flag.IntVar(&healthCheck.Threshold, "health-check-threshold", 3, "Number of consecutive health checks to mark a destination entry unhealthy or healthy again")
+	flag.DurationVar(&shutdown.Timeout, "shutdown-timeout", 10*time.Second, "Timeout of waiting for the system calls in flight on shutdown")
+	flag.StringVar(&shutdownErrnoStr, "shutdown-errno", "", "Errno to fail the system calls which would be bypassed on shutdown, such as ECONNREFUSED (empty to continue them natively)")
 	flag.Parse()
 
 	if versionFlag {
@@ -85,12 +106,22 @@ func main() {
 		os.Exit(1)
 	}
 
+	if shutdownErrnoStr != "" {
+		errno, err := seccomp.ParseErrno(shutdownErrnoStr)
+		if err != nil {
+			fmt.Printf("--shutdown-errno: %s\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+		shutdown.Errno = errno
+	}
+
 	myVIP := net.ParseIP(myVIPStr)
 
-	os.Exit(run(logLevel, logSource, socketPath, defaultPolicy, myVIP, featureRDMA))
+	os.Exit(run(logLevel, logSource, socketPath, apiSocketPath, defaultPolicy, myVIP, vipAnnotation, featureRDMA, configPath, registryPath, healthCheck, connectTimeout, shutdown))
 }
 
-func run(logLevel slog.Level, logSource bool, socketPath string, defaultPolicy bool, myVIP net.IP, featureRDMA bool) int {
+func run(logLevel slog.Level, logSource bool, socketPath, apiSocketPath string, defaultPolicy bool, myVIP net.IP, vipAnnotation bool, featureRDMA bool, configPath, registryPath string, healthCheck destination.HealthCheckConfig, connectTimeout time.Duration, shutdown seccomp.ShutdownConfig) int {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: logSource,
 		Level:     logLevel,
@@ -107,16 +138,24 @@ func run(logLevel slog.Level, logSource bool, socketPath string, defaultPolicy b
 		cancel()
 	}()
 
-	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		logger.ErrorContext(ctx, "Cannot cleanup socket file", "error", err)
-		return 1
-	}
-	defer func() {
-		if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-			logger.ErrorContext(ctx, "Cannot cleanup socket file", "error", err)
+	for _, path := range []string{socketPath, apiSocketPath} {
+		if path == "" {
+			continue
 		}
-	}()
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.ErrorContext(ctx, "Cannot cleanup socket file", "error", err, "path", path)
+			return 1
+		}
+		defer func() {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.ErrorContext(ctx, "Cannot cleanup socket file", "error", err, "path", path)
+			}
+		}()
+	}
 
-	tiaccoon.Start(ctx, socketPath, defaultPolicy, myVIP, featureRDMA)
+	if err := tiaccoon.Start(ctx, socketPath, apiSocketPath, defaultPolicy, myVIP, vipAnnotation, featureRDMA, configPath, registryPath, healthCheck, connectTimeout, shutdown); err != nil {
+		logger.ErrorContext(ctx, "Failed to start tiaccoon", "error", err)
+		return 1
+	}
 	return 0
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/version"
+)
+
+const usage = `Usage: tiaccoonctl [flags] COMMAND
+
+Commands:
+  acl ls (client|server)
+  acl add (client|server) IP|CIDR (allow|deny) [-ports PORTS] [-protocol tcp|udp] [-local-vip VIP]
+  acl rm (client|server) IP|CIDR [-ports PORTS] [-protocol tcp|udp] [-local-vip VIP]
+  dest ls [VIP VPORT]
+  dest add VIP VPORT TRANSPORT ADDRESS [-weight WEIGHT] [-balancer random|round-robin|weighted|least-connections|hash]
+           [-connect-timeout DURATION] [-transports TRANSPORT,...]
+  dest rm VIP VPORT [TRANSPORT ADDRESS]
+  dest health
+  sockets ls
+  version
+
+Flags:
+`
+
+func main() {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+
+	var (
+		socketPath string
+		output     string
+	)
+	flag.StringVar(&socketPath, "socket", filepath.Join(xdgRuntimeDir, "tiaccoon-api.sock"), "Socket path for the control-plane API")
+	flag.StringVar(&output, "o", "table", "Output format (table, json)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if output != "table" && output != "json" {
+		fmt.Fprintln(os.Stderr, "-o must be either 'table' or 'json'")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	c := &ctl{
+		client: api.NewClient(socketPath),
+		json:   output == "json",
+		out:    os.Stdout,
+	}
+	if err := c.run(context.Background(), flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		if errors.Is(err, errUsage) {
+			flag.Usage()
+		}
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid arguments")
+
+type ctl struct {
+	client *api.Client
+	json   bool
+	out    io.Writer
+}
+
+func (c *ctl) run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "acl":
+		return c.acl(ctx, args[1:])
+	case "dest":
+		return c.dest(ctx, args[1:])
+	case "sockets":
+		return c.sockets(ctx, args[1:])
+	case "version":
+		return c.version(ctx, args[1:])
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+}
+
+func (c *ctl) acl(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	side := args[1]
+	if side != api.SideClient && side != api.SideServer {
+		return fmt.Errorf("%w: side must be either %q or %q", errUsage, api.SideClient, api.SideServer)
+	}
+
+	switch args[0] {
+	case "ls":
+		if len(args) != 2 {
+			return errUsage
+		}
+		list, err := c.client.ListAccessControl(ctx, side)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(list)
+		}
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "LOCAL VIP\tIP\tPORTS\tPROTOCOL\tPOLICY")
+		for _, e := range list.Rules {
+			localVIP := ""
+			if e.LocalVIP != nil {
+				localVIP = e.LocalVIP.String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orAny(localVIP), accesscontrol.FormatIPNet(e.IPNet), orAny(e.Ports.String()), orAny(accesscontrol.FormatProtocol(e.SockType)), accesscontrol.FormatPolicy(e.Policy))
+		}
+		fmt.Fprintf(w, "*\t*\t*\t*\t%s\n", list.DefaultPolicy)
+		return w.Flush()
+	case "add":
+		if len(args) < 4 {
+			return errUsage
+		}
+		match, err := parseMatch(args[2], args[4:])
+		if err != nil {
+			return err
+		}
+		policy, err := accesscontrol.ParsePolicy(args[3])
+		if err != nil {
+			return err
+		}
+		return c.client.PutAccessControl(ctx, side, &accesscontrol.Entry{Match: match, Policy: policy})
+	case "rm":
+		if len(args) < 3 {
+			return errUsage
+		}
+		match, err := parseMatch(args[2], args[3:])
+		if err != nil {
+			return err
+		}
+		return c.client.DeleteAccessControl(ctx, side, match)
+	default:
+		return fmt.Errorf("%w: unknown acl command %q", errUsage, args[0])
+	}
+}
+
+func (c *ctl) dest(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "ls":
+		var (
+			entries []*destination.Entry
+			err     error
+		)
+		switch len(args) {
+		case 1:
+			entries, err = c.client.ListDestinations(ctx)
+		case 3:
+			var (
+				vip   net.IP
+				vport uint16
+			)
+			vip, vport, err = parseVIPPort(args[1], args[2])
+			if err != nil {
+				return err
+			}
+			entries, err = c.client.GetDestinations(ctx, vip, vport)
+		default:
+			return errUsage
+		}
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(entries)
+		}
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "VIP\tVPORT\tTRANSPORT\tADDRESS\tWEIGHT\tBALANCER\tCONNECT TIMEOUT\tTRANSPORTS")
+		for _, e := range entries {
+			connectTimeout, transports := "-", "-"
+			if e.ConnectTimeout != 0 {
+				connectTimeout = e.ConnectTimeout.String()
+			}
+			if len(e.Transports) > 0 {
+				transports = strings.Join(destination.FormatTransportOrder(e.Transports), ",")
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%s\t%s\t%s\n", e.VIP, e.VPort, e.Transport, e.Address, e.Weight, e.Balancer, connectTimeout, transports)
+		}
+		return w.Flush()
+	case "add":
+		if len(args) < 5 {
+			return errUsage
+		}
+		entry, err := parseEntry(args[1:5])
+		if err != nil {
+			return err
+		}
+		if err := parseEntryFlags(entry, args[5:]); err != nil {
+			return err
+		}
+		entries, err := c.client.GetDestinations(ctx, entry.VIP, entry.VPort)
+		var statusErr *api.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			entries, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Transport == entry.Transport && e.Address.String() == entry.Address.String() {
+				return fmt.Errorf("destination entry %s %s for %s:%d already exists", entry.Transport, entry.Address, entry.VIP, entry.VPort)
+			}
+		}
+		return c.client.PutDestinations(ctx, entry.VIP, entry.VPort, append(entries, entry))
+	case "rm":
+		switch len(args) {
+		case 3:
+			vip, vport, err := parseVIPPort(args[1], args[2])
+			if err != nil {
+				return err
+			}
+			return c.client.DeleteDestinations(ctx, vip, vport)
+		case 5:
+			entry, err := parseEntry(args[1:])
+			if err != nil {
+				return err
+			}
+			entries, err := c.client.GetDestinations(ctx, entry.VIP, entry.VPort)
+			if err != nil {
+				return err
+			}
+			remaining := []*destination.Entry{}
+			for _, e := range entries {
+				if e.Transport != entry.Transport || e.Address.String() != entry.Address.String() {
+					remaining = append(remaining, e)
+				}
+			}
+			if len(remaining) == len(entries) {
+				return fmt.Errorf("destination entry %s %s for %s:%d is not found", entry.Transport, entry.Address, entry.VIP, entry.VPort)
+			}
+			return c.client.PutDestinations(ctx, entry.VIP, entry.VPort, remaining)
+		default:
+			return errUsage
+		}
+	case "health":
+		if len(args) != 1 {
+			return errUsage
+		}
+		list, err := c.client.ListDestinationHealth(ctx)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(list)
+		}
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "VIP\tVPORT\tTRANSPORT\tADDRESS\tHEALTHY\tFAILURES\tLAST CHECKED\tLAST ERROR")
+		for _, h := range list {
+			lastChecked := "-"
+			if !h.LastChecked.IsZero() {
+				lastChecked = h.LastChecked.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%t\t%d\t%s\t%s\n", h.Entry.VIP, h.Entry.VPort, h.Entry.Transport, h.Entry.Address, h.Healthy, h.Failures, lastChecked, h.LastError)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("%w: unknown dest command %q", errUsage, args[0])
+	}
+}
+
+func (c *ctl) sockets(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] != "ls" {
+		return errUsage
+	}
+	containers, err := c.client.ListSockets(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(containers)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NOTIFFD\tCONTAINER\tVIP\tPID\tFD\tSTATE\tDOMAIN\tTYPE\tLOCAL\tREMOTE\tHOST SOCKETS")
+	for _, ctr := range containers {
+		for _, p := range ctr.Processes {
+			for _, s := range p.Sockets {
+				hostSockets := ""
+				for i, hs := range s.HostSockets {
+					if i > 0 {
+						hostSockets += ","
+					}
+					hostSockets += fmt.Sprintf("%d(%s)", hs.Sockfd, hs.State)
+					if hs.Entry != nil {
+						hostSockets += fmt.Sprintf("=%s:%s", hs.Entry.Transport, hs.Entry.Address)
+					}
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\t%d\t%d\t%s\t%s\t%s\n",
+					ctr.NotifFd, ctr.ID, ctr.VIP, p.Pid, s.Fd, s.State, s.Domain, s.Type, s.LocalVAddr, s.RemoteVAddr, hostSockets)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func (c *ctl) version(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	v, err := c.client.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]string{
+			"client": version.Version,
+			"server": v.Version,
+		})
+	}
+	fmt.Fprintf(c.out, "Client: %s\nServer: %s\n", version.Version, v.Version)
+	return nil
+}
+
+func (c *ctl) printJSON(v any) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseMatch parses the IP or CIDR and the -ports, -protocol and -local-vip flags following it.
+func parseMatch(ip string, args []string) (accesscontrol.Match, error) {
+	fs := flag.NewFlagSet("acl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	ports := fs.String("ports", "", "")
+	protocol := fs.String("protocol", "", "")
+	localVIP := fs.String("local-vip", "", "")
+	if err := fs.Parse(args); err != nil {
+		return accesscontrol.Match{}, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return accesscontrol.Match{}, errUsage
+	}
+	match, err := accesscontrol.ParseMatch(ip, *ports, *protocol)
+	if err != nil {
+		return accesscontrol.Match{}, err
+	}
+	match.LocalVIP, err = accesscontrol.ParseLocalVIP(*localVIP)
+	return match, err
+}
+
+func orAny(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
+	}
+	return ip, nil
+}
+
+func parseVIPPort(vipStr, vportStr string) (net.IP, uint16, error) {
+	vip, err := parseIP(vipStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	vport, err := strconv.ParseUint(vportStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid vport %q", vportStr)
+	}
+	return vip, uint16(vport), nil
+}
+
+// parseEntry parses VIP VPORT TRANSPORT ADDRESS.
+func parseEntry(args []string) (*destination.Entry, error) {
+	vip, vport, err := parseVIPPort(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	transport, err := destination.ParseTransportType(args[2])
+	if err != nil {
+		return nil, err
+	}
+	address, err := destination.ParseTransportAddr(transport, args[3])
+	if err != nil {
+		return nil, err
+	}
+	return &destination.Entry{
+		VIP:       vip,
+		VPort:     vport,
+		Transport: transport,
+		Address:   address,
+	}, nil
+}
+
+// parseEntryFlags parses the -weight, -balancer, -connect-timeout and -transports flags following the entry.
+func parseEntryFlags(entry *destination.Entry, args []string) error {
+	fs := flag.NewFlagSet("dest", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	weight := fs.Uint("weight", 0, "")
+	balancer := fs.String("balancer", "", "")
+	connectTimeout := fs.String("connect-timeout", "", "")
+	transports := fs.String("transports", "", "")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	if *weight > math.MaxUint32 {
+		return fmt.Errorf("invalid weight %d", *weight)
+	}
+	b, err := destination.ParseBalancerType(*balancer)
+	if err != nil {
+		return err
+	}
+	timeout, err := destination.ParseConnectTimeout(*connectTimeout)
+	if err != nil {
+		return err
+	}
+	var names []string
+	if *transports != "" {
+		names = strings.Split(*transports, ",")
+	}
+	order, err := destination.ParseTransportOrder(names)
+	if err != nil {
+		return err
+	}
+	entry.Weight = uint32(*weight)
+	entry.Balancer = b
+	entry.ConnectTimeout = timeout
+	entry.Transports = order
+	return nil
+}
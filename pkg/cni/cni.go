@@ -1,121 +1,241 @@
 package cni
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/registry"
 )
 
+// timeout is the timeout of each command talking to tiaccoon.
+const timeout = 10 * time.Second
+
+// NetConf is the network configuration of the plugin.
+// The plugin must be chained after a plugin which assigns the IP of the container.
+type NetConf struct {
+	types.NetConf
+	// APISocket is the control-plane API socket of tiaccoon on the node.
+	APISocket string `json:"apiSocket"`
+}
+
 type Handler struct {
 }
 
+// pluginInfo is the CNI versions supported by the plugin.
+var pluginInfo = version.PluginSupports("0.4.0", "1.0.0", "1.1.0")
+
 func (h *Handler) Start(tiaccoonVersion string) {
-	skel.PluginMainFuncs(
-		skel.CNIFuncs{
-			Add:    h.Add,
-			Del:    h.Del,
-			Check:  h.Check,
-			GC:     h.GC,
-			Status: h.Status,
-		},
-		version.PluginSupports("0.4.0", "1.0.0", "1.1.0"),
-		fmt.Sprintf("CNI plugin tiaccoon %s", tiaccoonVersion),
-	)
+	skel.PluginMainFuncs(h.funcs(), pluginInfo, fmt.Sprintf("CNI plugin tiaccoon %s", tiaccoonVersion))
 }
 
+func (h *Handler) funcs() skel.CNIFuncs {
+	return skel.CNIFuncs{
+		Add:    h.Add,
+		Del:    h.Del,
+		Check:  h.Check,
+		GC:     h.GC,
+		Status: h.Status,
+	}
+}
+
+// Add registers the IP of the container in prevResult as its VIP.
+// prevResult is passed through unchanged because tiaccoon adds no interfaces or addresses to the container.
 func (h *Handler) Add(args *skel.CmdArgs) error {
-	err := logCmdArgs("ADD", args)
+	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	return printPrevResult(args)
+	result, err := parsePrevResult(conf)
+	if err != nil {
+		return err
+	}
+	vip, err := containerIP(result, args.IfName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reg := &registry.Registration{
+		ContainerID: args.ContainerID,
+		IfName:      args.IfName,
+		Network:     conf.Name,
+		Netns:       args.Netns,
+		VIP:         vip,
+	}
+	if err := api.NewClient(conf.APISocket).PutRegistration(ctx, reg); err != nil {
+		return fmt.Errorf("failed to register container %s: %w", args.ContainerID, err)
+	}
+	return types.PrintResult(result, conf.CNIVersion)
 }
 
+// Del unregisters the container. tiaccoon removes the destination entries bound by its sockets.
+// It succeeds if the container is not registered or tiaccoon is not running, since DEL must be idempotent.
+// A registration left by tiaccoon not running is removed by GC.
 func (h *Handler) Del(args *skel.CmdArgs) error {
-	err := logCmdArgs("DEL", args)
+	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	return printPrevResult(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = api.NewClient(conf.APISocket).DeleteRegistration(ctx, args.ContainerID)
+	if err != nil && !isNotFound(err) && !isNotRunning(err) {
+		return fmt.Errorf("failed to unregister container %s: %w", args.ContainerID, err)
+	}
+	return nil
 }
 
+// Check verifies the container is registered with the IP in prevResult.
 func (h *Handler) Check(args *skel.CmdArgs) error {
-	err := logCmdArgs("CHECK", args)
+	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	return printPrevResult(args)
-}
-
-func (h *Handler) GC(args *skel.CmdArgs) error {
-	err := logCmdArgs("GC", args)
+	result, err := parsePrevResult(conf)
 	if err != nil {
 		return err
 	}
-	return printPrevResult(args)
-}
-
-func (h *Handler) Status(args *skel.CmdArgs) error {
-	err := logCmdArgs("STATUS", args)
+	vip, err := containerIP(result, args.IfName)
 	if err != nil {
 		return err
 	}
-	return printPrevResult(args)
-}
 
-func logCmdArgs(cmd string, args *skel.CmdArgs) error {
-	str := fmt.Sprintf("Command: %s\n", cmd)
-	str += fmt.Sprintf("	ContainerID: %s\n", args.ContainerID)
-	str += fmt.Sprintf("	Netns: %s\n", args.Netns)
-	str += fmt.Sprintf("	IfName: %s\n", args.IfName)
-	str += fmt.Sprintf("	Args: %s\n", args.Args)
-	str += fmt.Sprintf("	Path: %s\n", args.Path)
-	str += fmt.Sprintf("	NetnsOverride: %s\n", args.NetnsOverride)
-	str += fmt.Sprintf("	StdinData: %s\n", args.StdinData)
-
-	err := os.MkdirAll("/var/run/tiaccoon", 0755)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reg, err := api.NewClient(conf.APISocket).GetRegistration(ctx, args.ContainerID)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get registration of container %s: %w", args.ContainerID, err)
 	}
-	f, err := os.OpenFile("/var/run/tiaccoon/tiaccoon-cni.log", os.O_APPEND|os.O_WRONLY, 0755)
+	if !reg.VIP.Equal(vip) {
+		return fmt.Errorf("container %s is registered with vip %s, expected %s", args.ContainerID, reg.VIP, vip)
+	}
+	return nil
+}
+
+// GC unregisters the containers of the network which are not in the valid attachments.
+func (h *Handler) GC(args *skel.CmdArgs) error {
+	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = fmt.Fprintf(f, str)
-	return err
-}
+	valid := make(map[string]struct{}, len(conf.ValidAttachments))
+	for _, attachment := range conf.ValidAttachments {
+		valid[attachment.ContainerID] = struct{}{}
+	}
 
-func parseNetConf(data []byte) (*types.NetConf, error) {
-	conf := &types.NetConf{}
-	err := json.Unmarshal(data, conf)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := api.NewClient(conf.APISocket)
+	regs, err := client.ListRegistrations(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to list registrations: %w", err)
 	}
-	return conf, nil
+	var errs []error
+	for _, reg := range regs {
+		if reg.Network != conf.Name {
+			continue
+		}
+		if _, ok := valid[reg.ContainerID]; ok {
+			continue
+		}
+		if err := client.DeleteRegistration(ctx, reg.ContainerID); err != nil && !isNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to unregister container %s: %w", reg.ContainerID, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func printPrevResult(args *skel.CmdArgs) error {
+// Status reports whether tiaccoon is serving the API.
+func (h *Handler) Status(args *skel.CmdArgs) error {
 	conf, err := parseNetConf(args.StdinData)
 	if err != nil {
 		return err
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := api.NewClient(conf.APISocket).Version(ctx); err != nil {
+		return types.NewError(types.ErrTryAgainLater, "tiaccoon is not available", err.Error())
+	}
+	return nil
+}
+
+func parseNetConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, types.NewError(types.ErrDecodingFailure, "failed to parse network configuration", err.Error())
+	}
+	if conf.APISocket == "" {
+		return nil, types.NewError(types.ErrInvalidNetworkConfig, "apiSocket is required", "")
+	}
+	return conf, nil
+}
+
+func parsePrevResult(conf *NetConf) (*current.Result, error) {
 	if conf.RawPrevResult == nil {
-		return fmt.Errorf("Required prevResult missing")
+		return nil, types.NewError(types.ErrInvalidNetworkConfig, "prevResult is required: tiaccoon must be chained after a plugin assigning IPs", "")
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, err
 	}
+	return current.NewResultFromResult(conf.PrevResult)
+}
 
-	if err := version.ParsePrevResult(conf); err != nil {
-		return err
+// containerIP returns the first address of the interface named ifName in the container, preferring IPv4 to IPv6.
+// An address without the interface is used if there are no such addresses.
+func containerIP(result *current.Result, ifName string) (net.IP, error) {
+	if ip := containerIPOf(result, ifName, true); ip != nil {
+		return ip, nil
 	}
-	result, err := current.NewResultFromResult(conf.PrevResult)
-	if err != nil {
-		return err
+	if ip := containerIPOf(result, ifName, false); ip != nil {
+		return ip, nil
 	}
+	return nil, types.NewError(types.ErrInvalidNetworkConfig, fmt.Sprintf("no IP address of %s in prevResult", ifName), "")
+}
 
-	return types.PrintResult(result, conf.CNIVersion)
+func containerIPOf(result *current.Result, ifName string, ipv4 bool) net.IP {
+	var fallback net.IP
+	for _, ipConfig := range result.IPs {
+		ip := ipConfig.Address.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if (len(ip) == net.IPv4len) != ipv4 {
+			continue
+		}
+		if ipConfig.Interface == nil {
+			if fallback == nil {
+				fallback = ip
+			}
+			continue
+		}
+		i := *ipConfig.Interface
+		if i >= 0 && i < len(result.Interfaces) && result.Interfaces[i].Sandbox != "" && result.Interfaces[i].Name == ifName {
+			return ip
+		}
+	}
+	return fallback
+}
+
+func isNotFound(err error) bool {
+	var statusErr *api.StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+// isNotRunning reports whether tiaccoon is not serving the API socket, which is missing or left by a stopped tiaccoon.
+func isNotRunning(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)
 }
@@ -0,0 +1,256 @@
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/registry"
+)
+
+const (
+	containerID = "container1"
+	netns       = "/var/run/netns/test"
+)
+
+// startAPI serves the control-plane API backed by a registry like tiaccoon on the node.
+func startAPI(t *testing.T) (*registry.Registry, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ctx = log.ContextWithLogger(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	dir := t.TempDir()
+	reg := registry.New(filepath.Join(dir, "registry.json"))
+	socketPath := filepath.Join(dir, "api.sock")
+	srv := api.NewServer(accesscontrol.NewManager(true), destination.NewManager(false), nil, reg, socketPath)
+	go srv.Start(ctx)
+	t.Cleanup(func() { srv.Close(ctx) })
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the api socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return reg, socketPath
+}
+
+// netConf returns the network configuration chained after a plugin which assigned ip to eth0.
+func netConf(t *testing.T, apiSocket, ip string) []byte {
+	t.Helper()
+	conf := map[string]any{
+		"cniVersion": "1.0.0",
+		"name":       "test",
+		"type":       "tiaccoon",
+		"apiSocket":  apiSocket,
+	}
+	if ip != "" {
+		conf["prevResult"] = map[string]any{
+			"cniVersion": "1.0.0",
+			"interfaces": []map[string]any{{"name": "eth0", "sandbox": netns}},
+			"ips":        []map[string]any{{"address": ip + "/24", "interface": 0}},
+		}
+	}
+	return marshal(t, conf)
+}
+
+// gcConf returns the network configuration of GC and STATUS, which needs CNI 1.1.0, with the valid container IDs.
+func gcConf(t *testing.T, apiSocket string, valid ...string) []byte {
+	t.Helper()
+	attachments := []map[string]any{}
+	for _, id := range valid {
+		attachments = append(attachments, map[string]any{"containerID": id, "ifname": "eth0"})
+	}
+	return marshal(t, map[string]any{
+		"cniVersion":                "1.1.0",
+		"name":                      "test",
+		"type":                      "tiaccoon",
+		"apiSocket":                 apiSocket,
+		"cni.dev/valid-attachments": attachments,
+	})
+}
+
+func marshal(t *testing.T, conf map[string]any) []byte {
+	t.Helper()
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// run runs the command of the plugin through skel like the container runtime, returning what is printed to stdout.
+func run(t *testing.T, command string, conf []byte) ([]byte, *types.Error) {
+	t.Helper()
+	t.Setenv("CNI_COMMAND", command)
+	t.Setenv("CNI_CONTAINERID", containerID)
+	t.Setenv("CNI_NETNS", netns)
+	t.Setenv("CNI_IFNAME", "eth0")
+	t.Setenv("CNI_PATH", "/opt/cni/bin")
+
+	dir := t.TempDir()
+	stdin, err := os.Create(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	if _, err := stdin.Write(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+
+	origStdin, origStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	h := &Handler{}
+	cniErr := skel.PluginMainFuncsWithError(h.funcs(), pluginInfo, "test")
+	os.Stdin, os.Stdout = origStdin, origStdout
+
+	out, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, cniErr
+}
+
+func TestAddCheckDel(t *testing.T) {
+	reg, socketPath := startAPI(t)
+	conf := netConf(t, socketPath, "10.0.0.5")
+
+	out, cniErr := run(t, "ADD", conf)
+	if cniErr != nil {
+		t.Fatalf("ADD: %v", cniErr)
+	}
+	result := &current.Result{}
+	if err := json.Unmarshal(out, result); err != nil {
+		t.Fatalf("ADD printed invalid result %q: %v", out, err)
+	}
+	if n := len(result.Interfaces); n != 1 || result.Interfaces[0].Name != "eth0" || result.Interfaces[0].Sandbox != netns {
+		t.Errorf("ADD result interfaces = %v, want eth0 of prevResult only", result.Interfaces)
+	}
+	got := reg.Get(containerID)
+	if got == nil {
+		t.Fatal("container is not registered after ADD")
+	}
+	want := &registry.Registration{ContainerID: containerID, IfName: "eth0", Network: "test", Netns: netns, VIP: net.ParseIP("10.0.0.5").To4()}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("registration = %+v, want %+v", got, want)
+	}
+
+	if _, cniErr := run(t, "CHECK", conf); cniErr != nil {
+		t.Errorf("CHECK: %v", cniErr)
+	}
+	if _, cniErr := run(t, "CHECK", netConf(t, socketPath, "10.0.0.6")); cniErr == nil {
+		t.Error("CHECK succeeded with another IP")
+	}
+
+	if _, cniErr := run(t, "DEL", conf); cniErr != nil {
+		t.Fatalf("DEL: %v", cniErr)
+	}
+	if reg.Get(containerID) != nil {
+		t.Error("container is registered after DEL")
+	}
+	if _, cniErr := run(t, "DEL", conf); cniErr != nil {
+		t.Errorf("DEL of an unregistered container: %v", cniErr)
+	}
+	if _, cniErr := run(t, "CHECK", conf); cniErr == nil {
+		t.Error("CHECK succeeded after DEL")
+	}
+}
+
+func TestAddWithoutPrevResult(t *testing.T) {
+	reg, socketPath := startAPI(t)
+
+	_, cniErr := run(t, "ADD", netConf(t, socketPath, ""))
+	if cniErr == nil || cniErr.Code != types.ErrInvalidNetworkConfig {
+		t.Errorf("ADD without prevResult = %v, want code %d", cniErr, types.ErrInvalidNetworkConfig)
+	}
+	if reg.Get(containerID) != nil {
+		t.Error("container is registered without prevResult")
+	}
+}
+
+func TestDelWithoutTiaccoon(t *testing.T) {
+	conf := netConf(t, filepath.Join(t.TempDir(), "api.sock"), "10.0.0.5")
+	if _, cniErr := run(t, "DEL", conf); cniErr != nil {
+		t.Errorf("DEL without tiaccoon: %v", cniErr)
+	}
+}
+
+// TestDelStaleSocket runs DEL on the socket left by tiaccoon which is not running.
+func TestDelStaleSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	if _, cniErr := run(t, "DEL", netConf(t, socketPath, "10.0.0.5")); cniErr != nil {
+		t.Errorf("DEL with a stale socket: %v", cniErr)
+	}
+}
+
+func TestGC(t *testing.T) {
+	reg, socketPath := startAPI(t)
+	ctx := context.Background()
+	for _, r := range []*registry.Registration{
+		{ContainerID: "valid", Network: "test", VIP: net.ParseIP("10.0.0.1").To4()},
+		{ContainerID: "stale", Network: "test", VIP: net.ParseIP("10.0.0.2").To4()},
+		{ContainerID: "other", Network: "other", VIP: net.ParseIP("10.0.0.3").To4()},
+	} {
+		if err := reg.Register(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, cniErr := run(t, "GC", gcConf(t, socketPath, "valid")); cniErr != nil {
+		t.Fatalf("GC: %v", cniErr)
+	}
+	if reg.Get("valid") == nil {
+		t.Error("valid container is unregistered by GC")
+	}
+	if reg.Get("stale") != nil {
+		t.Error("stale container is left registered by GC")
+	}
+	if reg.Get("other") == nil {
+		t.Error("container of another network is unregistered by GC")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	_, socketPath := startAPI(t)
+	if _, cniErr := run(t, "STATUS", gcConf(t, socketPath)); cniErr != nil {
+		t.Errorf("STATUS: %v", cniErr)
+	}
+
+	_, cniErr := run(t, "STATUS", gcConf(t, filepath.Join(t.TempDir(), "api.sock")))
+	if cniErr == nil || cniErr.Code != types.ErrTryAgainLater {
+		t.Errorf("STATUS without tiaccoon = %v, want code %d", cniErr, types.ErrTryAgainLater)
+	}
+}
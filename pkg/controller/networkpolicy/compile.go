@@ -0,0 +1,375 @@
+package networkpolicy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/controller"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Rules is the access control rules compiled for a pod.
+type Rules struct {
+	Client []*accesscontrol.Entry // egress
+	Server []*accesscontrol.Entry // ingress
+}
+
+var anyIPNets = []*net.IPNet{
+	{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// Compile compiles the NetworkPolicies selecting the pod into its access control rules.
+// pods and namespaces are used to resolve podSelector and namespaceSelector of the peers.
+// services are used to allow the ClusterIPs of the egress peer pods, since containers connect to them
+// rather than the pod IPs. A ClusterIP port is allowed if its target port is allowed for the pod.
+//
+// The rules do not depend on the default policy of tiaccoon: isolation is expressed with deny rules for 0.0.0.0/0 and ::/0,
+// and a pod not isolated in a direction gets allow rules for them instead.
+// ipBlock.except is expressed with deny rules of the longer prefixes, so it also takes precedence over
+// the allow rules of shorter prefixes from other peers.
+// SCTP ports and named ports which cannot be resolved are skipped.
+func Compile(pod *corev1.Pod, policies []*networkingv1.NetworkPolicy, pods []*corev1.Pod, namespaces []*corev1.Namespace, services []*corev1.Service) (*Rules, error) {
+	c := &compiler{
+		pods:            pods,
+		services:        services,
+		namespaceLabels: make(map[string]labels.Set, len(namespaces)),
+	}
+	for _, ns := range namespaces {
+		c.namespaceLabels[ns.Name] = labels.Set(ns.Labels)
+	}
+
+	ingress, egress := ruleSet{}, ruleSet{}
+	var ingressIsolated, egressIsolated bool
+	for _, np := range policies {
+		if np.Namespace != pod.Namespace {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("networkpolicy %s/%s: %w", np.Namespace, np.Name, err)
+		}
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		if affectsIngress(np) {
+			ingressIsolated = true
+			for i, rule := range np.Spec.Ingress {
+				peers, err := c.peers(np.Namespace, rule.From)
+				if err != nil {
+					return nil, fmt.Errorf("networkpolicy %s/%s: ingress[%d]: %w", np.Namespace, np.Name, i, err)
+				}
+				for _, p := range peers {
+					// Ports of ingress rules are the ports of the selected pod.
+					ingress.allow(p, ports(rule.Ports, pod))
+				}
+			}
+		}
+		if affectsEgress(np) {
+			egressIsolated = true
+			for i, rule := range np.Spec.Egress {
+				peers, err := c.peers(np.Namespace, rule.To)
+				if err != nil {
+					return nil, fmt.Errorf("networkpolicy %s/%s: egress[%d]: %w", np.Namespace, np.Name, i, err)
+				}
+				for _, p := range peers {
+					// Ports of egress rules are the ports of the peer pod.
+					matches := ports(rule.Ports, p.pod)
+					egress.allow(p, matches)
+					if p.pod != nil {
+						c.allowServices(egress, p.pod, matches)
+					}
+				}
+			}
+		}
+	}
+
+	return &Rules{
+		Client: egress.entries(egressIsolated),
+		Server: ingress.entries(ingressIsolated),
+	}, nil
+}
+
+func affectsIngress(np *networkingv1.NetworkPolicy) bool {
+	if len(np.Spec.PolicyTypes) == 0 {
+		return true
+	}
+	return slices.Contains(np.Spec.PolicyTypes, networkingv1.PolicyTypeIngress)
+}
+
+func affectsEgress(np *networkingv1.NetworkPolicy) bool {
+	if len(np.Spec.PolicyTypes) == 0 {
+		return len(np.Spec.Egress) > 0
+	}
+	return slices.Contains(np.Spec.PolicyTypes, networkingv1.PolicyTypeEgress)
+}
+
+type compiler struct {
+	pods            []*corev1.Pod
+	services        []*corev1.Service
+	namespaceLabels map[string]labels.Set
+}
+
+// peer is an address allowed by a rule.
+type peer struct {
+	ipNet  *net.IPNet
+	except []*net.IPNet
+	pod    *corev1.Pod // nil for ipBlock
+}
+
+// peers resolves the peers of a rule in the namespace. No peers means all addresses.
+func (c *compiler) peers(namespace string, npPeers []networkingv1.NetworkPolicyPeer) ([]peer, error) {
+	if len(npPeers) == 0 {
+		peers := make([]peer, 0, len(anyIPNets))
+		for _, ipNet := range anyIPNets {
+			peers = append(peers, peer{ipNet: ipNet})
+		}
+		return peers, nil
+	}
+
+	var peers []peer
+	for _, npPeer := range npPeers {
+		if npPeer.IPBlock != nil {
+			p, err := ipBlockPeer(npPeer.IPBlock)
+			if err != nil {
+				return nil, err
+			}
+			peers = append(peers, p)
+			continue
+		}
+
+		nsSelector := labels.Nothing()
+		if npPeer.NamespaceSelector != nil {
+			var err error
+			nsSelector, err = metav1.LabelSelectorAsSelector(npPeer.NamespaceSelector)
+			if err != nil {
+				return nil, err
+			}
+		}
+		podSelector := labels.Everything()
+		if npPeer.PodSelector != nil {
+			var err error
+			podSelector, err = metav1.LabelSelectorAsSelector(npPeer.PodSelector)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, pod := range c.pods {
+			if !controller.HasPodIP(pod) {
+				continue
+			}
+			if npPeer.NamespaceSelector == nil {
+				if pod.Namespace != namespace {
+					continue
+				}
+			} else if !nsSelector.Matches(c.namespaceLabels[pod.Namespace]) {
+				continue
+			}
+			if !podSelector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			for _, podIP := range pod.Status.PodIPs {
+				ip := net.ParseIP(podIP.IP)
+				if ip == nil {
+					continue
+				}
+				peers = append(peers, peer{ipNet: accesscontrol.IPNetFromIP(ip), pod: pod})
+			}
+		}
+	}
+	return peers, nil
+}
+
+// allowServices allows the ClusterIPs of the Services selecting the pod for the service ports
+// whose target ports are in the matches.
+func (c *compiler) allowServices(s ruleSet, pod *corev1.Pod, matches []portMatch) {
+	for _, svc := range c.services {
+		if svc.Namespace != pod.Namespace || len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if !labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		svcMatches := servicePorts(svc, pod, matches)
+		if len(svcMatches) == 0 {
+			continue
+		}
+		clusterIPs := svc.Spec.ClusterIPs
+		if len(clusterIPs) == 0 {
+			clusterIPs = []string{svc.Spec.ClusterIP}
+		}
+		for _, clusterIP := range clusterIPs {
+			ip := net.ParseIP(clusterIP)
+			if ip == nil {
+				continue // None of headless Services
+			}
+			s.allow(peer{ipNet: accesscontrol.IPNetFromIP(ip)}, svcMatches)
+		}
+	}
+}
+
+// servicePorts returns the ports of the Service whose target ports of the pod are in the matches.
+func servicePorts(svc *corev1.Service, pod *corev1.Pod, matches []portMatch) []portMatch {
+	var svcMatches []portMatch
+	for _, svcPort := range svc.Spec.Ports {
+		protocol := svcPort.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		var sockType int
+		switch protocol {
+		case corev1.ProtocolTCP:
+			sockType = syscall.SOCK_STREAM
+		case corev1.ProtocolUDP:
+			sockType = syscall.SOCK_DGRAM
+		default:
+			continue
+		}
+
+		target := uint16(svcPort.Port)
+		switch {
+		case svcPort.TargetPort.Type == intstr.String:
+			port, ok := namedPort(pod, svcPort.TargetPort.StrVal, protocol)
+			if !ok {
+				continue
+			}
+			target = port
+		case svcPort.TargetPort.IntVal != 0:
+			target = uint16(svcPort.TargetPort.IntVal)
+		}
+
+		for _, m := range matches {
+			if (m.sockType == 0 || m.sockType == sockType) && m.ports.Contains(target) {
+				svcMatches = append(svcMatches, portMatch{ports: accesscontrol.PortRange{Min: uint16(svcPort.Port), Max: uint16(svcPort.Port)}, sockType: sockType})
+				break
+			}
+		}
+	}
+	return svcMatches
+}
+
+func ipBlockPeer(ipBlock *networkingv1.IPBlock) (peer, error) {
+	ipNet, err := accesscontrol.ParseIPNet(ipBlock.CIDR)
+	if err != nil {
+		return peer{}, fmt.Errorf("ipBlock: %w", err)
+	}
+	p := peer{ipNet: ipNet}
+	for _, except := range ipBlock.Except {
+		exceptIPNet, err := accesscontrol.ParseIPNet(except)
+		if err != nil {
+			return peer{}, fmt.Errorf("ipBlock.except: %w", err)
+		}
+		p.except = append(p.except, exceptIPNet)
+	}
+	return p, nil
+}
+
+type portMatch struct {
+	ports    accesscontrol.PortRange
+	sockType int
+}
+
+// ports resolves the ports of a rule. Named ports are resolved against the container ports of the pod.
+// No ports means all ports.
+func ports(npPorts []networkingv1.NetworkPolicyPort, pod *corev1.Pod) []portMatch {
+	if len(npPorts) == 0 {
+		return []portMatch{{ports: accesscontrol.AnyPort}}
+	}
+
+	var matches []portMatch
+	for _, npPort := range npPorts {
+		protocol := corev1.ProtocolTCP
+		if npPort.Protocol != nil {
+			protocol = *npPort.Protocol
+		}
+		var sockType int
+		switch protocol {
+		case corev1.ProtocolTCP:
+			sockType = syscall.SOCK_STREAM
+		case corev1.ProtocolUDP:
+			sockType = syscall.SOCK_DGRAM
+		default:
+			continue
+		}
+
+		switch {
+		case npPort.Port == nil:
+			matches = append(matches, portMatch{ports: accesscontrol.AnyPort, sockType: sockType})
+		case npPort.Port.Type == intstr.Int:
+			r := accesscontrol.PortRange{Min: uint16(npPort.Port.IntVal), Max: uint16(npPort.Port.IntVal)}
+			if npPort.EndPort != nil {
+				r.Max = uint16(*npPort.EndPort)
+			}
+			matches = append(matches, portMatch{ports: r, sockType: sockType})
+		default:
+			if port, ok := namedPort(pod, npPort.Port.StrVal, protocol); ok {
+				matches = append(matches, portMatch{ports: accesscontrol.PortRange{Min: port, Max: port}, sockType: sockType})
+			}
+		}
+	}
+	return matches
+}
+
+func namedPort(pod *corev1.Pod, name string, protocol corev1.Protocol) (uint16, bool) {
+	if pod == nil {
+		return 0, false
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			p := port.Protocol
+			if p == "" {
+				p = corev1.ProtocolTCP
+			}
+			if port.Name == name && p == protocol {
+				return uint16(port.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ruleSet is the rules keyed by accesscontrol.Match. Allow rules win over deny rules of the same match
+// because NetworkPolicy rules are additive.
+type ruleSet map[string]*accesscontrol.Entry
+
+func (s ruleSet) allow(p peer, matches []portMatch) {
+	for _, m := range matches {
+		s.add(accesscontrol.Match{IPNet: p.ipNet, Ports: m.ports, SockType: m.sockType}, true)
+		for _, except := range p.except {
+			s.add(accesscontrol.Match{IPNet: except, Ports: m.ports, SockType: m.sockType}, false)
+		}
+	}
+}
+
+func (s ruleSet) add(match accesscontrol.Match, policy bool) {
+	key := match.String()
+	if entry, ok := s[key]; ok && (entry.Policy || !policy) {
+		return
+	}
+	s[key] = &accesscontrol.Entry{Match: match, Policy: policy}
+}
+
+// entries returns the rules with the rules for all addresses, ordered by the match.
+func (s ruleSet) entries(isolated bool) []*accesscontrol.Entry {
+	for _, ipNet := range anyIPNets {
+		s.add(accesscontrol.Match{IPNet: ipNet, Ports: accesscontrol.AnyPort}, !isolated)
+	}
+	entries := make([]*accesscontrol.Entry, 0, len(s))
+	for _, entry := range s {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(x, y *accesscontrol.Entry) int {
+		return strings.Compare(x.Match.String(), y.Match.String())
+	})
+	return entries
+}
@@ -0,0 +1,225 @@
+package networkpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/controller"
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// syncKey is the only key of the queue. Any change of pods, namespaces, services or policies may change
+// the peers of every pod, so the rules of all pods on the node are compiled again.
+const syncKey = "sync"
+
+// Origin is the accesscontrol.Entry Origin of the rules pushed by the controller.
+// Only these rules are replaced, so rules added by the config file or tiaccoonctl are kept.
+const Origin = "networkpolicy"
+
+// Controller compiles NetworkPolicies into the access control rules of the pods on the node
+// and pushes them to tiaccoon of the node through the control-plane API served on apiSocketPath.
+// The rules of each pod are scoped by its pod IP as the local VIP.
+type Controller struct {
+	factory       informers.SharedInformerFactory
+	nodeName      string
+	apiSocketPath string
+
+	queue workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewController registers the informers to the factory, so it must be called before the factory is started.
+func NewController(factory informers.SharedInformerFactory, nodeName, apiSocketPath string) (*Controller, error) {
+	c := &Controller{
+		factory:       factory,
+		nodeName:      nodeName,
+		apiSocketPath: apiSocketPath,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "networkpolicy"},
+		),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { c.queue.Add(syncKey) },
+		UpdateFunc: func(any, any) { c.queue.Add(syncKey) },
+		DeleteFunc: func(any) { c.queue.Add(syncKey) },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		factory.Core().V1().Pods().Informer(),
+		factory.Core().V1().Namespaces().Informer(),
+		factory.Core().V1().Services().Informer(),
+		factory.Networking().V1().NetworkPolicies().Informer(),
+	} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("failed to add event handler: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Controller) Close(ctx context.Context) {
+	logger := log.FromContext(ctx).With("component", "networkpolicy controller")
+	logger.DebugContext(ctx, "Closing networkpolicy controller")
+	c.queue.ShutDown()
+}
+
+// Start runs the controller until ctx is done. The factory must have been started.
+func (c *Controller) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).With("component", "networkpolicy controller")
+	ctx = log.ContextWithLogger(ctx, logger)
+	logger.DebugContext(ctx, "Starting networkpolicy controller")
+
+	for typ, ok := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("failed to sync informer cache of %v", typ)
+		}
+	}
+	logger.InfoContext(ctx, "networkpolicy controller started", "nodeName", c.nodeName, "apiSocketPath", c.apiSocketPath)
+
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNextItem(ctx) {
+	}
+	return nil
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	logger := log.FromContext(ctx)
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx); err != nil {
+		logger.ErrorContext(ctx, "Failed to sync access control rules, retrying", "error", err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) sync(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	pods, err := c.factory.Core().V1().Pods().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	namespaces, err := c.factory.Core().V1().Namespaces().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	services, err := c.factory.Core().V1().Services().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	policies, err := c.factory.Networking().V1().NetworkPolicies().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list networkpolicies: %w", err)
+	}
+
+	if _, err := os.Stat(c.apiSocketPath); errors.Is(err, os.ErrNotExist) {
+		logger.DebugContext(ctx, "node is not served by tiaccoon", "apiSocketPath", c.apiSocketPath)
+		return nil
+	}
+
+	// The rules of all pods are pushed at once. Nothing is pushed if a pod fails to compile,
+	// so that its current rules are not removed.
+	all := &Rules{}
+	var errs []error
+	for _, pod := range pods {
+		if pod.Spec.NodeName != c.nodeName || !controller.HasPodIP(pod) {
+			continue
+		}
+		rules, err := Compile(pod, policies, pods, namespaces, services)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pod %s/%s: %w", pod.Namespace, pod.Name, err))
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			localVIP, err := accesscontrol.ParseLocalVIP(podIP.IP)
+			if err != nil || localVIP == nil {
+				continue
+			}
+			all.Client = append(all.Client, scoped(rules.Client, localVIP)...)
+			all.Server = append(all.Server, scoped(rules.Server, localVIP)...)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return push(ctx, api.NewClient(c.apiSocketPath), all)
+}
+
+// scoped returns copies of the rules applied only to the containers of the local VIP.
+func scoped(rules []*accesscontrol.Entry, localVIP net.IP) []*accesscontrol.Entry {
+	scoped := make([]*accesscontrol.Entry, 0, len(rules))
+	for _, rule := range rules {
+		match := rule.Match
+		match.LocalVIP = localVIP
+		scoped = append(scoped, &accesscontrol.Entry{Match: match, Policy: rule.Policy, Origin: Origin})
+	}
+	return scoped
+}
+
+// push makes the rules of tiaccoon with Origin equal to the rules, applying only the difference.
+func push(ctx context.Context, client *api.Client, rules *Rules) error {
+	if err := pushSide(ctx, client, api.SideClient, rules.Client); err != nil {
+		return err
+	}
+	return pushSide(ctx, client, api.SideServer, rules.Server)
+}
+
+func pushSide(ctx context.Context, client *api.Client, side string, rules []*accesscontrol.Entry) error {
+	logger := log.FromContext(ctx).With("side", side)
+
+	current, err := client.ListAccessControl(ctx, side)
+	if err != nil {
+		return fmt.Errorf("failed to list %s rules: %w", side, err)
+	}
+	currentRules := make(map[string]*accesscontrol.Entry, len(current.Rules))
+	for _, rule := range current.Rules {
+		if rule.Origin != Origin {
+			continue
+		}
+		currentRules[rule.Match.String()] = rule
+	}
+	desiredRules := make(map[string]*accesscontrol.Entry, len(rules))
+	for _, rule := range rules {
+		desiredRules[rule.Match.String()] = rule
+	}
+
+	// Upsert first so that a pod is not left without the new rules while the old ones are removed.
+	for key, rule := range desiredRules {
+		if old, ok := currentRules[key]; ok && old.Policy == rule.Policy {
+			continue
+		}
+		if err := client.PutAccessControl(ctx, side, rule); err != nil {
+			return fmt.Errorf("failed to put %s rule for %s: %w", side, key, err)
+		}
+		logger.InfoContext(ctx, "access control rule upserted", "match", key, "policy", accesscontrol.FormatPolicy(rule.Policy))
+	}
+	for key, rule := range currentRules {
+		if _, ok := desiredRules[key]; ok {
+			continue
+		}
+		if err := client.DeleteAccessControl(ctx, side, rule.Match); err != nil {
+			return fmt.Errorf("failed to delete %s rule for %s: %w", side, key, err)
+		}
+		logger.InfoContext(ctx, "access control rule removed", "match", key)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package networkpolicy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const nodeName = "node1"
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return log.ContextWithLogger(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// startAPI serves the control-plane API on socketPath like tiaccoon of the node.
+func startAPI(t *testing.T, ctx context.Context, socketPath string) *accesscontrol.Manager {
+	t.Helper()
+	am := accesscontrol.NewManager(true)
+	srv := api.NewServer(am, destination.NewManager(false), nil, nil, socketPath)
+	go srv.Start(ctx)
+	t.Cleanup(func() { srv.Close(ctx) })
+	eventually(t, "api socket is created", func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	})
+	return am
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func testPod(name, ip string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Spec:       corev1.PodSpec{NodeName: nodeName},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  ip,
+			PodIPs: []corev1.PodIP{{IP: ip}},
+		},
+	}
+}
+
+func ingressPolicy(from map[string]string) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{{
+					PodSelector: &metav1.LabelSelector{MatchLabels: from},
+				}},
+			}},
+		},
+	}
+}
+
+// TestControllerReconcile adds, updates and deletes a NetworkPolicy and checks the rules pushed to tiaccoon of the node.
+func TestControllerReconcile(t *testing.T) {
+	ctx := testContext(t)
+	socketPath := filepath.Join(t.TempDir(), "api.sock")
+	am := startAPI(t, ctx, socketPath)
+
+	// A rule of the config file or tiaccoonctl is kept.
+	manual := &accesscontrol.Entry{Match: accesscontrol.Match{IPNet: accesscontrol.IPNetFromIP(net.ParseIP("192.168.0.1")), Ports: accesscontrol.AnyPort}, Policy: false}
+	if err := am.UpsertServer(ctx, manual); err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		testPod("web", "10.0.0.1", map[string]string{"app": "web"}),
+		testPod("client", "10.0.0.2", map[string]string{"app": "client"}),
+		testPod("other", "10.0.0.3", map[string]string{"app": "other"}),
+	)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	c, err := NewController(factory, nodeName, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory.Start(ctx.Done())
+	go c.Start(ctx)
+	t.Cleanup(func() { c.Close(ctx) })
+
+	// Only the rules of web are scoped by its VIP. client and other are not isolated.
+	allowed := func(ip string) bool {
+		return am.ServerEntries.View(net.ParseIP("10.0.0.1")).Apply(ctx, net.ParseIP(ip), 80, syscall.SOCK_STREAM)
+	}
+	clientAllowed := func(ip string) bool {
+		return am.ServerEntries.View(net.ParseIP("10.0.0.2")).Apply(ctx, net.ParseIP(ip), 80, syscall.SOCK_STREAM)
+	}
+	policies := client.NetworkingV1().NetworkPolicies("default")
+
+	// Not isolated without policies.
+	eventually(t, "all peers are allowed", func() bool {
+		return allowed("10.0.0.2") && allowed("10.0.0.3") && len(am.ServerEntries.List(ctx)) > 0
+	})
+
+	if _, err := policies.Create(ctx, ingressPolicy(map[string]string{"app": "client"}), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "only client is allowed after add", func() bool {
+		return allowed("10.0.0.2") && !allowed("10.0.0.3")
+	})
+
+	if _, err := policies.Update(ctx, ingressPolicy(map[string]string{"app": "other"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "only other is allowed after update", func() bool {
+		return !allowed("10.0.0.2") && allowed("10.0.0.3")
+	})
+	if !clientAllowed("10.0.0.3") {
+		t.Error("rules of web are applied to client")
+	}
+
+	if err := policies.Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "all peers are allowed after delete", func() bool {
+		return allowed("10.0.0.2") && allowed("10.0.0.3")
+	})
+
+	if got := am.ServerEntries.Get(ctx, manual.Match); got == nil || got.Policy != manual.Policy || got.Origin != "" {
+		t.Errorf("manual rule = %+v, want kept", got)
+	}
+	for _, e := range am.ServerEntries.List(ctx) {
+		if e.Origin == Origin && e.LocalVIP == nil {
+			t.Errorf("rule %s is not scoped by a local VIP", e.Match)
+		}
+	}
+}
+
+// TestCompileEgressService checks that the ClusterIP of a Service selecting an egress peer is allowed
+// for the service ports whose target ports are allowed.
+func TestCompileEgressService(t *testing.T) {
+	client := testPod("client", "10.0.0.2", map[string]string{"app": "client"})
+	web := testPod("web", "10.0.0.1", map[string]string{"app": "web"})
+	web.Spec.Containers = []corev1.Container{{Name: "web", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}}}
+	tcp := corev1.ProtocolTCP
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "client"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress: []networkingv1.NetworkPolicyEgressRule{{
+				To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+				Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &intstr.IntOrString{Type: intstr.String, StrVal: "http"}}},
+			}},
+		},
+	}
+	services := []*corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: corev1.ServiceSpec{
+				Selector:  map[string]string{"app": "web"},
+				ClusterIP: "10.96.0.10",
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, TargetPort: intstr.FromString("http")},
+					{Name: "admin", Port: 9090, TargetPort: intstr.FromInt32(9090)},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"},
+			Spec: corev1.ServiceSpec{
+				Selector:  map[string]string{"app": "other"},
+				ClusterIP: "10.96.0.20",
+				Ports:     []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt32(8080)}},
+			},
+		},
+	}
+
+	rules, err := Compile(client, []*networkingv1.NetworkPolicy{policy}, []*corev1.Pod{client, web}, nil, services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am := accesscontrol.NewManager(true)
+	ctx := testContext(t)
+	for _, rule := range rules.Client {
+		if err := am.UpsertClient(ctx, rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		ip   string
+		port uint16
+		want bool
+	}{
+		{"10.0.0.1", 8080, true},
+		{"10.0.0.1", 80, false},
+		{"10.96.0.10", 80, true},
+		{"10.96.0.10", 9090, false},
+		{"10.96.0.20", 80, false},
+	} {
+		if got := am.ClientEntries.Apply(ctx, net.ParseIP(tt.ip), tt.port, syscall.SOCK_STREAM); got != tt.want {
+			t.Errorf("Apply(%s:%d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// NodeInternalIPs returns the first IPv4 and IPv6 InternalIPs of the node. Either of them may be nil.
+func NodeInternalIPs(node *corev1.Node) (ipv4, ipv6 net.IP) {
+	if node == nil {
+		return nil, nil
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != corev1.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(addr.Address)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			if ipv4 == nil {
+				ipv4 = ip.To4()
+			}
+		default:
+			if ipv6 == nil {
+				ipv6 = ip
+			}
+		}
+	}
+	return ipv4, ipv6
+}
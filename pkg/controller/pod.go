@@ -0,0 +1,21 @@
+// Package controller has the helpers shared by the controllers pushing rules and entries to tiaccoon of each pod.
+package controller
+
+import (
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// HasPodIP reports whether the pod has its own IPs which tiaccoon may see as VIPs.
+func HasPodIP(pod *corev1.Pod) bool {
+	if pod.Spec.HostNetwork || len(pod.Status.PodIPs) == 0 {
+		return false
+	}
+	return pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// APISocketPath returns the path of the control-plane API socket served by tiaccoon of the pod.
+func APISocketPath(apiSocketDir string, pod *corev1.Pod) string {
+	return filepath.Join(apiSocketDir, pod.Status.PodIP+".sock")
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/controller"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+const (
+	// AnnotationHostPorts is the pod annotation mapping the container ports to the host ports
+	// which the tiaccoon of the pod listens on for RDMA, IPv6 and IPv4, e.g. "8080=30080,9090=30090".
+	// A container port not in the annotation is listened on the same host port.
+	AnnotationHostPorts = "tiaccoon.io/host-ports"
+	// AnnotationRDMAIP is the node annotation advertising the IPv4 address of its RDMA device.
+	AnnotationRDMAIP = "tiaccoon.io/rdma-ip"
+)
+
+// UNIXSocketPath returns the path of the UNIX socket which the tiaccoon of a co-located backend listens on.
+func UNIXSocketPath(unixSocketDir string, podIP net.IP, port uint16) string {
+	return filepath.Join(unixSocketDir, fmt.Sprintf("%s_%d.sock", podIP, port))
+}
+
+// Compile compiles the Services into the destination entries of the pod.
+// pods and nodes are used to resolve the backends of the EndpointSlices.
+//
+// Each TCP port of a Service gets the entries of its ready backends for the ClusterIP.
+// A backend on the same node as the pod is reached by UNIX, a backend is reached by RDMA
+// if both nodes advertise AnnotationRDMAIP, and by the IPv6 and IPv4 InternalIPs of the node otherwise.
+// The pod itself gets the entries of its own IP and port for each Service it backs,
+// which tell its tiaccoon where to listen.
+// A Service with the ClientIP session affinity gets BalancerHash, so a pod keeps reaching the same backend.
+// Only IPv4 ClusterIPs and backends are supported. Other ports and invalid annotations are skipped.
+func Compile(pod *corev1.Pod, unixSocketDir string, services []*corev1.Service, endpointSlices []*discoveryv1.EndpointSlice, pods []*corev1.Pod, nodes []*corev1.Node) []*destination.Entry {
+	c := &compiler{
+		unixSocketDir: unixSocketDir,
+		pods:          make(map[string]*corev1.Pod, len(pods)),
+		nodes:         make(map[string]*corev1.Node, len(nodes)),
+	}
+	for _, p := range pods {
+		c.pods[p.Namespace+"/"+p.Name] = p
+	}
+	for _, n := range nodes {
+		c.nodes[n.Name] = n
+	}
+	c.local = c.nodes[pod.Spec.NodeName]
+	podIP := net.ParseIP(pod.Status.PodIP).To4()
+
+	slicesByService := make(map[string][]*discoveryv1.EndpointSlice)
+	for _, es := range endpointSlices {
+		name := es.Labels[discoveryv1.LabelServiceName]
+		if name == "" || es.AddressType != discoveryv1.AddressTypeIPv4 {
+			continue
+		}
+		key := es.Namespace + "/" + name
+		slicesByService[key] = append(slicesByService[key], es)
+	}
+
+	s := entrySet{}
+	for _, svc := range services {
+		clusterIP := net.ParseIP(svc.Spec.ClusterIP).To4()
+		if clusterIP == nil {
+			continue
+		}
+		for _, svcPort := range svc.Spec.Ports {
+			if svcPort.Protocol != "" && svcPort.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			for _, b := range c.backends(slicesByService[svc.Namespace+"/"+svc.Name], svcPort.Name) {
+				entries := c.entries(clusterIP, uint16(svcPort.Port), b)
+				if svc.Spec.SessionAffinity == corev1.ServiceAffinityClientIP {
+					for _, e := range entries {
+						e.Balancer = destination.BalancerHash
+					}
+				}
+				s.add(entries)
+				if podIP != nil && b.ip.Equal(podIP) && b.nodeName == pod.Spec.NodeName {
+					s.add(c.entries(b.ip, b.port, b))
+				}
+			}
+		}
+	}
+	return s.list()
+}
+
+type compiler struct {
+	unixSocketDir string
+	pods          map[string]*corev1.Pod  // keyed by namespace/name
+	nodes         map[string]*corev1.Node // keyed by name
+	local         *corev1.Node            // nil if unknown
+}
+
+// backend is a ready endpoint of a Service port.
+type backend struct {
+	ip       net.IP
+	port     uint16 // port of the pod
+	pod      *corev1.Pod
+	nodeName string
+}
+
+func (c *compiler) backends(endpointSlices []*discoveryv1.EndpointSlice, portName string) []backend {
+	var backends []backend
+	for _, es := range endpointSlices {
+		i := slices.IndexFunc(es.Ports, func(p discoveryv1.EndpointPort) bool {
+			return p.Name != nil && *p.Name == portName && p.Port != nil &&
+				(p.Protocol == nil || *p.Protocol == corev1.ProtocolTCP)
+		})
+		if i < 0 {
+			continue
+		}
+		port := uint16(*es.Ports[i].Port)
+		for _, ep := range es.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			b := backend{port: port}
+			if ep.NodeName != nil {
+				b.nodeName = *ep.NodeName
+			}
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				b.pod = c.pods[ep.TargetRef.Namespace+"/"+ep.TargetRef.Name]
+			}
+			for _, addr := range ep.Addresses {
+				if ip := net.ParseIP(addr).To4(); ip != nil {
+					b.ip = ip
+					backends = append(backends, b)
+				}
+			}
+		}
+	}
+	return backends
+}
+
+// entries returns the entries to reach the backend by vip and vport in the priority order of transports.
+func (c *compiler) entries(vip net.IP, vport uint16, b backend) []*destination.Entry {
+	var entries []*destination.Entry
+	add := func(transport destination.TransportType, address destination.TransportAddr) {
+		entries = append(entries, &destination.Entry{VIP: vip, VPort: vport, Transport: transport, Address: address})
+	}
+
+	if c.local != nil && b.nodeName == c.local.Name {
+		add(destination.TransportUNIX, destination.NewTransportAddrUNIX(UNIXSocketPath(c.unixSocketDir, b.ip, b.port)))
+	}
+	hostPort, ok := hostPort(b.pod, b.port)
+	if !ok {
+		return entries
+	}
+	node := c.nodes[b.nodeName]
+	if ip := rdmaIP(node); ip != nil && rdmaIP(c.local) != nil {
+		add(destination.TransportRDMA, destination.NewTransportAddrRDMA([4]byte(ip), hostPort))
+	}
+	ipv4, ipv6 := controller.NodeInternalIPs(node)
+	if ipv6 != nil {
+		add(destination.TransportIPv6, destination.NewTransportAddrIPv6([16]byte(ipv6.To16()), int(hostPort)))
+	}
+	if ipv4 != nil {
+		add(destination.TransportIPv4, destination.NewTransportAddrIPv4([4]byte(ipv4), int(hostPort)))
+	}
+	return entries
+}
+
+// hostPort resolves the host port of the port of the pod by AnnotationHostPorts.
+// It returns false if the annotation of the pod is invalid.
+func hostPort(pod *corev1.Pod, port uint16) (uint16, bool) {
+	if pod == nil || pod.Annotations[AnnotationHostPorts] == "" {
+		return port, true
+	}
+	for _, pair := range strings.Split(pod.Annotations[AnnotationHostPorts], ",") {
+		containerPort, hostPort, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return 0, false
+		}
+		c, err := strconv.ParseUint(containerPort, 10, 16)
+		if err != nil {
+			return 0, false
+		}
+		h, err := strconv.ParseUint(hostPort, 10, 16)
+		if err != nil {
+			return 0, false
+		}
+		if uint16(c) == port {
+			return uint16(h), true
+		}
+	}
+	return port, true
+}
+
+func rdmaIP(node *corev1.Node) net.IP {
+	if node == nil {
+		return nil
+	}
+	return net.ParseIP(node.Annotations[AnnotationRDMAIP]).To4()
+}
+
+// entrySet is the entries deduplicated by VIP, vport, transport and address.
+type entrySet map[string]*destination.Entry
+
+func (s entrySet) add(entries []*destination.Entry) {
+	for _, e := range entries {
+		s[fmt.Sprintf("%s:%d %s %s", e.VIP, e.VPort, e.Transport, e.Address)] = e
+	}
+}
+
+// list returns the entries ordered by VIP, vport, the priority of transports and address.
+func (s entrySet) list() []*destination.Entry {
+	entries := make([]*destination.Entry, 0, len(s))
+	for _, e := range s {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, compareEntry)
+	return entries
+}
+
+func compareEntry(x, y *destination.Entry) int {
+	if c := bytes.Compare(x.VIP.To16(), y.VIP.To16()); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(x.VPort, y.VPort); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(x.Transport, y.Transport); c != 0 {
+		return c
+	}
+	return strings.Compare(x.Address.String(), y.Address.String())
+}
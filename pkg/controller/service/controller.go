@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/controller"
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// syncKey is the only key of the queue. A change of a backend or a node may change
+// the entries of every pod, so the entries of all pods on the node are compiled again.
+const syncKey = "sync"
+
+// Controller compiles Services and EndpointSlices into the destination entries of the pods on the node
+// and pushes them to the tiaccoon of each pod through the control-plane API.
+// The tiaccoon of a pod is expected to serve the API on <apiSocketDir>/<pod IP>.sock.
+type Controller struct {
+	factory       informers.SharedInformerFactory
+	nodeName      string
+	apiSocketDir  string
+	unixSocketDir string
+
+	queue workqueue.TypedRateLimitingInterface[string]
+}
+
+// NewController registers the informers to the factory, so it must be called before the factory is started.
+func NewController(factory informers.SharedInformerFactory, nodeName, apiSocketDir, unixSocketDir string) (*Controller, error) {
+	c := &Controller{
+		factory:       factory,
+		nodeName:      nodeName,
+		apiSocketDir:  apiSocketDir,
+		unixSocketDir: unixSocketDir,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "service"},
+		),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { c.queue.Add(syncKey) },
+		UpdateFunc: func(any, any) { c.queue.Add(syncKey) },
+		DeleteFunc: func(any) { c.queue.Add(syncKey) },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		factory.Core().V1().Pods().Informer(),
+		factory.Core().V1().Nodes().Informer(),
+		factory.Core().V1().Services().Informer(),
+		factory.Discovery().V1().EndpointSlices().Informer(),
+	} {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("failed to add event handler: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *Controller) Close(ctx context.Context) {
+	logger := log.FromContext(ctx).With("component", "service controller")
+	logger.DebugContext(ctx, "Closing service controller")
+	c.queue.ShutDown()
+}
+
+// Start runs the controller until ctx is done. The factory must have been started.
+func (c *Controller) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).With("component", "service controller")
+	ctx = log.ContextWithLogger(ctx, logger)
+	logger.DebugContext(ctx, "Starting service controller")
+
+	for typ, ok := range c.factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			return fmt.Errorf("failed to sync informer cache of %v", typ)
+		}
+	}
+	logger.InfoContext(ctx, "service controller started", "nodeName", c.nodeName, "apiSocketDir", c.apiSocketDir, "unixSocketDir", c.unixSocketDir)
+
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNextItem(ctx) {
+	}
+	return nil
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	logger := log.FromContext(ctx)
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx); err != nil {
+		logger.ErrorContext(ctx, "Failed to sync destination entries, retrying", "error", err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) sync(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	pods, err := c.factory.Core().V1().Pods().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	nodes, err := c.factory.Core().V1().Nodes().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list nodes: %w", err)
+	}
+	services, err := c.factory.Core().V1().Services().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	endpointSlices, err := c.factory.Discovery().V1().EndpointSlices().Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list endpointslices: %w", err)
+	}
+
+	var errs []error
+	for _, pod := range pods {
+		if pod.Spec.NodeName != c.nodeName || !controller.HasPodIP(pod) {
+			continue
+		}
+		podLogger := logger.With("pod", pod.Namespace+"/"+pod.Name, "podIP", pod.Status.PodIP)
+		podCtx := log.ContextWithLogger(ctx, podLogger)
+
+		socketPath := controller.APISocketPath(c.apiSocketDir, pod)
+		if _, err := os.Stat(socketPath); errors.Is(err, os.ErrNotExist) {
+			podLogger.DebugContext(podCtx, "pod is not served by tiaccoon", "socketPath", socketPath)
+			continue
+		}
+
+		entries := Compile(pod, c.unixSocketDir, services, endpointSlices, pods, nodes)
+		if err := push(podCtx, api.NewClient(socketPath), entries); err != nil {
+			errs = append(errs, fmt.Errorf("pod %s/%s: %w", pod.Namespace, pod.Name, err))
+			continue
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// group is the entries of a VIP and port, which are replaced at once through the API.
+type group struct {
+	vip     net.IP
+	vport   uint16
+	entries []*destination.Entry
+}
+
+// key identifies the entries of the group regardless of their order.
+func (g *group) key() string {
+	keys := make([]string, 0, len(g.entries))
+	for _, e := range g.entries {
+		keys = append(keys, fmt.Sprintf("%s %s %d %s %s %v", e.Transport, e.Address, e.Weight, e.Balancer, e.ConnectTimeout, e.Transports))
+	}
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
+
+// bound reports whether tiaccoon added the entries for the vport allocated by bind(2).
+func (g *group) bound() bool {
+	return slices.ContainsFunc(g.entries, func(e *destination.Entry) bool { return e.Origin == destination.OriginBind })
+}
+
+func groupEntries(entries []*destination.Entry) map[string]*group {
+	groups := make(map[string]*group)
+	for _, e := range entries {
+		key := fmt.Sprintf("%s:%d", e.VIP, e.VPort)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{vip: e.VIP, vport: e.VPort}
+			groups[key] = g
+		}
+		g.entries = append(g.entries, e)
+	}
+	return groups
+}
+
+// push makes the destination entries of tiaccoon equal to the entries, replacing only the changed VIPs and ports.
+// Entries of port 0 and the entries added by tiaccoon for binding to any port are kept unless desired.
+func push(ctx context.Context, client *api.Client, entries []*destination.Entry) error {
+	logger := log.FromContext(ctx)
+
+	current, err := client.ListDestinations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list destinations: %w", err)
+	}
+	currentGroups := groupEntries(current)
+	desiredGroups := groupEntries(entries)
+
+	// Replace first so that a pod is not left without the new entries while the old ones are removed.
+	for key, g := range desiredGroups {
+		if old, ok := currentGroups[key]; ok && old.key() == g.key() {
+			continue
+		}
+		if err := client.PutDestinations(ctx, g.vip, g.vport, g.entries); err != nil {
+			return fmt.Errorf("failed to put destinations for %s: %w", key, err)
+		}
+		logger.InfoContext(ctx, "destination entries replaced", "destination", key, "entries", g.key())
+	}
+	for key, g := range currentGroups {
+		if _, ok := desiredGroups[key]; ok || g.vport == 0 || g.bound() {
+			continue
+		}
+		if err := client.DeleteDestinations(ctx, g.vip, g.vport); err != nil {
+			return fmt.Errorf("failed to delete destinations for %s: %w", key, err)
+		}
+		logger.InfoContext(ctx, "destination entries removed", "destination", key)
+	}
+	return nil
+}
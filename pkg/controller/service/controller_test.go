@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+const nodeName = "node1"
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return log.ContextWithLogger(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// startAPI serves the control-plane API of the pod IP on apiSocketDir like the tiaccoon of the pod.
+func startAPI(t *testing.T, ctx context.Context, apiSocketDir, podIP string) *destination.Manager {
+	t.Helper()
+	dm := destination.NewManager(false)
+	socketPath := filepath.Join(apiSocketDir, podIP+".sock")
+	srv := api.NewServer(accesscontrol.NewManager(true), dm, nil, nil, socketPath)
+	go srv.Start(ctx)
+	t.Cleanup(func() { srv.Close(ctx) })
+	eventually(t, "api socket is created", func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	})
+	return dm
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func testNode(name, ip string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func testPod(name, node, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  ip,
+			PodIPs: []corev1.PodIP{{IP: ip}},
+		},
+	}
+}
+
+func testEndpointSlice(ip string, port int32) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web-1",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{ip},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)},
+			NodeName:   ptr.To("node2"),
+			TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web"},
+		}},
+		Ports: []discoveryv1.EndpointPort{{Name: ptr.To(""), Port: ptr.To(port)}},
+	}
+}
+
+// TestControllerReconcile adds, updates and deletes a Service and its EndpointSlice
+// and checks the entries pushed to the tiaccoon of the pod.
+func TestControllerReconcile(t *testing.T) {
+	ctx := testContext(t)
+	apiSocketDir := t.TempDir()
+	dm := startAPI(t, ctx, apiSocketDir, "10.0.0.1")
+
+	client := fake.NewSimpleClientset(
+		testNode(nodeName, "192.168.0.1"),
+		testNode("node2", "192.168.0.2"),
+		testPod("client", nodeName, "10.0.0.1"),
+		testPod("web", "node2", "10.0.1.1"),
+	)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	c, err := NewController(factory, nodeName, apiSocketDir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory.Start(ctx.Done())
+	go c.Start(ctx)
+	t.Cleanup(func() { c.Close(ctx) })
+
+	clusterIP := net.ParseIP("10.96.0.10")
+	addresses := func() []string {
+		var addrs []string
+		for _, entries := range dm.Entries.GetClient(ctx, clusterIP, 80) {
+			for _, e := range entries {
+				addrs = append(addrs, e.Transport.String()+" "+e.Address.String())
+			}
+		}
+		return addrs
+	}
+	hasAddresses := func(want ...string) func() bool {
+		return func() bool {
+			got := addresses()
+			if len(got) != len(want) {
+				return false
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	services := client.CoreV1().Services("default")
+	endpointSlices := client.DiscoveryV1().EndpointSlices("default")
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: clusterIP.String(),
+			Ports:     []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	if _, err := services.Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := endpointSlices.Create(ctx, testEndpointSlice("10.0.1.1", 8080), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := destination.NewTransportAddrIPv4([4]byte{192, 168, 0, 2}, 8080)
+	eventually(t, "entry is added", hasAddresses(destination.TransportIPv4.String()+" "+want.String()))
+
+	if _, err := endpointSlices.Update(ctx, testEndpointSlice("10.0.1.1", 9090), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want = destination.NewTransportAddrIPv4([4]byte{192, 168, 0, 2}, 9090)
+	eventually(t, "entry is updated", hasAddresses(destination.TransportIPv4.String()+" "+want.String()))
+
+	if err := services.Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := endpointSlices.Delete(ctx, "web-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "entry is removed", hasAddresses())
+}
+
+// TestPushKeepsBoundEntries checks push removes stale entries in any vport but the entries added by tiaccoon for bind(2).
+func TestPushKeepsBoundEntries(t *testing.T) {
+	ctx := testContext(t)
+	apiSocketDir := t.TempDir()
+	dm := startAPI(t, ctx, apiSocketDir, "10.0.0.1")
+
+	clusterIP, podVIP := net.ParseIP("10.96.0.10"), net.ParseIP("10.0.0.1")
+	stale := &destination.Entry{Transport: destination.TransportIPv4, Address: destination.NewTransportAddrIPv4([4]byte{192, 168, 0, 2}, 40000)}
+	dm.Replace(ctx, clusterIP, 40000, []*destination.Entry{stale})
+	bound := &destination.Entry{Transport: destination.TransportIPv4, Address: destination.NewTransportAddrIPv4([4]byte{192, 168, 0, 1}, 50000), Origin: destination.OriginBind}
+	dm.Replace(ctx, podVIP, 40000, []*destination.Entry{bound})
+
+	if err := push(ctx, api.NewClient(filepath.Join(apiSocketDir, "10.0.0.1.sock")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(slices.Concat(dm.Entries.GetClient(ctx, clusterIP, 40000)...)); n != 0 {
+		t.Errorf("%d stale entries of the service port 40000 are left", n)
+	}
+	if n := len(slices.Concat(dm.Entries.GetClient(ctx, podVIP, 40000)...)); n != 1 {
+		t.Errorf("%d entries bound to the vport 40000, want 1", n)
+	}
+}
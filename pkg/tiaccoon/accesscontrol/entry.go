@@ -2,52 +2,445 @@ package accesscontrol
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
-	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/vip"
 )
 
+// Match selects the peers and ports an access control rule applies to.
+type Match struct {
+	IPNet    *net.IPNet // peer VIPs. A single IP has the full-length mask (/32 or /128).
+	Ports    PortRange  // vports. The client side matches the peer's vport and the server side matches the local vport.
+	SockType int        // syscall.SOCK_STREAM or syscall.SOCK_DGRAM. 0 matches any type.
+
+	// LocalVIP is the VIP of the containers the rule applies to. nil applies to all containers.
+	LocalVIP net.IP
+}
+
+func (m Match) String() string {
+	s := FormatIPNet(m.IPNet)
+	if m.Ports != AnyPort {
+		s += " ports=" + m.Ports.String()
+	}
+	if m.SockType != 0 {
+		s += " protocol=" + FormatProtocol(m.SockType)
+	}
+	if m.LocalVIP != nil {
+		s += " localVIP=" + m.LocalVIP.String()
+	}
+	return s
+}
+
+func (m Match) matches(port uint16, sockType int) bool {
+	return m.Ports.Contains(port) && (m.SockType == 0 || m.SockType == sockType)
+}
+
+// moreSpecific reports whether m is more specific than n within the same prefix.
+func (m Match) moreSpecific(n Match) bool {
+	if m.Ports.size() != n.Ports.size() {
+		return m.Ports.size() < n.Ports.size()
+	}
+	return m.SockType != 0 && n.SockType == 0
+}
+
+// Entry is an access control rule.
+type Entry struct {
+	Match
+	Policy bool
+
+	// Origin tells who added the rule, such as a controller, so that it replaces only its own rules.
+	// Empty is the config file or the control-plane API.
+	Origin string
+}
+
+type entryJSON struct {
+	IP       string `json:"ip"`
+	Ports    string `json:"ports,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	LocalVIP string `json:"localVIP,omitempty"`
+	Policy   string `json:"policy"`
+	Origin   string `json:"origin,omitempty"`
+}
+
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	v := &entryJSON{
+		IP:       FormatIPNet(e.IPNet),
+		Ports:    e.Ports.String(),
+		Protocol: FormatProtocol(e.SockType),
+		Policy:   FormatPolicy(e.Policy),
+		Origin:   e.Origin,
+	}
+	if e.LocalVIP != nil {
+		v.LocalVIP = e.LocalVIP.String()
+	}
+	return json.Marshal(v)
+}
+
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var v entryJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	match, err := ParseMatch(v.IP, v.Ports, v.Protocol)
+	if err != nil {
+		return err
+	}
+	match.LocalVIP, err = ParseLocalVIP(v.LocalVIP)
+	if err != nil {
+		return err
+	}
+	policy, err := ParsePolicy(v.Policy)
+	if err != nil {
+		return err
+	}
+	e.Match = match
+	e.Policy = policy
+	e.Origin = v.Origin
+	return nil
+}
+
+// ParseMatch parses the IP or CIDR, the ports and the protocol. Empty ports and protocol match any.
+func ParseMatch(ip, ports, protocol string) (Match, error) {
+	ipNet, err := ParseIPNet(ip)
+	if err != nil {
+		return Match{}, err
+	}
+	portRange, err := ParsePortRange(ports)
+	if err != nil {
+		return Match{}, err
+	}
+	sockType, err := ParseProtocol(protocol)
+	if err != nil {
+		return Match{}, err
+	}
+	return Match{
+		IPNet:    ipNet,
+		Ports:    portRange,
+		SockType: sockType,
+	}, nil
+}
+
+// ParseLocalVIP parses the VIP of the containers a rule applies to. Empty is nil, which applies to all containers.
+func ParseLocalVIP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid local vip %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// PortRange is the inclusive range of ports.
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// AnyPort matches all ports.
+var AnyPort = PortRange{Min: 0, Max: 65535}
+
+// ParsePortRange parses "", "80" or "8000-8080". Empty matches any port.
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return AnyPort, nil
+	}
+	minStr, maxStr, found := strings.Cut(s, "-")
+	if !found {
+		maxStr = minStr
+	}
+	minPort, err := strconv.ParseUint(minStr, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid ports %q", s)
+	}
+	maxPort, err := strconv.ParseUint(maxStr, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid ports %q", s)
+	}
+	if minPort > maxPort {
+		return PortRange{}, fmt.Errorf("invalid ports %q: %d is larger than %d", s, minPort, maxPort)
+	}
+	return PortRange{Min: uint16(minPort), Max: uint16(maxPort)}, nil
+}
+
+// String returns the format parsed by ParsePortRange.
+func (r PortRange) String() string {
+	switch {
+	case r == AnyPort:
+		return ""
+	case r.Min == r.Max:
+		return strconv.Itoa(int(r.Min))
+	default:
+		return fmt.Sprintf("%d-%d", r.Min, r.Max)
+	}
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return r.Min <= port && port <= r.Max
+}
+
+func (r PortRange) size() int {
+	return int(r.Max) - int(r.Min) + 1
+}
+
+// ParseProtocol parses "tcp" or "udp" case-insensitively into the socket type. Empty matches any type.
+func ParseProtocol(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, nil
+	case "tcp":
+		return syscall.SOCK_STREAM, nil
+	case "udp":
+		return syscall.SOCK_DGRAM, nil
+	default:
+		return 0, fmt.Errorf("protocol must be either 'tcp' or 'udp', got %q", s)
+	}
+}
+
+// FormatProtocol returns the format parsed by ParseProtocol.
+func FormatProtocol(sockType int) string {
+	switch sockType {
+	case syscall.SOCK_STREAM:
+		return "tcp"
+	case syscall.SOCK_DGRAM:
+		return "udp"
+	default:
+		return ""
+	}
+}
+
+// ParseIPNet parses an IP or a CIDR. An IP is parsed as the prefix of the full-length mask.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip %q: %w", s, err)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", s)
+	}
+	return IPNetFromIP(ip), nil
+}
+
+// IPNetFromIP returns the prefix of the full-length mask for ip.
+func IPNetFromIP(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// FormatIPNet returns the IP for the full-length mask and the CIDR otherwise.
+func FormatIPNet(ipNet *net.IPNet) string {
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String()
+	}
+	return ipNet.String()
+}
+
+// ParsePolicy parses "allow" or "deny" into the policy value.
+func ParsePolicy(s string) (bool, error) {
+	switch s {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	default:
+		return false, fmt.Errorf("policy must be either 'allow' or 'deny', got %q", s)
+	}
+}
+
+// FormatPolicy returns "allow" or "deny".
+func FormatPolicy(policy bool) string {
+	if policy {
+		return "allow"
+	}
+	return "deny"
+}
+
+// Entries is safe for concurrent use.
+// Writers copy the tries on write and swap them, so Apply on the connect/accept path is lock-free.
 type Entries struct {
 	defaultPolicy bool
-	entries       map[uint64]map[uint64]bool // entries[upper VIP][lower VIP]
+	mu            sync.Mutex // serializes writers
+	// tries has the trie of the rules for each local VIP. The zero Addr has the rules for all containers.
+	tries atomic.Pointer[map[netip.Addr]*trie]
 }
 
 func newEntries(defaultPolicy bool) *Entries {
-	return &Entries{
+	a := &Entries{
 		defaultPolicy: defaultPolicy,
-		entries:       make(map[uint64]map[uint64]bool),
 	}
+	a.tries.Store(&map[netip.Addr]*trie{})
+	return a
+}
+
+// scopeOf returns the key of the trie for the local VIP.
+func scopeOf(localVIP net.IP) (netip.Addr, bool) {
+	if localVIP == nil {
+		return netip.Addr{}, true
+	}
+	return toAddr(localVIP)
+}
+
+func (a *Entries) upsert(ctx context.Context, entry *Entry) error {
+	logger := log.FromContext(ctx).With("func", "accesscontrol.upsert", "match", entry.Match, "policy", entry.Policy)
+	prefix, ok := toPrefix(entry.IPNet)
+	if !ok {
+		return fmt.Errorf("invalid prefix %s", entry.IPNet)
+	}
+	scope, ok := scopeOf(entry.LocalVIP)
+	if !ok {
+		return fmt.Errorf("invalid local vip %s", entry.LocalVIP)
+	}
+	logger.DebugContext(ctx, "parsed", "prefix", prefix, "scope", scope)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur := *a.tries.Load()
+	t, ok := cur[scope]
+	if !ok {
+		t = &trie{}
+	}
+	next := maps.Clone(cur)
+	next[scope] = t.insert(prefix, entry)
+	a.tries.Store(&next)
+	return nil
 }
 
-func (a *Entries) upsert(ctx context.Context, ip net.IP, policy bool) {
-	logger := log.FromContext(ctx).With("func", "accesscontrol.upsert", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)), "policy", policy)
-	upper, lower := vip.IP2Int(ip)
-	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
-	if _, ok := a.entries[upper]; !ok {
-		a.entries[upper] = make(map[uint64]bool)
+func (a *Entries) remove(ctx context.Context, match Match) error {
+	logger := log.FromContext(ctx).With("func", "accesscontrol.remove", "match", match)
+	prefix, ok := toPrefix(match.IPNet)
+	if !ok {
+		return fmt.Errorf("invalid prefix %s", match.IPNet)
+	}
+	scope, ok := scopeOf(match.LocalVIP)
+	if !ok {
+		return fmt.Errorf("invalid local vip %s", match.LocalVIP)
+	}
+	logger.DebugContext(ctx, "parsed", "prefix", prefix, "scope", scope)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur := *a.tries.Load()
+	t, ok := cur[scope]
+	if !ok {
+		return nil
+	}
+	removed := t.remove(prefix, match)
+	if removed == t {
+		return nil
 	}
-	a.entries[upper][lower] = policy
+	next := maps.Clone(cur)
+	if removed.empty() {
+		delete(next, scope)
+	} else {
+		next[scope] = removed
+	}
+	a.tries.Store(&next)
+	return nil
 }
 
-func (a *Entries) remove(ctx context.Context, ip net.IP) {
-	logger := log.FromContext(ctx).With("func", "accesscontrol.remove", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)))
-	upper, lower := vip.IP2Int(ip)
-	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
-	if _, ok := a.entries[upper]; ok {
-		delete(a.entries[upper], lower)
+// Apply returns the policy of the rules for all containers matching the peer ip, the port and the socket type.
+// The rules of the local VIPs are applied by View.
+func (a *Entries) Apply(ctx context.Context, ip net.IP, port uint16, sockType int) bool {
+	return a.View(nil).Apply(ctx, ip, port, sockType)
+}
+
+// View returns the rules seen by the containers with the local VIP. nil sees only the rules for all containers.
+func (a *Entries) View(localVIP net.IP) *View {
+	scope, _ := scopeOf(localVIP)
+	return &View{
+		entries: a,
+		scope:   scope,
 	}
 }
 
-func (a *Entries) Apply(ctx context.Context, ip net.IP) bool {
-	logger := log.FromContext(ctx).With("func", "accesscontrol.Apply", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)))
-	upper, lower := vip.IP2Int(ip)
-	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
-	if v, ok := a.entries[upper]; ok {
-		if policy, ok := v[lower]; ok {
-			return policy
+// View is the rules applied to a container: the rules for its VIP and then the rules for all containers.
+type View struct {
+	entries *Entries
+	scope   netip.Addr
+}
+
+// Apply returns the policy of the rule matching the peer ip, the port and the socket type.
+// Rules with the longest prefix containing ip are tried first and the most specific one among them wins.
+// If none of them matches the port and the socket type, shorter prefixes are tried.
+// The rules for all containers are tried only if none of the rules for the local VIP matches,
+// in the same way as destination.Entries.GetServer falls back to the entries shared by all containers.
+func (v *View) Apply(ctx context.Context, ip net.IP, port uint16, sockType int) bool {
+	logger := log.FromContext(ctx).With("func", "accesscontrol.Apply", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)), "port", port, "sockType", sockType, "scope", v.scope)
+	addr, ok := toAddr(ip)
+	if !ok {
+		logger.WarnContext(ctx, "invalid ip, applying the default policy")
+		return v.entries.defaultPolicy
+	}
+	tries := *v.entries.tries.Load()
+	scopes := []netip.Addr{v.scope}
+	if v.scope.IsValid() {
+		scopes = append(scopes, netip.Addr{})
+	}
+	for _, scope := range scopes {
+		t, ok := tries[scope]
+		if !ok {
+			continue
 		}
+		if entry := t.lookup(addr, port, sockType); entry != nil {
+			logger.DebugContext(ctx, "matched", "match", entry.Match)
+			return entry.Policy
+		}
+	}
+	return v.entries.defaultPolicy
+}
+
+// Get returns the rule for exactly match or nil if not found.
+func (a *Entries) Get(ctx context.Context, match Match) *Entry {
+	prefix, ok := toPrefix(match.IPNet)
+	if !ok {
+		return nil
+	}
+	scope, ok := scopeOf(match.LocalVIP)
+	if !ok {
+		return nil
 	}
+	t, ok := (*a.tries.Load())[scope]
+	if !ok {
+		return nil
+	}
+	return t.get(prefix, match)
+}
+
+// List returns all rules: the rules for all containers and then the rules of each local VIP in the order of the VIPs.
+// The rules of each of them are ordered by IP, by prefix length and then from the most specific.
+func (a *Entries) List(ctx context.Context) []*Entry {
+	tries := *a.tries.Load()
+	scopes := slices.SortedFunc(maps.Keys(tries), netip.Addr.Compare)
+	list := []*Entry{}
+	for _, scope := range scopes {
+		tries[scope].walk(func(entry *Entry) {
+			list = append(list, entry)
+		})
+	}
+	return list
+}
+
+// DefaultPolicy returns the policy applied when no rule matches.
+func (a *Entries) DefaultPolicy() bool {
 	return a.defaultPolicy
 }
@@ -0,0 +1,201 @@
+package accesscontrol
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+)
+
+func testContext() context.Context {
+	return log.ContextWithLogger(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func mustEntry(t *testing.T, ip string, policy bool) *Entry {
+	t.Helper()
+	match, err := ParseMatch(ip, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Entry{Match: match, Policy: policy}
+}
+
+// TestEntriesConcurrent runs readers while writers upsert and remove rules.
+// Readers must always see a consistent trie: the fixed rules apply regardless of the rules being changed.
+func TestEntriesConcurrent(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(false)
+	if err := m.UpsertClient(ctx, mustEntry(t, "10.0.0.0/8", true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.UpsertClient(ctx, mustEntry(t, "10.255.0.0/16", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, readers, iterations = 4, 8, 200
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				entry := mustEntry(t, fmt.Sprintf("10.%d.%d.0/24", w+1, i%250), false)
+				if err := m.UpsertClient(ctx, entry); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%2 == 0 {
+					if err := m.RemoveClient(ctx, entry.Match); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	errs := make(chan error, readers)
+	for range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				if !m.ClientEntries.Apply(ctx, net.ParseIP("10.200.0.1"), 80, syscall.SOCK_STREAM) {
+					errs <- fmt.Errorf("10.200.0.1 is denied at iteration %d", i)
+					return
+				}
+				if m.ClientEntries.Apply(ctx, net.ParseIP("10.255.0.1"), 80, syscall.SOCK_STREAM) {
+					errs <- fmt.Errorf("10.255.0.1 is allowed at iteration %d", i)
+					return
+				}
+				m.ClientEntries.List(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The odd iterations are left upserted.
+	for w := range writers {
+		ip := net.ParseIP(fmt.Sprintf("10.%d.1.1", w+1))
+		if m.ClientEntries.Apply(ctx, ip, 80, syscall.SOCK_STREAM) {
+			t.Errorf("%s is allowed after the writers", ip)
+		}
+		ip = net.ParseIP(fmt.Sprintf("10.%d.0.1", w+1))
+		if !m.ClientEntries.Apply(ctx, ip, 80, syscall.SOCK_STREAM) {
+			t.Errorf("%s is denied after the writers", ip)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    PortRange
+		wantErr bool
+	}{
+		{"", AnyPort, false},
+		{"0", PortRange{0, 0}, false},
+		{"65535", PortRange{65535, 65535}, false},
+		{"0-65535", AnyPort, false},
+		{"8000-8080", PortRange{8000, 8080}, false},
+		{"80-80", PortRange{80, 80}, false},
+		{"8080-8000", PortRange{}, true}, // lo > hi
+		{"65536", PortRange{}, true},
+		{"-1", PortRange{}, true},
+		{"80-", PortRange{}, true},
+		{"-80", PortRange{}, true},
+		{"http", PortRange{}, true},
+		{"1-2-3", PortRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortRange(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+		if err != nil {
+			continue
+		}
+		if again, err := ParsePortRange(got.String()); err != nil || again != got {
+			t.Errorf("ParsePortRange(%q) = %v, %v, want %v", got.String(), again, err, got)
+		}
+	}
+}
+
+func TestPortRangeContains(t *testing.T) {
+	tests := []struct {
+		r    PortRange
+		port uint16
+		want bool
+	}{
+		{AnyPort, 0, true},
+		{AnyPort, 65535, true},
+		{PortRange{0, 0}, 0, true},
+		{PortRange{0, 0}, 1, false},
+		{PortRange{65535, 65535}, 65535, true},
+		{PortRange{65535, 65535}, 65534, false},
+		{PortRange{8000, 8080}, 7999, false},
+		{PortRange{8000, 8080}, 8000, true},
+		{PortRange{8000, 8080}, 8080, true},
+		{PortRange{8000, 8080}, 8081, false},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Contains(tt.port); got != tt.want {
+			t.Errorf("%v.Contains(%d) = %v, want %v", tt.r, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestApplySpecificity(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(false)
+	for _, r := range []struct {
+		ports, protocol string
+		policy          bool
+	}{
+		{"", "", true},
+		{"", "udp", false},
+		{"8000-8999", "", false},
+		{"8080", "", true},
+		{"8080", "tcp", false},
+	} {
+		match, err := ParseMatch("10.0.0.0/24", r.ports, r.protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.UpsertClient(ctx, &Entry{Match: match, Policy: r.policy}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		port     uint16
+		sockType int
+		want     bool
+	}{
+		{80, syscall.SOCK_STREAM, true},   // any
+		{80, syscall.SOCK_DGRAM, false},   // protocol is more specific than any
+		{8001, syscall.SOCK_DGRAM, false}, // a narrower range wins over the protocol
+		{8080, syscall.SOCK_DGRAM, true},  // a single port
+		{8080, syscall.SOCK_STREAM, false},
+		{8999, syscall.SOCK_STREAM, false},
+		{9000, syscall.SOCK_STREAM, true},
+	}
+	ip := net.ParseIP("10.0.0.1")
+	for _, tt := range tests {
+		if got := m.ClientEntries.Apply(ctx, ip, tt.port, tt.sockType); got != tt.want {
+			t.Errorf("Apply(%d, %d) = %v, want %v", tt.port, tt.sockType, got, tt.want)
+		}
+	}
+}
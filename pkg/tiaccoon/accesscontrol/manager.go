@@ -2,7 +2,6 @@ package accesscontrol
 
 import (
 	"context"
-	"net"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 )
@@ -19,22 +18,34 @@ func NewManager(defaultPolicy bool) *Manager {
 	}
 }
 
-func (m *Manager) UpsertClient(ctx context.Context, srcIP net.IP, policy bool) {
-	m.ClientEntries.upsert(ctx, srcIP, policy)
-	log.FromContext(ctx).InfoContext(ctx, "client access control upserted", "srcIP", srcIP, "policy", policy)
+func (m *Manager) UpsertClient(ctx context.Context, entry *Entry) error {
+	if err := m.ClientEntries.upsert(ctx, entry); err != nil {
+		return err
+	}
+	log.FromContext(ctx).InfoContext(ctx, "client access control upserted", "match", entry.Match, "policy", entry.Policy)
+	return nil
 }
 
-func (m *Manager) RemoveClient(ctx context.Context, srcIP net.IP) {
-	m.ClientEntries.remove(ctx, srcIP)
-	log.FromContext(ctx).InfoContext(ctx, "client access control removed", "srcIP", srcIP)
+func (m *Manager) RemoveClient(ctx context.Context, match Match) error {
+	if err := m.ClientEntries.remove(ctx, match); err != nil {
+		return err
+	}
+	log.FromContext(ctx).InfoContext(ctx, "client access control removed", "match", match)
+	return nil
 }
 
-func (m *Manager) UpsertServer(ctx context.Context, dstIP net.IP, policy bool) {
-	m.ServerEntries.upsert(ctx, dstIP, policy)
-	log.FromContext(ctx).InfoContext(ctx, "server access control upserted", "dstIP", dstIP, "policy", policy)
+func (m *Manager) UpsertServer(ctx context.Context, entry *Entry) error {
+	if err := m.ServerEntries.upsert(ctx, entry); err != nil {
+		return err
+	}
+	log.FromContext(ctx).InfoContext(ctx, "server access control upserted", "match", entry.Match, "policy", entry.Policy)
+	return nil
 }
 
-func (m *Manager) RemoveServer(ctx context.Context, dstIP net.IP) {
-	m.ServerEntries.remove(ctx, dstIP)
-	log.FromContext(ctx).InfoContext(ctx, "server access control removed", "dstIP", dstIP)
+func (m *Manager) RemoveServer(ctx context.Context, match Match) error {
+	if err := m.ServerEntries.remove(ctx, match); err != nil {
+		return err
+	}
+	log.FromContext(ctx).InfoContext(ctx, "server access control removed", "match", match)
+	return nil
 }
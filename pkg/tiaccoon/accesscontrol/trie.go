@@ -0,0 +1,263 @@
+package accesscontrol
+
+import (
+	"math/bits"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// trie is a persistent path-compressed binary trie for longest prefix match.
+// Insert and remove copy the nodes on the path and return a new trie, so a trie can be read without locks once stored.
+type trie struct {
+	v4 *node
+	v6 *node
+}
+
+type node struct {
+	prefix  netip.Prefix // masked
+	entries []*Entry     // rules for the prefix ordered from the most specific. Empty if the node is only a branch.
+	child   [2]*node
+}
+
+// with returns entries with entry upserted, keeping the order from the most specific.
+func (n *node) with(entry *Entry) []*Entry {
+	entries := make([]*Entry, 0, len(n.entries)+1)
+	for _, e := range n.entries {
+		if !sameMatch(e.Match, entry.Match) {
+			entries = append(entries, e)
+		}
+	}
+	i := len(entries)
+	for j, e := range entries {
+		if entry.moreSpecific(e.Match) {
+			i = j
+			break
+		}
+	}
+	return slices.Insert(entries, i, entry)
+}
+
+// without returns entries without the rule for match and whether it was found.
+func (n *node) without(match Match) ([]*Entry, bool) {
+	i := slices.IndexFunc(n.entries, func(e *Entry) bool {
+		return sameMatch(e.Match, match)
+	})
+	if i < 0 {
+		return n.entries, false
+	}
+	return slices.Delete(slices.Clone(n.entries), i, i+1), true
+}
+
+// match returns the most specific rule matching port and sockType or nil.
+func (n *node) match(port uint16, sockType int) *Entry {
+	for _, e := range n.entries {
+		if e.matches(port, sockType) {
+			return e
+		}
+	}
+	return nil
+}
+
+// sameMatch compares the ports and the socket type. The prefix is compared by the node.
+func sameMatch(x, y Match) bool {
+	return x.Ports == y.Ports && x.SockType == y.SockType
+}
+
+// toPrefix converts ipNet into a masked prefix. IPv4-mapped IPv6 addresses are treated as IPv4.
+func toPrefix(ipNet *net.IPNet) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, size := ipNet.Mask.Size()
+	if size == 0 {
+		return netip.Prefix{}, false
+	}
+	if addr.Is4In6() && size == 128 {
+		if ones < 96 {
+			return netip.Prefix{}, false
+		}
+		ones -= 96
+	}
+	return netip.PrefixFrom(addr.Unmap(), ones).Masked(), true
+}
+
+func toAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+func (t *trie) empty() bool {
+	return t.v4 == nil && t.v6 == nil
+}
+
+func (t *trie) root(addr netip.Addr) **node {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func (t *trie) insert(p netip.Prefix, entry *Entry) *trie {
+	c := *t
+	root := c.root(p.Addr())
+	*root = insert(*root, p, entry)
+	return &c
+}
+
+func (t *trie) remove(p netip.Prefix, match Match) *trie {
+	c := *t
+	root := c.root(p.Addr())
+	n := remove(*root, p, match)
+	if n == *root {
+		return t
+	}
+	*root = n
+	return &c
+}
+
+// lookup returns the matching rule of the longest prefix containing addr or nil.
+func (t *trie) lookup(addr netip.Addr, port uint16, sockType int) *Entry {
+	var found *Entry
+	for n := *t.root(addr); n != nil && n.prefix.Contains(addr); {
+		if e := n.match(port, sockType); e != nil {
+			found = e
+		}
+		if n.prefix.Bits() == addr.BitLen() {
+			break
+		}
+		n = n.child[bitAt(addr, n.prefix.Bits())]
+	}
+	return found
+}
+
+// get returns the rule for exactly p and match or nil.
+func (t *trie) get(p netip.Prefix, match Match) *Entry {
+	for n := *t.root(p.Addr()); n != nil && n.prefix.Bits() <= p.Bits() && n.prefix.Contains(p.Addr()); {
+		if n.prefix.Bits() == p.Bits() {
+			for _, e := range n.entries {
+				if sameMatch(e.Match, match) {
+					return e
+				}
+			}
+			return nil
+		}
+		n = n.child[bitAt(p.Addr(), n.prefix.Bits())]
+	}
+	return nil
+}
+
+// walk calls fn for each entry ordered by address and then by prefix length, IPv4 first.
+func (t *trie) walk(fn func(*Entry)) {
+	walk(t.v4, fn)
+	walk(t.v6, fn)
+}
+
+func insert(n *node, p netip.Prefix, entry *Entry) *node {
+	if n == nil {
+		return &node{prefix: p, entries: []*Entry{entry}}
+	}
+	common := commonBits(n.prefix, p)
+	switch {
+	case common == n.prefix.Bits() && common == p.Bits():
+		c := *n
+		c.entries = n.with(entry)
+		return &c
+	case common == n.prefix.Bits():
+		c := *n
+		b := bitAt(p.Addr(), common)
+		c.child[b] = insert(n.child[b], p, entry)
+		return &c
+	case common == p.Bits():
+		c := &node{prefix: p, entries: []*Entry{entry}}
+		c.child[bitAt(n.prefix.Addr(), common)] = n
+		return c
+	default:
+		branch := &node{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+		branch.child[bitAt(n.prefix.Addr(), common)] = n
+		branch.child[bitAt(p.Addr(), common)] = &node{prefix: p, entries: []*Entry{entry}}
+		return branch
+	}
+}
+
+// remove returns n itself if the rule is not found.
+func remove(n *node, p netip.Prefix, match Match) *node {
+	if n == nil || n.prefix.Bits() > p.Bits() || !n.prefix.Contains(p.Addr()) {
+		return n
+	}
+	if n.prefix.Bits() == p.Bits() {
+		entries, ok := n.without(match)
+		if !ok {
+			return n
+		}
+		if len(entries) == 0 {
+			if n.child[0] == nil {
+				return n.child[1]
+			}
+			if n.child[1] == nil {
+				return n.child[0]
+			}
+		}
+		c := *n
+		c.entries = entries
+		return &c
+	}
+
+	b := bitAt(p.Addr(), n.prefix.Bits())
+	child := remove(n.child[b], p, match)
+	if child == n.child[b] {
+		return n
+	}
+	c := *n
+	c.child[b] = child
+	// A branch node with a single child is no longer needed.
+	if len(c.entries) == 0 {
+		if c.child[0] == nil {
+			return c.child[1]
+		}
+		if c.child[1] == nil {
+			return c.child[0]
+		}
+	}
+	return &c
+}
+
+func walk(n *node, fn func(*Entry)) {
+	if n == nil {
+		return
+	}
+	for _, e := range n.entries {
+		fn(e)
+	}
+	walk(n.child[0], fn)
+	walk(n.child[1], fn)
+}
+
+// bitAt returns the i-th bit of addr from the most significant bit.
+func bitAt(addr netip.Addr, i int) int {
+	if addr.Is4() {
+		i += 96
+	}
+	a := addr.As16()
+	return int(a[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns the length of the common leading bits of x and y, up to the shorter prefix length.
+func commonBits(x, y netip.Prefix) int {
+	n := min(x.Bits(), y.Bits())
+	offset := 0
+	if x.Addr().Is4() {
+		offset = 96
+	}
+	a, b := x.Addr().As16(), y.Addr().As16()
+	common := 0
+	for i := offset / 8; i < 16 && common < n; i++ {
+		if d := a[i] ^ b[i]; d != 0 {
+			common += bits.LeadingZeros8(d)
+			break
+		}
+		common += 8
+	}
+	return min(common, n)
+}
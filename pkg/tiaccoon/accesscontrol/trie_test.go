@@ -0,0 +1,234 @@
+package accesscontrol
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+func TestApplyLongestPrefix(t *testing.T) {
+	rules := []struct {
+		ip     string
+		ports  string
+		policy bool
+	}{
+		{"0.0.0.0/0", "", false},
+		{"10.0.0.0/8", "", true},
+		{"10.1.0.0/16", "", false},
+		{"10.1.2.0/24", "", true},
+		{"10.1.2.3", "", false},
+		{"10.2.0.0/16", "80", false}, // only for port 80
+		{"::/0", "", true},
+		{"2001:db8::/32", "", false},
+		{"2001:db8:1::/48", "", true},
+		{"2001:db8:1::1", "", false},
+	}
+	tests := []struct {
+		ip   string
+		port uint16
+		want bool
+	}{
+		{"192.168.0.1", 80, false}, // /0
+		{"10.0.0.1", 80, true},     // /8
+		{"10.1.0.1", 80, false},    // /16 within /8
+		{"10.1.2.1", 80, true},     // /24 within /16
+		{"10.1.2.3", 80, false},    // /32
+		{"10.1.2.4", 80, true},     // sibling of /32
+		{"10.2.0.1", 80, false},    // /16 matching the port
+		{"10.2.0.1", 443, true},    // falls back to /8
+		{"::ffff:10.1.2.3", 80, false},
+		{"2001:db9::1", 80, true}, // ::/0
+		{"2001:db8::1", 80, false},
+		{"2001:db8:1::2", 80, true},
+		{"2001:db8:1::1", 80, false}, // /128
+		{"2001:db8:2::1", 80, false},
+	}
+
+	ctx := testContext()
+	m := NewManager(true)
+	for _, r := range rules {
+		match, err := ParseMatch(r.ip, r.ports, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.UpsertServer(ctx, &Entry{Match: match, Policy: r.policy}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range tests {
+		if got := m.ServerEntries.Apply(ctx, net.ParseIP(tt.ip), tt.port, syscall.SOCK_STREAM); got != tt.want {
+			t.Errorf("Apply(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+// TestTrieRemove checks removing rules restores the lookup and compresses the branches.
+func TestTrieRemove(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(false)
+	var matches []Match
+	for _, ip := range []string{"10.0.0.0/8", "10.0.0.0/24", "10.0.1.0/24", "10.128.0.0/9", "0.0.0.0/0"} {
+		entry := mustEntry(t, ip, true)
+		matches = append(matches, entry.Match)
+		if err := m.UpsertServer(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(m.ServerEntries.List(ctx)); n != len(matches) {
+		t.Fatalf("%d rules listed, want %d", n, len(matches))
+	}
+	// Removing a missing rule does not change the trie.
+	shared := func() *trie {
+		if t, ok := (*m.ServerEntries.tries.Load())[netip.Addr{}]; ok {
+			return t
+		}
+		return &trie{}
+	}
+	before := shared()
+	missing := mustEntry(t, "10.0.2.0/24", true).Match
+	if err := m.RemoveServer(ctx, missing); err != nil {
+		t.Fatal(err)
+	}
+	if shared() != before {
+		t.Error("trie is copied by removing a missing rule")
+	}
+
+	for i, match := range matches {
+		if err := m.RemoveServer(ctx, match); err != nil {
+			t.Fatal(err)
+		}
+		if m.ServerEntries.Get(ctx, match) != nil {
+			t.Errorf("%s is left after removal", match)
+		}
+		for _, rest := range matches[i+1:] {
+			if m.ServerEntries.Get(ctx, rest) == nil {
+				t.Errorf("%s is lost by removing %s", rest, match)
+			}
+		}
+		assertCompressed(t, shared().v4)
+	}
+	if root := shared().v4; root != nil {
+		t.Errorf("trie is not empty: %v", root.prefix)
+	}
+	if m.ServerEntries.Apply(ctx, net.ParseIP("10.0.0.1"), 80, syscall.SOCK_STREAM) {
+		t.Error("default policy is not applied after removing all rules")
+	}
+}
+
+// assertCompressed checks every node has rules or two children, and contains its children.
+func assertCompressed(t *testing.T, n *node) {
+	t.Helper()
+	if n == nil {
+		return
+	}
+	if len(n.entries) == 0 && (n.child[0] == nil || n.child[1] == nil) {
+		t.Errorf("branch %s has a single child", n.prefix)
+	}
+	for b, c := range n.child {
+		if c == nil {
+			continue
+		}
+		if c.prefix.Bits() <= n.prefix.Bits() || !n.prefix.Overlaps(c.prefix) || bitAt(c.prefix.Addr(), n.prefix.Bits()) != b {
+			t.Errorf("child %s is misplaced under %s", c.prefix, n.prefix)
+		}
+		assertCompressed(t, c)
+	}
+}
+
+func TestToPrefix(t *testing.T) {
+	mapped := func(ip string, ones int) *net.IPNet {
+		return &net.IPNet{IP: net.ParseIP(ip).To16(), Mask: net.CIDRMask(ones, 128)}
+	}
+	cidr := func(s string) *net.IPNet {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ipNet
+	}
+	tests := []struct {
+		ipNet *net.IPNet
+		want  string
+		ok    bool
+	}{
+		{cidr("10.1.2.3/8"), "10.0.0.0/8", true},
+		{cidr("0.0.0.0/0"), "0.0.0.0/0", true},
+		{cidr("10.1.2.3/32"), "10.1.2.3/32", true},
+		{cidr("2001:db8::1/32"), "2001:db8::/32", true},
+		{cidr("::/0"), "::/0", true},
+		{cidr("2001:db8::1/128"), "2001:db8::1/128", true},
+		{mapped("10.1.2.3", 104), "10.0.0.0/8", true}, // IPv4-mapped
+		{mapped("10.1.2.3", 128), "10.1.2.3/32", true},
+		{mapped("10.1.2.3", 95), "", false}, // shorter than the IPv4-mapped prefix
+		{&net.IPNet{IP: net.IP{10, 0, 0}, Mask: net.CIDRMask(8, 32)}, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := toPrefix(tt.ipNet)
+		if ok != tt.ok || (ok && got != netip.MustParsePrefix(tt.want)) {
+			t.Errorf("toPrefix(%s) = %v, %v, want %s, %v", tt.ipNet, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestViewLocalVIP checks the rules of a local VIP apply only to its view and take precedence over the rules for all containers.
+func TestViewLocalVIP(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(true)
+	web, db := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	for _, r := range []struct {
+		ip       string
+		localVIP net.IP
+		policy   bool
+	}{
+		{"10.1.0.0/16", nil, false},
+		{"0.0.0.0/0", web, false}, // web is isolated
+		{"10.1.2.0/24", web, true},
+		{"10.2.0.1", db, false},
+	} {
+		entry := mustEntry(t, r.ip, r.policy)
+		entry.LocalVIP = r.localVIP
+		if err := m.UpsertServer(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		localVIP net.IP
+		ip       string
+		want     bool
+	}{
+		{nil, "10.1.2.3", false},
+		{nil, "10.2.0.1", true},
+		{web, "10.1.2.3", true},  // the rule of web wins over the longer prefix for all containers
+		{web, "10.1.3.1", false}, // isolated
+		{web, "10.2.0.1", false},
+		{db, "10.1.2.3", false}, // falls back to the rules for all containers
+		{db, "10.2.0.1", false},
+		{db, "10.3.0.1", true}, // default
+		{net.ParseIP("10.0.0.3"), "10.2.0.1", true},
+	}
+	for _, tt := range tests {
+		if got := m.ServerEntries.View(tt.localVIP).Apply(ctx, net.ParseIP(tt.ip), 80, syscall.SOCK_STREAM); got != tt.want {
+			t.Errorf("View(%s).Apply(%s) = %v, want %v", tt.localVIP, tt.ip, got, tt.want)
+		}
+	}
+
+	list := m.ServerEntries.List(ctx)
+	if len(list) != 4 || list[0].LocalVIP != nil || !list[1].LocalVIP.Equal(web) || !list[3].LocalVIP.Equal(db) {
+		t.Errorf("List() = %v, want the rules for all containers first and then by local VIP", list)
+	}
+	match := mustEntry(t, "10.2.0.1", false).Match
+	if m.ServerEntries.Get(ctx, match) != nil {
+		t.Error("rule of db is got without its local VIP")
+	}
+	match.LocalVIP = db
+	if err := m.RemoveServer(ctx, match); err != nil {
+		t.Fatal(err)
+	}
+	if !m.ServerEntries.View(db).Apply(ctx, net.ParseIP("10.2.0.1"), 80, syscall.SOCK_STREAM) {
+		t.Error("rule of db is applied after removal")
+	}
+	if _, ok := (*m.ServerEntries.tries.Load())[netip.MustParseAddr("10.0.0.2")]; ok {
+		t.Error("empty trie of db is kept")
+	}
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/registry"
+)
+
+// StatusError is returned by Client when the server responds with an error.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.StatusCode)
+}
+
+// Client is a client of the control-plane API served by Server.
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	v := &Version{}
+	return v, c.do(ctx, http.MethodGet, "/v1/version", nil, v)
+}
+
+func (c *Client) ListAccessControl(ctx context.Context, side string) (*AccessControlList, error) {
+	list := &AccessControlList{}
+	return list, c.do(ctx, http.MethodGet, "/v1/accesscontrol/"+url.PathEscape(side), nil, list)
+}
+
+func (c *Client) GetAccessControl(ctx context.Context, side string, match accesscontrol.Match) (*accesscontrol.Entry, error) {
+	entry := &accesscontrol.Entry{}
+	return entry, c.do(ctx, http.MethodGet, accessControlPath(side, match), nil, entry)
+}
+
+func (c *Client) PutAccessControl(ctx context.Context, side string, entry *accesscontrol.Entry) error {
+	return c.do(ctx, http.MethodPut, "/v1/accesscontrol/"+url.PathEscape(side), entry, nil)
+}
+
+func (c *Client) DeleteAccessControl(ctx context.Context, side string, match accesscontrol.Match) error {
+	return c.do(ctx, http.MethodDelete, accessControlPath(side, match), nil, nil)
+}
+
+func accessControlPath(side string, match accesscontrol.Match) string {
+	q := url.Values{}
+	q.Set("ip", accesscontrol.FormatIPNet(match.IPNet))
+	if ports := match.Ports.String(); ports != "" {
+		q.Set("ports", ports)
+	}
+	if protocol := accesscontrol.FormatProtocol(match.SockType); protocol != "" {
+		q.Set("protocol", protocol)
+	}
+	if match.LocalVIP != nil {
+		q.Set("localVIP", match.LocalVIP.String())
+	}
+	return "/v1/accesscontrol/" + url.PathEscape(side) + "?" + q.Encode()
+}
+
+func (c *Client) ListDestinations(ctx context.Context) ([]*destination.Entry, error) {
+	entries := []*destination.Entry{}
+	return entries, c.do(ctx, http.MethodGet, "/v1/destinations", nil, &entries)
+}
+
+func (c *Client) ListDestinationHealth(ctx context.Context) ([]*destination.Health, error) {
+	list := []*destination.Health{}
+	return list, c.do(ctx, http.MethodGet, "/v1/destinations/health", nil, &list)
+}
+
+func (c *Client) GetDestinations(ctx context.Context, vip net.IP, vport uint16) ([]*destination.Entry, error) {
+	entries := []*destination.Entry{}
+	return entries, c.do(ctx, http.MethodGet, destinationPath(vip, vport), nil, &entries)
+}
+
+func (c *Client) PutDestinations(ctx context.Context, vip net.IP, vport uint16, entries []*destination.Entry) error {
+	return c.do(ctx, http.MethodPut, destinationPath(vip, vport), entries, nil)
+}
+
+func (c *Client) DeleteDestinations(ctx context.Context, vip net.IP, vport uint16) error {
+	return c.do(ctx, http.MethodDelete, destinationPath(vip, vport), nil, nil)
+}
+
+func (c *Client) ListSockets(ctx context.Context) ([]*Container, error) {
+	containers := []*Container{}
+	return containers, c.do(ctx, http.MethodGet, "/v1/sockets", nil, &containers)
+}
+
+func (c *Client) ListRegistrations(ctx context.Context) ([]*registry.Registration, error) {
+	list := []*registry.Registration{}
+	return list, c.do(ctx, http.MethodGet, "/v1/registrations", nil, &list)
+}
+
+func (c *Client) GetRegistration(ctx context.Context, containerID string) (*registry.Registration, error) {
+	reg := &registry.Registration{}
+	return reg, c.do(ctx, http.MethodGet, "/v1/registrations/"+url.PathEscape(containerID), nil, reg)
+}
+
+func (c *Client) PutRegistration(ctx context.Context, reg *registry.Registration) error {
+	return c.do(ctx, http.MethodPut, "/v1/registrations/"+url.PathEscape(reg.ContainerID), reg, nil)
+}
+
+func (c *Client) DeleteRegistration(ctx context.Context, containerID string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/registrations/"+url.PathEscape(containerID), nil, nil)
+}
+
+func destinationPath(vip net.IP, vport uint16) string {
+	return "/v1/destinations/" + url.PathEscape(vip.String()) + "/" + strconv.Itoa(int(vport))
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	// The host is ignored because the client always dials the UNIX socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://tiaccoon"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		e := &Error{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &StatusError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/registry"
+	"github.com/hiroyaonoe/tiaccoon/pkg/version"
+	"golang.org/x/sys/unix"
+)
+
+// Server serves the control-plane API over HTTP on a UNIX socket.
+//
+//	GET    /v1/version
+//	GET    /v1/accesscontrol/{side}               list rules, or get a rule with ?ip=
+//	PUT    /v1/accesscontrol/{side}               upsert the rule in the body
+//	DELETE /v1/accesscontrol/{side}?ip=           delete the rule
+//	GET    /v1/destinations                       list entries
+//	GET    /v1/destinations/health                list the health of entries
+//	GET    /v1/destinations/{vip}/{vport}         get entries
+//	PUT    /v1/destinations/{vip}/{vport}         replace entries with the ones in the body
+//	DELETE /v1/destinations/{vip}/{vport}         delete entries
+//	GET    /v1/sockets                            list sockets of each container
+//	GET    /v1/registrations                      list containers registered by the CNI plugin
+//	GET    /v1/registrations/{id}                 get the registration of the container
+//	PUT    /v1/registrations/{id}                 register the container in the body
+//	DELETE /v1/registrations/{id}                 unregister the container and delete the entries bound by its sockets
+//
+// {side} is either "client" or "server". A rule is selected by ?ip=&ports=&protocol=&localVIP=,
+// where ip is an IP or a CIDR, empty ports and protocol match any, and empty localVIP is the rules for all containers.
+// Only root and the user running tiaccoon are allowed to connect.
+type Server struct {
+	am         *accesscontrol.Manager
+	dm         *destination.Manager
+	containers ContainerLister
+	registry   *registry.Registry
+
+	// srv is built in NewServer, so Close shuts it down even before Start serves it.
+	srv *http.Server
+
+	socketPath string
+}
+
+// ContainerLister lists the status of the containers handled by tiaccoon.
+type ContainerLister interface {
+	Containers(ctx context.Context) []*Container
+}
+
+func NewServer(am *accesscontrol.Manager, dm *destination.Manager, containers ContainerLister, reg *registry.Registry, socketPath string) *Server {
+	s := &Server{
+		am:         am,
+		dm:         dm,
+		containers: containers,
+		registry:   reg,
+		socketPath: socketPath,
+	}
+	s.srv = &http.Server{
+		Handler:     s.authorize(s.routes()),
+		ConnContext: withPeerCred,
+	}
+	return s
+}
+
+func (s *Server) Close(ctx context.Context) {
+	logger := log.FromContext(ctx).With("component", "api server")
+	logger.DebugContext(ctx, "Closing api server")
+	s.srv.Close()
+}
+
+func (s *Server) Start(ctx context.Context) {
+	logger := log.FromContext(ctx).With("component", "api server")
+	ctx = log.ContextWithLogger(ctx, logger)
+	logger.DebugContext(ctx, "Starting api server")
+
+	dir := filepath.Dir(s.socketPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.ErrorContext(ctx, "Failed to create directory for api socket", "error", err, "dir", dir)
+		return
+	}
+
+	l, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to listen api socket", "error", err, "socketPath", s.socketPath)
+		return
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		logger.ErrorContext(ctx, "Failed to restrict permission of api socket", "error", err, "socketPath", s.socketPath)
+		l.Close()
+		return
+	}
+	logger.InfoContext(ctx, "Listening api socket", "socketPath", s.socketPath)
+
+	// Serve returns ErrServerClosed if Close is called before.
+	s.srv.BaseContext = func(net.Listener) context.Context { return ctx }
+	if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.ErrorContext(ctx, "Failed to serve api", "error", err)
+	}
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/version", s.getVersion)
+	mux.HandleFunc("GET /v1/accesscontrol/{side}", s.getAccessControl)
+	mux.HandleFunc("PUT /v1/accesscontrol/{side}", s.putAccessControl)
+	mux.HandleFunc("DELETE /v1/accesscontrol/{side}", s.deleteAccessControl)
+	mux.HandleFunc("GET /v1/destinations", s.listDestinations)
+	mux.HandleFunc("GET /v1/destinations/health", s.listDestinationHealth)
+	mux.HandleFunc("GET /v1/destinations/{vip}/{vport}", s.getDestinations)
+	mux.HandleFunc("PUT /v1/destinations/{vip}/{vport}", s.putDestinations)
+	mux.HandleFunc("DELETE /v1/destinations/{vip}/{vport}", s.deleteDestinations)
+	mux.HandleFunc("GET /v1/sockets", s.listSockets)
+	mux.HandleFunc("GET /v1/registrations", s.listRegistrations)
+	mux.HandleFunc("GET /v1/registrations/{id}", s.getRegistration)
+	mux.HandleFunc("PUT /v1/registrations/{id}", s.putRegistration)
+	mux.HandleFunc("DELETE /v1/registrations/{id}", s.deleteRegistration)
+	return mux
+}
+
+type peerCredKey struct{}
+
+// withPeerCred records the credentials of the peer process to authorize requests.
+func withPeerCred(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	uid := uint32(os.Getuid())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := log.FromContext(ctx).With("method", r.Method, "path", r.URL.Path)
+		cred, ok := ctx.Value(peerCredKey{}).(*unix.Ucred)
+		if !ok || (cred.Uid != 0 && cred.Uid != uid) {
+			logger.WarnContext(ctx, "unauthorized api request", "cred", cred)
+			writeError(w, http.StatusForbidden, errors.New("permission denied"))
+			return
+		}
+		logger = logger.With("peerPid", cred.Pid, "peerUid", cred.Uid)
+		logger.DebugContext(ctx, "api request")
+		next.ServeHTTP(w, r.WithContext(log.ContextWithLogger(ctx, logger)))
+	})
+}
+
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &Version{Version: version.Version})
+}
+
+func (s *Server) accessControlEntries(side string) (*accesscontrol.Entries, error) {
+	switch side {
+	case SideClient:
+		return s.am.ClientEntries, nil
+	case SideServer:
+		return s.am.ServerEntries, nil
+	default:
+		return nil, fmt.Errorf("side must be either %q or %q, got %q", SideClient, SideServer, side)
+	}
+}
+
+func (s *Server) getAccessControl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	entries, err := s.accessControlEntries(r.PathValue("side"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if r.URL.Query().Has("ip") {
+		match, err := parseMatch(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		entry := entries.Get(ctx, match)
+		if entry == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("rule for %s not found", match))
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &AccessControlList{
+		DefaultPolicy: accesscontrol.FormatPolicy(entries.DefaultPolicy()),
+		Rules:         entries.List(ctx),
+	})
+}
+
+func (s *Server) putAccessControl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	side := r.PathValue("side")
+	if _, err := s.accessControlEntries(side); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	entry := &accesscontrol.Entry{}
+	if err := json.NewDecoder(r.Body).Decode(entry); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid rule: %w", err))
+		return
+	}
+
+	var err error
+	if side == SideClient {
+		err = s.am.UpsertClient(ctx, entry)
+	} else {
+		err = s.am.UpsertServer(ctx, entry)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *Server) deleteAccessControl(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	side := r.PathValue("side")
+	entries, err := s.accessControlEntries(side)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	match, err := parseMatch(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if entries.Get(ctx, match) == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("rule for %s not found", match))
+		return
+	}
+
+	if side == SideClient {
+		err = s.am.RemoveClient(ctx, match)
+	} else {
+		err = s.am.RemoveServer(ctx, match)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listDestinations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.dm.Entries.List(r.Context()))
+}
+
+func (s *Server) listDestinationHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.dm.Entries.Health(r.Context()))
+}
+
+func (s *Server) getDestinations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ip, port, err := parseVIPPort(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries := s.dm.Entries.Get(ctx, ip, port)
+	if len(entries) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("destination %s not found", net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))))
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) putDestinations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ip, port, err := parseVIPPort(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	entries := []*destination.Entry{}
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid entries: %w", err))
+		return
+	}
+	if len(entries) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no entries: use DELETE to remove the destination"))
+		return
+	}
+	for i, entry := range entries {
+		if !entry.VIP.Equal(ip) || entry.VPort != port {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("entries[%d]: vip and vport must match the path", i))
+			return
+		}
+	}
+
+	s.dm.Replace(ctx, ip, port, entries)
+	writeJSON(w, http.StatusOK, s.dm.Entries.Get(ctx, ip, port))
+}
+
+func (s *Server) deleteDestinations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ip, port, err := parseVIPPort(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(s.dm.Entries.Get(ctx, ip, port)) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("destination %s not found", net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))))
+		return
+	}
+	s.dm.Remove(ctx, ip, port)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listSockets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.containers.Containers(r.Context()))
+}
+
+func (s *Server) listRegistrations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.List())
+}
+
+func (s *Server) getRegistration(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	reg := s.registry.Get(id)
+	if reg == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("container %s not registered", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, reg)
+}
+
+func (s *Server) putRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reg := &registry.Registration{}
+	if err := json.NewDecoder(r.Body).Decode(reg); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid registration: %w", err))
+		return
+	}
+	if reg.ContainerID != r.PathValue("id") {
+		writeError(w, http.StatusBadRequest, errors.New("containerID must match the path"))
+		return
+	}
+	if reg.VIP == nil {
+		writeError(w, http.StatusBadRequest, errors.New("vip is required"))
+		return
+	}
+	if ip4 := reg.VIP.To4(); ip4 != nil {
+		reg.VIP = ip4
+	}
+
+	if err := s.registry.Register(ctx, reg); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, reg)
+}
+
+func (s *Server) deleteRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	reg, err := s.registry.Unregister(ctx, id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if reg == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("container %s not registered", id))
+		return
+	}
+	// Only the entries added for the vports bound by the container are removed, keeping those of the config file,
+	// the API and the controllers. The VIP may have been already reused by another container.
+	if !s.registry.HasVIP(reg.VIP) {
+		s.dm.RemoveVIPOrigin(ctx, reg.VIP, destination.OriginBind)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseMatch parses ?ip=&ports=&protocol=&localVIP= selecting a rule.
+func parseMatch(r *http.Request) (accesscontrol.Match, error) {
+	q := r.URL.Query()
+	match, err := accesscontrol.ParseMatch(q.Get("ip"), q.Get("ports"), q.Get("protocol"))
+	if err != nil {
+		return accesscontrol.Match{}, err
+	}
+	match.LocalVIP, err = accesscontrol.ParseLocalVIP(q.Get("localVIP"))
+	return match, err
+}
+
+func parseVIPPort(r *http.Request) (net.IP, uint16, error) {
+	ipStr := r.PathValue("vip")
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid vip %q", ipStr)
+	}
+	portStr := r.PathValue("vport")
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid vport %q", portStr)
+	}
+	return ip, uint16(port), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &Error{Error: err.Error()})
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+)
+
+const (
+	// SideClient selects the access control rules applied to connect(2) by the container.
+	SideClient = "client"
+	// SideServer selects the access control rules applied to connections accepted by the container.
+	SideServer = "server"
+)
+
+// Version is the response of GET /v1/version.
+type Version struct {
+	Version string `json:"version"`
+}
+
+// AccessControlList is the response of GET /v1/accesscontrol/{side}.
+type AccessControlList struct {
+	DefaultPolicy string                 `json:"defaultPolicy"`
+	Rules         []*accesscontrol.Entry `json:"rules"`
+}
+
+// Error is the response body when the request fails.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Container is the status of a container handled through a seccomp notify fd.
+type Container struct {
+	NotifFd   int        `json:"notifFd"`
+	ID        string     `json:"id"`
+	Pid       int        `json:"pid"`
+	VIP       string     `json:"vip"`
+	Processes []*Process `json:"processes"`
+}
+
+// Process is the status of a process in the container.
+type Process struct {
+	Pid     int       `json:"pid"`
+	Sockets []*Socket `json:"sockets"`
+}
+
+// Socket is the status of a socket fd in the process.
+type Socket struct {
+	Fd          int           `json:"fd"`
+	State       string        `json:"state"`
+	Domain      int           `json:"domain"`
+	Type        int           `json:"type"`
+	Protocol    int           `json:"protocol"`
+	LocalVAddr  string        `json:"localVAddr"`
+	RemoteVAddr string        `json:"remoteVAddr"`
+	HostSockets []*HostSocket `json:"hostSockets"`
+}
+
+// HostSocket is the status of a socket created on the host for the socket in the container.
+type HostSocket struct {
+	Sockfd int                `json:"sockfd"`
+	State  string             `json:"state"`
+	Entry  *destination.Entry `json:"entry"`
+}
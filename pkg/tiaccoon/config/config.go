@@ -0,0 +1,201 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the access control rules and destination entries loaded from a config file.
+type Config struct {
+	ClientRules  []*accesscontrol.Entry
+	ServerRules  []*accesscontrol.Entry
+	Destinations []*destination.Entry
+}
+
+// file is the on-disk format of the config file. JSON is accepted as a subset of YAML.
+//
+//	accessControl:
+//	  client:
+//	  - ip: 10.0.10.50
+//	    ports: 80
+//	    protocol: tcp
+//	    policy: allow
+//	  server:
+//	  - ip: 10.0.10.0/24
+//	    policy: deny
+//	  - ip: 10.0.10.0/24
+//	    localVIP: 10.0.10.40
+//	    policy: allow
+//	destinations:
+//	- vip: 10.0.10.50
+//	  vport: 80
+//	  transport: IPv4
+//	  address: 127.0.0.1:8080
+//	  weight: 2
+//	  balancer: least-connections
+//	  connectTimeout: 500ms
+//	  transports: [UNIX, IPv4]
+type file struct {
+	AccessControl accessControlFile `json:"accessControl"`
+	Destinations  []destinationFile `json:"destinations"`
+}
+
+type accessControlFile struct {
+	Client []ruleFile `json:"client"`
+	Server []ruleFile `json:"server"`
+}
+
+type ruleFile struct {
+	IP       string    `json:"ip"`
+	Ports    portsFile `json:"ports"`
+	Protocol string    `json:"protocol"`
+	LocalVIP string    `json:"localVIP"`
+	Policy   string    `json:"policy"`
+}
+
+// portsFile accepts a port number as well as a string like "8000-8080".
+type portsFile string
+
+func (p *portsFile) UnmarshalJSON(data []byte) error {
+	var port uint16
+	if err := json.Unmarshal(data, &port); err == nil {
+		*p = portsFile(strconv.Itoa(int(port)))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("ports must be a port number or a string like \"8000-8080\"")
+	}
+	*p = portsFile(s)
+	return nil
+}
+
+type destinationFile struct {
+	VIP            string   `json:"vip"`
+	VPort          uint16   `json:"vport"`
+	Transport      string   `json:"transport"`
+	Address        string   `json:"address"`
+	Weight         uint32   `json:"weight"`
+	Balancer       string   `json:"balancer"`
+	ConnectTimeout string   `json:"connectTimeout"`
+	Transports     []string `json:"transports"`
+}
+
+// Load reads the config file in YAML or JSON and validates it.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses the config in YAML or JSON and validates it.
+func Parse(data []byte) (*Config, error) {
+	f := &file{}
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	var err error
+	cfg.ClientRules, err = parseRules("accessControl.client", f.AccessControl.Client)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ServerRules, err = parseRules("accessControl.server", f.AccessControl.Server)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range f.Destinations {
+		entry, err := d.parse()
+		if err != nil {
+			return nil, fmt.Errorf("destinations[%d]: %w", i, err)
+		}
+		cfg.Destinations = append(cfg.Destinations, entry)
+	}
+	return cfg, nil
+}
+
+func parseRules(field string, rules []ruleFile) ([]*accesscontrol.Entry, error) {
+	parsed := make([]*accesscontrol.Entry, 0, len(rules))
+	seen := make(map[string]int, len(rules))
+	for i, r := range rules {
+		rule, err := r.parse()
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", field, i, err)
+		}
+		key := rule.Match.String()
+		if j, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s[%d]: rule for %s is already defined in %s[%d]", field, i, key, field, j)
+		}
+		seen[key] = i
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func (r ruleFile) parse() (*accesscontrol.Entry, error) {
+	match, err := accesscontrol.ParseMatch(r.IP, string(r.Ports), r.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	match.LocalVIP, err = accesscontrol.ParseLocalVIP(r.LocalVIP)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := accesscontrol.ParsePolicy(r.Policy)
+	if err != nil {
+		return nil, err
+	}
+	return &accesscontrol.Entry{Match: match, Policy: policy}, nil
+}
+
+func (d destinationFile) parse() (*destination.Entry, error) {
+	ip := net.ParseIP(d.VIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid vip %q", d.VIP)
+	}
+	transport, err := destination.ParseTransportType(d.Transport)
+	if err != nil {
+		return nil, err
+	}
+	address, err := destination.ParseTransportAddr(transport, d.Address)
+	if err != nil {
+		return nil, err
+	}
+	balancer, err := destination.ParseBalancerType(d.Balancer)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeout, err := destination.ParseConnectTimeout(d.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	transports, err := destination.ParseTransportOrder(d.Transports)
+	if err != nil {
+		return nil, err
+	}
+	return &destination.Entry{
+		VIP:            ip,
+		VPort:          d.VPort,
+		Transport:      transport,
+		Address:        address,
+		Weight:         d.Weight,
+		Balancer:       balancer,
+		ConnectTimeout: connectTimeout,
+		Transports:     transports,
+		Origin:         destination.OriginConfig,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package destination
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/vip"
+)
+
+// BalancerType is how the client chooses among the entries of the same transport of a VIP and vport.
+type BalancerType int32
+
+const (
+	NumBalancerType = 5
+)
+
+const (
+	// BalancerRandom tries the entries in a random order.
+	BalancerRandom BalancerType = iota
+	// BalancerRoundRobin starts from the entry next to the one started from last time.
+	BalancerRoundRobin
+	// BalancerWeighted tries the entries in a random order where the entries of larger weights come first more often.
+	BalancerWeighted
+	// BalancerLeastConnections tries the entries with fewer bypassed sockets per weight first.
+	BalancerLeastConnections
+	// BalancerHash tries the entries in the order decided by the VIP of the client by rendezvous hashing,
+	// so a client keeps reaching the same entry while the others are added or removed.
+	BalancerHash
+)
+
+func (b BalancerType) String() string {
+	switch b {
+	case BalancerRandom:
+		return "random"
+	case BalancerRoundRobin:
+		return "round-robin"
+	case BalancerWeighted:
+		return "weighted"
+	case BalancerLeastConnections:
+		return "least-connections"
+	case BalancerHash:
+		return "hash"
+	default:
+		panic(fmt.Sprintf("unexpected enum %d: String() is not implemented", b))
+	}
+}
+
+// ParseBalancerType parses the name returned by BalancerType.String case-insensitively. Empty is BalancerRandom.
+func ParseBalancerType(s string) (BalancerType, error) {
+	if s == "" {
+		return BalancerRandom, nil
+	}
+	for b := BalancerType(0); b < NumBalancerType; b++ {
+		if strings.EqualFold(s, b.String()) {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balancer %q", s)
+}
+
+// balancer is the balancer of a VIP and vport.
+type balancer struct {
+	balancerType BalancerType
+	next         atomic.Uint64 // for BalancerRoundRobin
+}
+
+type balancerKey struct {
+	upper, lower uint64
+	port         uint16
+}
+
+func newBalancerKey(ip net.IP, port uint16) balancerKey {
+	upper, lower := vip.IP2Int(ip)
+	return balancerKey{upper, lower, port}
+}
+
+// balancerTypeOf returns the first balancer set in the entries.
+func balancerTypeOf(entries []*Entry) BalancerType {
+	for _, entry := range entries {
+		if entry.Balancer != BalancerRandom {
+			return entry.Balancer
+		}
+	}
+	return BalancerRandom
+}
+
+// setBalancer sets the balancer of the VIP and vport. d.mu must be held.
+// The state of the balancer is kept if its type is not changed.
+func (d *Entries) setBalancer(ip net.IP, port uint16, balancerType BalancerType) {
+	key := newBalancerKey(ip, port)
+	if b, ok := d.balancers.Load(key); ok && b.(*balancer).balancerType == balancerType {
+		return
+	}
+	d.balancers.Store(key, &balancer{balancerType: balancerType})
+}
+
+// weight returns the weight of the entry, which is 1 if not set.
+func (e *Entry) weight() float64 {
+	if e.Weight == 0 {
+		return 1
+	}
+	return float64(e.Weight)
+}
+
+// key identifies the entry for the connection counts.
+func (e *Entry) key() string {
+	return fmt.Sprintf("%s:%d %s %s", e.VIP, e.VPort, e.Transport, e.Address)
+}
+
+// Order returns the entries of a transport of the VIP and vport in the order to try by the balancer of the VIP and vport.
+// client is the VIP of the client, which BalancerHash distributes by.
+func (d *Entries) Order(ip net.IP, port uint16, entries []*Entry, client net.IP) []*Entry {
+	ordered := slices.Clone(entries)
+	if len(ordered) <= 1 {
+		return ordered
+	}
+	v, ok := d.balancers.Load(newBalancerKey(ip, port))
+	if !ok {
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+		return ordered
+	}
+	b := v.(*balancer)
+
+	switch b.balancerType {
+	case BalancerRoundRobin:
+		start := int((b.next.Add(1) - 1) % uint64(len(ordered)))
+		return slices.Concat(ordered[start:], ordered[:start])
+	case BalancerWeighted:
+		// Exponential keys with rates of the weights, which is weighted random sampling without replacement.
+		keys := make(map[*Entry]float64, len(ordered))
+		for _, entry := range ordered {
+			keys[entry] = rand.ExpFloat64() / entry.weight()
+		}
+		slices.SortFunc(ordered, func(x, y *Entry) int { return cmp.Compare(keys[x], keys[y]) })
+	case BalancerLeastConnections:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+		loads := make(map[*Entry]float64, len(ordered))
+		for _, entry := range ordered {
+			loads[entry] = float64(d.connectionsOf(entry)) / entry.weight()
+		}
+		slices.SortStableFunc(ordered, func(x, y *Entry) int { return cmp.Compare(loads[x], loads[y]) })
+	case BalancerHash:
+		scores := make(map[*Entry]float64, len(ordered))
+		for _, entry := range ordered {
+			h := fnv.New64a()
+			h.Write(client.To16())
+			h.Write([]byte(entry.Transport.String() + " " + entry.Address.String()))
+			// Weighted rendezvous hashing: the hash is mapped to (0, 1).
+			u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			scores[entry] = -entry.weight() / math.Log(u)
+		}
+		slices.SortFunc(ordered, func(x, y *Entry) int { return cmp.Compare(scores[y], scores[x]) })
+	default:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	}
+	return ordered
+}
+
+// Connected counts a bypassed socket connected by the entry for BalancerLeastConnections until release is called.
+func (d *Entries) Connected(entry *Entry) (release func()) {
+	v, _ := d.connections.LoadOrStore(entry.key(), &atomic.Int64{})
+	n := v.(*atomic.Int64)
+	n.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { n.Add(-1) })
+	}
+}
+
+func (d *Entries) connectionsOf(entry *Entry) int64 {
+	v, ok := d.connections.Load(entry.key())
+	if !ok {
+		return 0
+	}
+	return v.(*atomic.Int64).Load()
+}
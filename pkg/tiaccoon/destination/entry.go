@@ -1,9 +1,17 @@
 package destination
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/vip"
@@ -14,65 +22,203 @@ type Entry struct {
 	VPort     uint16        `json:"vport"`
 	Transport TransportType `json:"transport"`
 	Address   TransportAddr `json:"address"`
+	// Weight is used by BalancerWeighted, BalancerLeastConnections and BalancerHash. 0 is the same as 1.
+	Weight uint32 `json:"weight"`
+	// Balancer is the balancer of the VIP and vport, which is the first one set in its entries.
+	Balancer BalancerType `json:"balancer"`
+	// ConnectTimeout bounds connect(2) to the address. 0 uses the default timeout of tiaccoon.
+	ConnectTimeout time.Duration `json:"connectTimeout"`
+	// Transports is the order of the transports to try for the VIP and vport, which is the first one set in its entries.
+	// Transports not in the order are not tried. Empty is the priority order of TransportType.
+	Transports []TransportType `json:"transports"`
+	// Origin tells who added the entry. Empty is the control-plane API.
+	Origin string `json:"origin"`
+}
+
+// OriginConfig is the Origin of the entries loaded from the config file.
+// A reload replaces only them, so the entries added by the API or the controllers for the same VIP and vport are kept.
+const OriginConfig = "config"
+
+// OriginBind is the Origin of the entries added by tiaccoon for the vports allocated by bind(2).
+// They are removed when the socket is closed, so controllers must keep them.
+const OriginBind = "bind"
+
+// entryJSON is the JSON representation of Entry.
+type entryJSON struct {
+	VIP            string   `json:"vip"`
+	VPort          uint16   `json:"vport"`
+	Transport      string   `json:"transport"`
+	Address        string   `json:"address"`
+	Weight         uint32   `json:"weight"`
+	Balancer       string   `json:"balancer"`
+	ConnectTimeout string   `json:"connectTimeout,omitempty"`
+	Transports     []string `json:"transports,omitempty"`
+	Origin         string   `json:"origin,omitempty"`
 }
 
 func (e *Entry) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`{"vip":"%s","vport":%d,"transport":"%s","address":"%s"}`, e.VIP, e.VPort, e.Transport.String(), e.Address.String())), nil
+	v := entryJSON{
+		VIP:        e.VIP.String(),
+		VPort:      e.VPort,
+		Transport:  e.Transport.String(),
+		Address:    e.Address.String(),
+		Weight:     e.Weight,
+		Balancer:   e.Balancer.String(),
+		Transports: FormatTransportOrder(e.Transports),
+		Origin:     e.Origin,
+	}
+	if e.ConnectTimeout != 0 {
+		v.ConnectTimeout = e.ConnectTimeout.String()
+	}
+	return json.Marshal(v)
+}
+
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var v entryJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	ip := net.ParseIP(v.VIP)
+	if ip == nil {
+		return fmt.Errorf("invalid vip %q", v.VIP)
+	}
+	transport, err := ParseTransportType(v.Transport)
+	if err != nil {
+		return err
+	}
+	address, err := ParseTransportAddr(transport, v.Address)
+	if err != nil {
+		return err
+	}
+	balancer, err := ParseBalancerType(v.Balancer)
+	if err != nil {
+		return err
+	}
+	connectTimeout, err := ParseConnectTimeout(v.ConnectTimeout)
+	if err != nil {
+		return err
+	}
+	transports, err := ParseTransportOrder(v.Transports)
+	if err != nil {
+		return err
+	}
+	e.VIP = ip
+	e.VPort = v.VPort
+	e.Transport = transport
+	e.Address = address
+	e.Weight = v.Weight
+	e.Balancer = balancer
+	e.ConnectTimeout = connectTimeout
+	e.Transports = transports
+	e.Origin = v.Origin
+	return nil
 }
 
+// Entries is safe for concurrent use.
+// Writers copy the maps on write and swap the snapshot, so GetClient and GetServer are lock-free.
+// Returned slices are shared with the snapshot and must not be modified.
 type Entries struct {
-	myVIP         net.IP
-	featureRDMA   bool
+	featureRDMA bool
+	mu          sync.Mutex // serializes writers
+	snapshot    atomic.Pointer[entriesSnapshot]
+
+	balancers   sync.Map // *balancer keyed by balancerKey
+	connections sync.Map // *atomic.Int64 keyed by Entry.key
+	health      sync.Map // *health keyed by Entry.key
+	unhealthy   atomic.Int64
+}
+
+type entriesSnapshot struct {
 	clientEntries map[uint64]map[uint64]map[uint16][][]*Entry // clientEntries[upper VIP][lower VIP][Vport][Transport]
-	serverEntries map[uint16][]*Entry                         // serverEntries[Vport]
+	serverEntries map[uint64]map[uint64]map[uint16][]*Entry   // serverEntries[upper VIP][lower VIP][Vport]
 }
 
-func newEntries(myVIP net.IP, featureRDMA bool) *Entries {
-	return &Entries{
-		myVIP:         myVIP,
-		featureRDMA:   featureRDMA,
+func newEntries(featureRDMA bool) *Entries {
+	d := &Entries{
+		featureRDMA: featureRDMA,
+	}
+	d.snapshot.Store(&entriesSnapshot{
 		clientEntries: make(map[uint64]map[uint64]map[uint16][][]*Entry),
-		serverEntries: make(map[uint16][]*Entry),
+		serverEntries: make(map[uint64]map[uint64]map[uint16][]*Entry),
+	})
+	return d
+}
+
+// withServerEntries returns a copy of serverEntries where the entries of the VIP and port are replaced.
+// Empty entries removes them.
+func withServerEntries(serverEntries map[uint64]map[uint64]map[uint16][]*Entry, upper, lower uint64, port uint16, entries []*Entry) map[uint64]map[uint64]map[uint16][]*Entry {
+	next := maps.Clone(serverEntries)
+	v1 := maps.Clone(next[upper])
+	if v1 == nil {
+		v1 = make(map[uint64]map[uint16][]*Entry)
+	}
+	v2 := maps.Clone(v1[lower])
+	if v2 == nil {
+		v2 = make(map[uint16][]*Entry)
 	}
+	if len(entries) == 0 {
+		delete(v2, port)
+	} else {
+		v2[port] = entries
+	}
+	v1[lower] = v2
+	next[upper] = v1
+	return next
 }
 
-func (d *Entries) upsert(ctx context.Context, ip net.IP, port uint16, transport TransportType, address TransportAddr) {
-	logger := log.FromContext(ctx).With("func", "destination.upsert", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)), "port", port, "transport", transport.String(), "address", address.String())
+func (d *Entries) upsert(ctx context.Context, entry *Entry) {
+	ip, port, transport := entry.VIP, entry.VPort, entry.Transport
+	logger := log.FromContext(ctx).With("func", "destination.upsert", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)), "port", port, "transport", transport.String(), "address", entry.Address.String())
 
 	if !d.featureRDMA && transport == TransportRDMA {
 		return
 	}
 	upper, lower := vip.IP2Int(ip)
 	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
-	if _, ok := d.clientEntries[upper]; !ok {
-		d.clientEntries[upper] = make(map[uint64]map[uint16][][]*Entry)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cur := d.snapshot.Load()
+	next := &entriesSnapshot{
+		clientEntries: maps.Clone(cur.clientEntries),
+		serverEntries: cur.serverEntries,
+	}
+
+	v1 := maps.Clone(next.clientEntries[upper])
+	if v1 == nil {
+		v1 = make(map[uint64]map[uint16][][]*Entry)
 	}
-	if _, ok := d.clientEntries[upper][lower]; !ok {
-		d.clientEntries[upper][lower] = make(map[uint16][][]*Entry)
+	v2 := maps.Clone(v1[lower])
+	if v2 == nil {
+		v2 = make(map[uint16][][]*Entry)
 	}
-	if _, ok := d.clientEntries[upper][lower][port]; !ok {
-		d.clientEntries[upper][lower][port] = make([][]*Entry, NumTransportType)
+	v3 := slices.Clone(v2[port])
+	if v3 == nil {
+		v3 = make([][]*Entry, NumTransportType)
 	}
-	d.clientEntries[upper][lower][port][transport] = append(d.clientEntries[upper][lower][port][transport], &Entry{
-		VIP:       ip,
-		VPort:     port,
-		Transport: transport,
-		Address:   address,
-	})
+	added := &Entry{
+		VIP:            ip,
+		VPort:          port,
+		Transport:      transport,
+		Address:        entry.Address,
+		Weight:         entry.Weight,
+		Balancer:       entry.Balancer,
+		ConnectTimeout: entry.ConnectTimeout,
+		Transports:     entry.Transports,
+		Origin:         entry.Origin,
+	}
+	v3[transport] = append(slices.Clip(v3[transport]), added)
+	v2[port] = v3
+	v1[lower] = v2
+	next.clientEntries[upper] = v1
 	logger.DebugContext(ctx, "added to clientEntries")
 
-	if ip.Equal(d.myVIP) {
-		if _, ok := d.serverEntries[port]; !ok {
-			d.serverEntries[port] = make([]*Entry, 0, 1)
-		}
-		d.serverEntries[port] = append(d.serverEntries[port], &Entry{
-			VIP:       ip,
-			VPort:     port,
-			Transport: transport,
-			Address:   address,
-		})
-		logger.DebugContext(ctx, "added to serverEntries")
-	}
+	server := append(slices.Clip(cur.serverEntries[upper][lower][port]), added)
+	next.serverEntries = withServerEntries(cur.serverEntries, upper, lower, port, server)
+	logger.DebugContext(ctx, "added to serverEntries")
+
+	d.setBalancer(ip, port, balancerTypeOf(server))
+	d.snapshot.Store(next)
 }
 
 func (d *Entries) remove(ctx context.Context, ip net.IP, port uint16) {
@@ -80,32 +226,170 @@ func (d *Entries) remove(ctx context.Context, ip net.IP, port uint16) {
 
 	upper, lower := vip.IP2Int(ip)
 	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
-	if _, ok := d.clientEntries[upper]; ok {
-		if _, ok := d.clientEntries[upper][lower]; ok {
-			if _, ok := d.clientEntries[upper][lower][port]; ok {
-				for i := 0; i < NumTransportType; i++ {
-					d.clientEntries[upper][lower][port][i] = nil
-				}
-				d.clientEntries[upper][lower][port] = nil
-			}
-		}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cur := d.snapshot.Load()
+	next := &entriesSnapshot{
+		clientEntries: cur.clientEntries,
+		serverEntries: cur.serverEntries,
+	}
+
+	if _, ok := cur.clientEntries[upper][lower][port]; ok {
+		v2 := maps.Clone(cur.clientEntries[upper][lower])
+		delete(v2, port)
+		v1 := maps.Clone(cur.clientEntries[upper])
+		v1[lower] = v2
+		next.clientEntries = maps.Clone(cur.clientEntries)
+		next.clientEntries[upper] = v1
 	}
 	logger.DebugContext(ctx, "removed from clientEntries")
 
-	if ip.Equal(d.myVIP) {
-		if _, ok := d.serverEntries[port]; ok {
-			d.serverEntries[port] = nil
-		}
+	if _, ok := cur.serverEntries[upper][lower][port]; ok {
+		next.serverEntries = withServerEntries(cur.serverEntries, upper, lower, port, nil)
 	}
 	logger.DebugContext(ctx, "removed from serverEntries")
+
+	d.balancers.Delete(newBalancerKey(ip, port))
+	d.snapshot.Store(next)
+}
+
+// replace replaces all entries of the VIP and port at once.
+func (d *Entries) replace(ctx context.Context, ip net.IP, port uint16, entries []*Entry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.replaceLocked(ctx, ip, port, entries)
 }
 
+// replaceOrigin replaces the entries of the origin for the VIP and port, keeping the entries of the other origins.
+func (d *Entries) replaceOrigin(ctx context.Context, ip net.IP, port uint16, origin string, entries []*Entry) {
+	upper, lower := vip.IP2Int(ip)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept := []*Entry{}
+	for _, entry := range d.snapshot.Load().serverEntries[upper][lower][port] {
+		if entry.Origin != origin {
+			kept = append(kept, entry)
+		}
+	}
+	d.replaceLocked(ctx, ip, port, append(kept, entries...))
+}
+
+// replaceLocked is replace with d.mu held.
+func (d *Entries) replaceLocked(ctx context.Context, ip net.IP, port uint16, entries []*Entry) {
+	logger := log.FromContext(ctx).With("func", "destination.replace", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)), "port", port, "entries", len(entries))
+
+	upper, lower := vip.IP2Int(ip)
+	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
+
+	v3 := make([][]*Entry, NumTransportType)
+	server := make([]*Entry, 0, len(entries))
+	for _, entry := range entries {
+		if !d.featureRDMA && entry.Transport == TransportRDMA {
+			continue
+		}
+		e := &Entry{
+			VIP:            ip,
+			VPort:          port,
+			Transport:      entry.Transport,
+			Address:        entry.Address,
+			Weight:         entry.Weight,
+			Balancer:       entry.Balancer,
+			ConnectTimeout: entry.ConnectTimeout,
+			Transports:     entry.Transports,
+			Origin:         entry.Origin,
+		}
+		v3[entry.Transport] = append(v3[entry.Transport], e)
+		server = append(server, e)
+	}
+
+	cur := d.snapshot.Load()
+	next := &entriesSnapshot{
+		clientEntries: maps.Clone(cur.clientEntries),
+		serverEntries: cur.serverEntries,
+	}
+
+	v1 := maps.Clone(next.clientEntries[upper])
+	if v1 == nil {
+		v1 = make(map[uint64]map[uint16][][]*Entry)
+	}
+	v2 := maps.Clone(v1[lower])
+	if v2 == nil {
+		v2 = make(map[uint16][][]*Entry)
+	}
+	if len(server) == 0 {
+		delete(v2, port)
+	} else {
+		v2[port] = v3
+	}
+	v1[lower] = v2
+	next.clientEntries[upper] = v1
+	logger.DebugContext(ctx, "replaced clientEntries")
+
+	next.serverEntries = withServerEntries(cur.serverEntries, upper, lower, port, server)
+	logger.DebugContext(ctx, "replaced serverEntries")
+
+	if len(server) == 0 {
+		d.balancers.Delete(newBalancerKey(ip, port))
+	} else {
+		d.setBalancer(ip, port, balancerTypeOf(server))
+	}
+	d.snapshot.Store(next)
+}
+
+// GetClient returns the entries to connect to the VIP and port for each transport in the order to try, skipping the unhealthy ones.
+// nil is returned if all of them are unhealthy.
 func (d *Entries) GetClient(ctx context.Context, ip net.IP, port uint16) [][]*Entry {
+	entries := d.GetClientAll(ctx, ip, port)
+	if entries == nil || d.unhealthy.Load() == 0 {
+		return entries
+	}
+	healthy := make([][]*Entry, len(entries))
+	found := false
+	for i, v := range entries {
+		for _, entry := range v {
+			if d.healthy(entry) {
+				healthy[i] = append(healthy[i], entry)
+				found = true
+			}
+		}
+	}
+	if !found {
+		log.FromContext(ctx).WarnContext(ctx, "all destination entries are unhealthy", "ip", ip, "port", port)
+		return nil
+	}
+	return healthy
+}
+
+// GetClientAll returns the entries of the VIP and port for each transport in the order to try including the unhealthy ones.
+// It is used for UDP, which the probes of the health checker do not tell.
+// The order is the first one set in the entries, or the priority order of TransportType.
+func (d *Entries) GetClientAll(ctx context.Context, ip net.IP, port uint16) [][]*Entry {
+	entries := d.lookupClient(ctx, ip, port)
+	if entries == nil {
+		return nil
+	}
+	upper, lower := vip.IP2Int(ip)
+	for _, entry := range d.snapshot.Load().serverEntries[upper][lower][port] {
+		if len(entry.Transports) == 0 {
+			continue
+		}
+		ordered := make([][]*Entry, 0, len(entry.Transports))
+		for _, transport := range entry.Transports {
+			ordered = append(ordered, entries[transport])
+		}
+		return ordered
+	}
+	return entries
+}
+
+func (d *Entries) lookupClient(ctx context.Context, ip net.IP, port uint16) [][]*Entry {
 	logger := log.FromContext(ctx).With("func", "destination.GetClient", "ip", ip, "raw-ip", fmt.Sprintf("%+v", []byte(ip)), "port", port)
 
 	upper, lower := vip.IP2Int(ip)
 	logger.DebugContext(ctx, "parsed", "upper", upper, "lower", lower)
-	if v1, ok := d.clientEntries[upper]; ok {
+	if v1, ok := d.snapshot.Load().clientEntries[upper]; ok {
 		if v2, ok := v1[lower]; ok {
 			if v3, ok := v2[port]; ok {
 				return v3
@@ -116,12 +400,55 @@ func (d *Entries) GetClient(ctx context.Context, ip net.IP, port uint16) [][]*En
 	return nil
 }
 
-func (d *Entries) GetServer(ctx context.Context, port uint16) []*Entry {
-	logger := log.FromContext(ctx).With("func", "destination.GetServer", "port", port)
+// GetServer returns the entries which the container with the VIP binds for the port.
+// The entries of 0.0.0.0 are shared by all containers and used if the VIP has no entries for the port.
+func (d *Entries) GetServer(ctx context.Context, ip net.IP, port uint16) []*Entry {
+	logger := log.FromContext(ctx).With("func", "destination.GetServer", "ip", ip, "port", port)
 
-	if v, ok := d.serverEntries[port]; ok {
+	snapshot := d.snapshot.Load()
+	if ip != nil {
+		upper, lower := vip.IP2Int(ip)
+		if v, ok := snapshot.serverEntries[upper][lower][port]; ok {
+			return v
+		}
+	}
+	upper, lower := vip.IP2Int(net.IPv4zero)
+	if v, ok := snapshot.serverEntries[upper][lower][port]; ok {
 		return v
 	}
-	logger.DebugContext(ctx, "not found", "port", port)
+	logger.DebugContext(ctx, "not found")
 	return nil
 }
+
+// Get returns all entries of the VIP and port in the priority order of transports.
+func (d *Entries) Get(ctx context.Context, ip net.IP, port uint16) []*Entry {
+	list := []*Entry{}
+	for _, entries := range d.lookupClient(ctx, ip, port) {
+		list = append(list, entries...)
+	}
+	return list
+}
+
+// List returns all entries ordered by VIP, port and the priority of transports.
+func (d *Entries) List(ctx context.Context) []*Entry {
+	list := []*Entry{}
+	for _, v1 := range d.snapshot.Load().clientEntries {
+		for _, v2 := range v1 {
+			for _, v3 := range v2 {
+				for _, entries := range v3 {
+					list = append(list, entries...)
+				}
+			}
+		}
+	}
+	slices.SortStableFunc(list, func(x, y *Entry) int {
+		if c := bytes.Compare(x.VIP.To16(), y.VIP.To16()); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(x.VPort, y.VPort); c != 0 {
+			return c
+		}
+		return cmp.Compare(x.Transport, y.Transport)
+	})
+	return list
+}
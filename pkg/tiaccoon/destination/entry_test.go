@@ -0,0 +1,171 @@
+package destination
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+)
+
+func testContext() context.Context {
+	return log.ContextWithLogger(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func testEntries(vip net.IP, vport uint16, n int) []*Entry {
+	entries := []*Entry{}
+	for i := range n {
+		entries = append(entries, &Entry{
+			VIP:       vip,
+			VPort:     vport,
+			Transport: TransportIPv4,
+			Address:   NewTransportAddrIPv4([4]byte{192, 168, 0, byte(i + 1)}, 8000+int(vport)),
+		})
+	}
+	return entries
+}
+
+// TestEntriesConcurrent runs readers while writers replace and remove the entries of VIPs.
+// Readers must see all entries of a VIP and vport replaced at once or none of them.
+func TestEntriesConcurrent(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(false)
+	fixed := net.ParseIP("10.0.0.1")
+	m.Replace(ctx, fixed, 80, testEntries(fixed, 80, 2))
+
+	const writers, readers, iterations, size = 4, 8, 200, 3
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vip := net.ParseIP(fmt.Sprintf("10.0.1.%d", w+1))
+			for i := range iterations {
+				vport := uint16(i%10 + 1)
+				m.Replace(ctx, vip, vport, testEntries(vip, vport, size))
+				if i%2 == 0 {
+					m.Remove(ctx, vip, vport)
+				}
+			}
+		}()
+	}
+	errs := make(chan error, readers)
+	for r := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vip := net.ParseIP(fmt.Sprintf("10.0.1.%d", r%writers+1))
+			for i := range iterations {
+				if n := countEntries(m.Entries.GetClient(ctx, fixed, 80)); n != 2 {
+					errs <- fmt.Errorf("%d entries of %s:80 at iteration %d", n, fixed, i)
+					return
+				}
+				vport := uint16(i%10 + 1)
+				if n := countEntries(m.Entries.GetClient(ctx, vip, vport)); n != 0 && n != size {
+					errs <- fmt.Errorf("%d entries of %s:%d at iteration %d", n, vip, vport, i)
+					return
+				}
+				m.Entries.List(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The vports of the odd iterations are left replaced.
+	for w := range writers {
+		vip := net.ParseIP(fmt.Sprintf("10.0.1.%d", w+1))
+		for vport := uint16(1); vport <= 10; vport++ {
+			want := 0
+			if vport%2 == 0 {
+				want = size
+			}
+			if n := countEntries(m.Entries.GetClient(ctx, vip, vport)); n != want {
+				t.Errorf("%d entries of %s:%d after the writers, want %d", n, vip, vport, want)
+			}
+		}
+	}
+}
+
+func countEntries(entries [][]*Entry) int {
+	n := 0
+	for _, v := range entries {
+		n += len(v)
+	}
+	return n
+}
+
+// TestReplaceOrigin checks replacing the entries of an origin keeps those of the other origins for the same VIP and vport.
+func TestReplaceOrigin(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(false)
+	vip := net.ParseIP("10.0.0.1")
+	entries := testEntries(vip, 80, 3)
+	entries[0].Origin = OriginConfig
+	entries[2].Origin = OriginBind
+	m.Replace(ctx, vip, 80, entries)
+
+	config := testEntries(vip, 80, 5)[3:]
+	for _, e := range config {
+		e.Origin = OriginConfig
+	}
+	m.ReplaceOrigin(ctx, vip, 80, OriginConfig, config)
+	got := map[string]int{}
+	for _, e := range m.Entries.Get(ctx, vip, 80) {
+		got[e.Origin]++
+	}
+	if got[OriginConfig] != 2 || got[""] != 1 || got[OriginBind] != 1 {
+		t.Errorf("entries by origin after replace = %v", got)
+	}
+
+	m.ReplaceOrigin(ctx, vip, 80, OriginConfig, nil)
+	got = map[string]int{}
+	for _, e := range m.Entries.Get(ctx, vip, 80) {
+		got[e.Origin]++
+	}
+	if got[OriginConfig] != 0 || got[""] != 1 || got[OriginBind] != 1 {
+		t.Errorf("entries by origin after remove = %v", got)
+	}
+
+	m.ReplaceOrigin(ctx, vip, 80, "", nil)
+	m.ReplaceOrigin(ctx, vip, 80, OriginBind, nil)
+	if n := countEntries(m.Entries.GetClient(ctx, vip, 80)); n != 0 {
+		t.Errorf("%d entries left after removing all origins", n)
+	}
+}
+
+// TestRemoveVIPOrigin checks only the entries of the origin are removed from every vport of the VIP.
+func TestRemoveVIPOrigin(t *testing.T) {
+	ctx := testContext()
+	m := NewManager(false)
+	vip, other := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	for _, ip := range []net.IP{vip, other} {
+		for _, vport := range []uint16{80, 40000} {
+			entries := testEntries(ip, vport, 2)
+			entries[1].Origin = OriginBind
+			m.Replace(ctx, ip, vport, entries)
+		}
+	}
+
+	m.RemoveVIPOrigin(ctx, vip, OriginBind)
+	for _, vport := range []uint16{80, 40000} {
+		for _, e := range m.Entries.Get(ctx, vip, vport) {
+			if e.Origin == OriginBind {
+				t.Errorf("bound entry %s:%d is left", vip, vport)
+			}
+		}
+		if n := len(m.Entries.Get(ctx, vip, vport)); n != 1 {
+			t.Errorf("%d entries of %s:%d, want 1", n, vip, vport)
+		}
+		if n := len(m.Entries.Get(ctx, other, vport)); n != 2 {
+			t.Errorf("%d entries of %s:%d, want 2", n, other, vport)
+		}
+	}
+}
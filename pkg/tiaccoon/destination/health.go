@@ -0,0 +1,224 @@
+package destination
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+)
+
+// HealthCheckConfig configures the health checker of the destination entries.
+type HealthCheckConfig struct {
+	// Interval is the period of the probes. 0 disables the health checker.
+	Interval time.Duration
+	// Timeout is the timeout of a probe.
+	Timeout time.Duration
+	// Threshold is the number of consecutive probes to mark an entry unhealthy or healthy again.
+	Threshold int
+}
+
+// Health is the result of the probes of a destination entry.
+// Entries which are not probed yet are healthy.
+type Health struct {
+	Entry       *Entry    `json:"entry"`
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"`  // consecutive failed probes
+	Successes   int       `json:"successes"` // consecutive succeeded probes
+	LastChecked time.Time `json:"lastChecked"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// health is the state of the probes of an entry, stored in Entries.health.
+type health struct {
+	mu sync.Mutex
+	Health
+}
+
+var errNotProbed = errors.New("transport is not probed")
+
+// probe connects to the address of the entry. RDMA and the templates of vport 0 are not probed.
+func probe(ctx context.Context, entry *Entry, timeout time.Duration) error {
+	if entry.VPort == 0 {
+		return errNotProbed
+	}
+	var network, address string
+	switch addr := entry.Address.(type) {
+	case TransportAddrUNIX:
+		network, address = "unix", addr.Path()
+	case TransportAddrIPv4, TransportAddrIPv6:
+		network, address = "tcp", addr.String()
+	default:
+		return errNotProbed
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// healthy reports whether the entry has not been marked unhealthy by the health checker.
+func (d *Entries) healthy(entry *Entry) bool {
+	v, ok := d.health.Load(entry.key())
+	if !ok {
+		return true
+	}
+	h := v.(*health)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Healthy
+}
+
+// Health returns the health of all entries in the order of List.
+func (d *Entries) Health(ctx context.Context) []*Health {
+	list := []*Health{}
+	for _, entry := range d.List(ctx) {
+		v, ok := d.health.Load(entry.key())
+		if !ok {
+			list = append(list, &Health{Entry: entry, Healthy: true})
+			continue
+		}
+		h := v.(*health)
+		h.mu.Lock()
+		c := h.Health
+		h.mu.Unlock()
+		c.Entry = entry
+		list = append(list, &c)
+	}
+	return list
+}
+
+// report records the result of a probe of the entry and returns whether the health is changed.
+func (d *Entries) report(entry *Entry, err error, threshold int) (changed bool) {
+	v, _ := d.health.LoadOrStore(entry.key(), &health{Health: Health{Healthy: true}})
+	h := v.(*health)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.LastChecked = time.Now()
+	if err != nil {
+		h.Failures++
+		h.Successes = 0
+		h.LastError = err.Error()
+		if h.Healthy && h.Failures >= threshold {
+			h.Healthy = false
+			d.unhealthy.Add(1)
+			return true
+		}
+		return false
+	}
+	h.Successes++
+	h.Failures = 0
+	h.LastError = ""
+	if !h.Healthy && h.Successes >= threshold {
+		h.Healthy = true
+		d.unhealthy.Add(-1)
+		return true
+	}
+	return false
+}
+
+// forget drops the health of the entries which are no longer in keys.
+func (d *Entries) forget(keys map[string]struct{}) {
+	d.health.Range(func(key, value any) bool {
+		if _, ok := keys[key.(string)]; ok {
+			return true
+		}
+		h := value.(*health)
+		h.mu.Lock()
+		if !h.Healthy {
+			d.unhealthy.Add(-1)
+		}
+		h.mu.Unlock()
+		d.health.Delete(key)
+		return true
+	})
+}
+
+// HealthChecker probes the destination entries periodically by connecting to their addresses.
+// Unhealthy entries are skipped by Entries.GetClient until they recover.
+type HealthChecker struct {
+	entries *Entries
+	config  HealthCheckConfig
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewHealthChecker(entries *Entries, config HealthCheckConfig) *HealthChecker {
+	if config.Threshold <= 0 {
+		config.Threshold = 1
+	}
+	return &HealthChecker{
+		entries: entries,
+		config:  config,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *HealthChecker) Close(ctx context.Context) {
+	logger := log.FromContext(ctx).With("component", "health checker")
+	logger.DebugContext(ctx, "Closing health checker")
+	c.once.Do(func() { close(c.done) })
+}
+
+// Start probes the entries until ctx is done or Close is called. It does nothing if the interval is 0.
+func (c *HealthChecker) Start(ctx context.Context) {
+	logger := log.FromContext(ctx).With("component", "health checker")
+	ctx = log.ContextWithLogger(ctx, logger)
+	if c.config.Interval <= 0 {
+		logger.DebugContext(ctx, "health checker is disabled")
+		return
+	}
+	logger.DebugContext(ctx, "Starting health checker", "interval", c.config.Interval, "timeout", c.config.Timeout, "threshold", c.config.Threshold)
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check probes all entries concurrently and waits for them.
+func (c *HealthChecker) check(ctx context.Context) {
+	logger := log.FromContext(ctx)
+
+	keys := map[string]struct{}{}
+	var wg sync.WaitGroup
+	for _, entry := range c.entries.List(ctx) {
+		key := entry.key()
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		keys[key] = struct{}{}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := probe(ctx, entry, c.config.Timeout)
+			if errors.Is(err, errNotProbed) || ctx.Err() != nil {
+				return
+			}
+			if !c.entries.report(entry, err, c.config.Threshold) {
+				return
+			}
+			if err != nil {
+				logger.WarnContext(ctx, "destination entry is unhealthy", "entry", entry, "error", err)
+			} else {
+				logger.InfoContext(ctx, "destination entry is healthy", "entry", entry)
+			}
+		}()
+	}
+	wg.Wait()
+	c.entries.forget(keys)
+}
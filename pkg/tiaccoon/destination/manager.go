@@ -11,18 +11,45 @@ type Manager struct {
 	Entries *Entries
 }
 
-func NewManager(myVIP net.IP, featureRDMA bool) *Manager {
+func NewManager(featureRDMA bool) *Manager {
 	return &Manager{
-		Entries: newEntries(myVIP, featureRDMA),
+		Entries: newEntries(featureRDMA),
 	}
 }
 
-func (m *Manager) Upsert(ctx context.Context, vip net.IP, vport uint16, transport TransportType, address TransportAddr) {
-	m.Entries.upsert(ctx, vip, vport, transport, address)
-	log.FromContext(ctx).InfoContext(ctx, "destination upserted", "vip", vip, "vport", vport, "transport", transport.String(), "address", address.String())
+func (m *Manager) Upsert(ctx context.Context, entry *Entry) {
+	m.Entries.upsert(ctx, entry)
+	log.FromContext(ctx).InfoContext(ctx, "destination upserted", "vip", entry.VIP, "vport", entry.VPort, "transport", entry.Transport.String(), "address", entry.Address.String(), "weight", entry.Weight, "balancer", entry.Balancer.String())
 }
 
 func (m *Manager) Remove(ctx context.Context, vip net.IP, vport uint16) {
 	m.Entries.remove(ctx, vip, vport)
 	log.FromContext(ctx).InfoContext(ctx, "destination removed", "vip", vip, "vport", vport)
 }
+
+// Replace replaces all entries of the VIP and vport at once. Empty entries removes them.
+func (m *Manager) Replace(ctx context.Context, vip net.IP, vport uint16, entries []*Entry) {
+	m.Entries.replace(ctx, vip, vport, entries)
+	log.FromContext(ctx).InfoContext(ctx, "destination replaced", "vip", vip, "vport", vport, "entries", entries)
+}
+
+// ReplaceOrigin replaces the entries of the origin for the VIP and vport at once, keeping the entries of the other origins.
+// Empty entries removes only those of the origin.
+func (m *Manager) ReplaceOrigin(ctx context.Context, vip net.IP, vport uint16, origin string, entries []*Entry) {
+	m.Entries.replaceOrigin(ctx, vip, vport, origin, entries)
+	log.FromContext(ctx).InfoContext(ctx, "destination replaced", "vip", vip, "vport", vport, "origin", origin, "entries", entries)
+}
+
+// RemoveVIPOrigin removes the entries of the origin for all vports of the VIP, keeping the entries of the other origins.
+func (m *Manager) RemoveVIPOrigin(ctx context.Context, vip net.IP, origin string) {
+	vports := make(map[uint16]struct{})
+	for _, entry := range m.Entries.List(ctx) {
+		if entry.VIP.Equal(vip) && entry.Origin == origin {
+			vports[entry.VPort] = struct{}{}
+		}
+	}
+	for vport := range vports {
+		m.Entries.replaceOrigin(ctx, vip, vport, origin, nil)
+	}
+	log.FromContext(ctx).InfoContext(ctx, "destinations of vip removed", "vip", vip, "origin", origin, "vports", len(vports))
+}
@@ -1,9 +1,14 @@
 package destination
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type TransportType int32
@@ -35,6 +40,59 @@ func (p TransportType) String() string {
 	}
 }
 
+// ParseTransportType parses the name returned by TransportType.String case-insensitively.
+func ParseTransportType(s string) (TransportType, error) {
+	for t := TransportType(0); t < NumTransportType; t++ {
+		if strings.EqualFold(s, t.String()) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown transport %q", s)
+}
+
+// ParseTransportOrder parses the names of the transports in the order to try. Empty is nil, the default order.
+func ParseTransportOrder(names []string) ([]TransportType, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	order := make([]TransportType, 0, len(names))
+	for _, name := range names {
+		t, err := ParseTransportType(name)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(order, t) {
+			return nil, fmt.Errorf("duplicated transport %q", name)
+		}
+		order = append(order, t)
+	}
+	return order, nil
+}
+
+// FormatTransportOrder returns the names of the transports, which ParseTransportOrder parses.
+func FormatTransportOrder(order []TransportType) []string {
+	if len(order) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(order))
+	for _, t := range order {
+		names = append(names, t.String())
+	}
+	return names
+}
+
+// ParseConnectTimeout parses a duration like "500ms". Empty is 0, the default timeout.
+func ParseConnectTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid connect timeout %q", s)
+	}
+	return d, nil
+}
+
 type TransportAddr interface {
 	Byte() []byte
 	String() string
@@ -68,6 +126,34 @@ func (t TransportAddrIPv4) Port() int {
 	return t.port
 }
 
+type TransportAddrIPv6 struct {
+	ip   net.IP
+	port int
+}
+
+func NewTransportAddrIPv6(ip [16]byte, port int) TransportAddrIPv6 {
+	return TransportAddrIPv6{
+		net.IP(ip[:]),
+		port,
+	}
+}
+
+func (t TransportAddrIPv6) Byte() []byte {
+	return append(slices.Clone(t.ip.To16()), byte(t.port>>8), byte(t.port))
+}
+
+func (t TransportAddrIPv6) String() string {
+	return net.JoinHostPort(t.ip.String(), strconv.Itoa(t.port))
+}
+
+func (t TransportAddrIPv6) IP() [16]byte {
+	return [16]byte(t.ip.To16())
+}
+
+func (t TransportAddrIPv6) Port() int {
+	return t.port
+}
+
 type TransportAddrUNIX struct {
 	path string
 }
@@ -126,3 +212,67 @@ func (t TransportAddrRDMA) IP() [4]byte {
 func (t TransportAddrRDMA) Port() uint16 {
 	return t.port
 }
+
+// ParseTransportAddr parses the address of the transport in the format returned by TransportAddr.String.
+func ParseTransportAddr(transport TransportType, s string) (TransportAddr, error) {
+	switch transport {
+	case TransportUNIX:
+		if s == "" {
+			return nil, errors.New("empty UNIX socket path")
+		}
+		return NewTransportAddrUNIX(s), nil
+	case TransportRDMA:
+		ip, port, err := parseIPv4Port(s)
+		if err != nil {
+			return nil, err
+		}
+		return NewTransportAddrRDMA(ip, port), nil
+	case TransportIPv6:
+		ip, port, err := parseIPv6Port(s)
+		if err != nil {
+			return nil, err
+		}
+		return NewTransportAddrIPv6(ip, int(port)), nil
+	case TransportIPv4:
+		ip, port, err := parseIPv4Port(s)
+		if err != nil {
+			return nil, err
+		}
+		return NewTransportAddrIPv4(ip, int(port)), nil
+	default:
+		return nil, fmt.Errorf("transport %s is not supported", transport.String())
+	}
+}
+
+func parseIPv4Port(s string) ([4]byte, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return [4]byte{}, 0, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return [4]byte{}, 0, fmt.Errorf("invalid address %q: %q is not an IPv4 address", s, host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return [4]byte{}, 0, fmt.Errorf("invalid address %q: invalid port %q", s, portStr)
+	}
+	return [4]byte{ip[0], ip[1], ip[2], ip[3]}, uint16(port), nil
+}
+
+// parseIPv6Port parses "[ip]:port". IPv4 addresses including IPv4-mapped ones are rejected.
+func parseIPv6Port(s string) ([16]byte, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return [16]byte{}, 0, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return [16]byte{}, 0, fmt.Errorf("invalid address %q: %q is not an IPv6 address", s, host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return [16]byte{}, 0, fmt.Errorf("invalid address %q: invalid port %q", s, portStr)
+	}
+	return [16]byte(ip.To16()), uint16(port), nil
+}
@@ -2,10 +2,15 @@ package manage
 
 import (
 	"context"
-	"net"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/config"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
 )
 
@@ -13,290 +18,190 @@ type Manager struct {
 	am            *accesscontrol.Manager
 	dm            *destination.Manager
 	defaultPolicy bool
-	myVIP         net.IP
 	featureRDMA   bool
+	configPath    string
+	config        *config.Config
 }
 
-func NewManager(defaultPolicy bool, myVIP net.IP, featureRDMA bool) *Manager {
+func NewManager(defaultPolicy bool, featureRDMA bool, configPath string) *Manager {
 	return &Manager{
 		defaultPolicy: defaultPolicy,
-		myVIP:         myVIP,
 		featureRDMA:   featureRDMA,
+		configPath:    configPath,
 	}
 }
 
+// AccessControl returns the access control manager. It is available after Start.
+func (m *Manager) AccessControl() *accesscontrol.Manager {
+	return m.am
+}
+
+// Destination returns the destination manager. It is available after Start.
+func (m *Manager) Destination() *destination.Manager {
+	return m.dm
+}
+
 func (m *Manager) Close(ctx context.Context) {
 	logger := log.FromContext(ctx).With("component", "manager")
 	logger.DebugContext(ctx, "Closing manager")
 }
 
-func (m *Manager) Start(ctx context.Context) (sae, cae *accesscontrol.Entries, de *destination.Entries) {
+func (m *Manager) Start(ctx context.Context) (sae, cae *accesscontrol.Entries, de *destination.Entries, err error) {
 	logger := log.FromContext(ctx).With("component", "manager")
 	ctx = log.ContextWithLogger(ctx, logger)
 	logger.DebugContext(ctx, "Starting manager")
 
 	m.am = accesscontrol.NewManager(m.defaultPolicy)
-	m.dm = destination.NewManager(m.myVIP, m.featureRDMA)
-
-	go m.manage(ctx)
+	m.dm = destination.NewManager(m.featureRDMA)
+
+	if m.configPath != "" {
+		cfg, err := config.Load(m.configPath)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to load config: %w", err)
+		}
+		if err := m.apply(ctx, cfg); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to apply config: %w", err)
+		}
+		m.config = cfg
+		logger.InfoContext(ctx, "config applied", "path", m.configPath)
+
+		go m.manage(ctx)
+	}
 
-	return m.am.ServerEntries, m.am.ClientEntries, m.dm.Entries
+	return m.am.ServerEntries, m.am.ClientEntries, m.dm.Entries, nil
 }
 
 func (m *Manager) manage(ctx context.Context) {
-	// TODO: Implement the logic to manage the entries
-	m.am.UpsertClient(ctx, net.IPv4(10, 0, 10, 50), true)
-
-	// TODO: allow zero bind (dynamic port)
-	m.dm.Upsert(ctx,
-		net.IPv4(0, 0, 0, 0),
-		0,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 0),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		0,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 0),
-	)
-
-	var yourVIP net.IP
-	if m.myVIP.Equal(net.IPv4(10, 0, 10, 40)) {
-		yourVIP = net.IPv4(10, 0, 10, 50)
-	} else {
-		yourVIP = net.IPv4(10, 0, 10, 40)
+	logger := log.FromContext(ctx)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.InfoContext(ctx, "Received SIGHUP, reloading config", "path", m.configPath)
+			if err := m.reload(ctx); err != nil {
+				logger.ErrorContext(ctx, "Failed to reload config, keeping current entries", "error", err)
+				continue
+			}
+			logger.InfoContext(ctx, "config reloaded", "path", m.configPath)
+		}
 	}
-
-	// netperf
-	// m.netperfTCPLocal(ctx, yourVIP)
-	// m.netperfTCPRemote(ctx, yourVIP)
-	// m.netperfUNIX(ctx, yourVIP)
-	// m.netperfRDMALocal(ctx, yourVIP)
-	// m.netperfRDMARemote(ctx, yourVIP)
-
-	m.nginxTCPLocal(ctx, yourVIP)
-
-	// m.testDestination(ctx, yourVIP)
 }
 
-func (m *Manager) testDestination(ctx context.Context, yourVIP net.IP) {
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		net.IPv4(127, 0, 0, 1),
-		6000,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{127, 0, 0, 1}, 18000),
-	)
-	m.dm.Upsert(ctx,
-		net.IPv4(127, 0, 0, 1),
-		8000,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{192, 168, 20, 3}, 18000),
-	)
-	m.dm.Upsert(ctx,
-		net.IPv4(127, 0, 0, 1),
-		9000,
-		destination.TransportUNIX,
-		destination.NewTransportAddrUNIX("/tmp/test.sock"),
-	)
-	m.dm.Upsert(ctx,
-		net.IPv4(127, 0, 0, 1),
-		7000,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{192, 168, 20, 30}, 17000),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		8000,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 18000),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		8000,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 28000),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		8000,
-		destination.TransportUNIX,
-		destination.NewTransportAddrUNIX("/tmp/test.sock"),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		8000,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{0, 0, 0, 0}, 17000),
-	)
+// reload loads the config file again and applies only the difference from the current config.
+// Entries are only looked up on connect and bind, so already bypassed sockets are not affected.
+func (m *Manager) reload(ctx context.Context) error {
+	cfg, err := config.Load(m.configPath)
+	if err != nil {
+		return err
+	}
+	if err := m.applyDiff(ctx, m.config, cfg); err != nil {
+		return err
+	}
+	m.config = cfg
+	return nil
 }
 
-func (m *Manager) netperfTCPLocal(ctx context.Context, yourVIP net.IP) {
-	// TCP Local
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		yourVIP,
-		12865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{127, 0, 0, 1}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		yourVIP,
-		22865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{127, 0, 0, 1}, 22865),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		12865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		22865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 22865),
-	)
+// applyDiff applies the difference from the config from to the config to.
+func (m *Manager) applyDiff(ctx context.Context, from, to *config.Config) error {
+	oldClient, newClient := rulesByMatch(from.ClientRules), rulesByMatch(to.ClientRules)
+	for key, rule := range oldClient {
+		if _, ok := newClient[key]; !ok {
+			if err := m.am.RemoveClient(ctx, rule.Match); err != nil {
+				return err
+			}
+		}
+	}
+	for key, rule := range newClient {
+		if old, ok := oldClient[key]; !ok || old.Policy != rule.Policy {
+			if err := m.am.UpsertClient(ctx, rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	oldServer, newServer := rulesByMatch(from.ServerRules), rulesByMatch(to.ServerRules)
+	for key, rule := range oldServer {
+		if _, ok := newServer[key]; !ok {
+			if err := m.am.RemoveServer(ctx, rule.Match); err != nil {
+				return err
+			}
+		}
+	}
+	for key, rule := range newServer {
+		if old, ok := oldServer[key]; !ok || old.Policy != rule.Policy {
+			if err := m.am.UpsertServer(ctx, rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	// destination.Manager replaces entries per (VIP, vport), so compare them in the same unit.
+	// Only the entries of the config file are replaced, keeping those added by the API or the controllers.
+	oldDest, newDest := destinationsByVIPPort(from.Destinations), destinationsByVIPPort(to.Destinations)
+	for key, entries := range oldDest {
+		if _, ok := newDest[key]; !ok {
+			m.dm.ReplaceOrigin(ctx, entries[0].VIP, entries[0].VPort, destination.OriginConfig, nil)
+		}
+	}
+	for key, entries := range newDest {
+		if old, ok := oldDest[key]; ok && slices.Equal(entryKeys(old), entryKeys(entries)) {
+			continue
+		}
+		m.dm.ReplaceOrigin(ctx, entries[0].VIP, entries[0].VPort, destination.OriginConfig, entries)
+	}
+	return nil
 }
 
-func (m *Manager) netperfTCPRemote(ctx context.Context, yourVIP net.IP) {
-	// TCP Remote
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		yourVIP,
-		12865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{192, 168, 20, 3}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		yourVIP,
-		22865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{192, 168, 20, 3}, 22865),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		12865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		22865,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 22865),
-	)
+func rulesByMatch(rules []*accesscontrol.Entry) map[string]*accesscontrol.Entry {
+	m := make(map[string]*accesscontrol.Entry, len(rules))
+	for _, rule := range rules {
+		m[rule.Match.String()] = rule
+	}
+	return m
 }
 
-func (m *Manager) netperfUNIX(ctx context.Context, yourVIP net.IP) {
-	// UNIX
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		yourVIP,
-		12865,
-		destination.TransportUNIX,
-		destination.NewTransportAddrUNIX("/tmp/tiaccoon/netperf-remote.sock"),
-	)
-	m.dm.Upsert(ctx,
-		yourVIP,
-		22865,
-		destination.TransportUNIX,
-		destination.NewTransportAddrUNIX("/tmp/tiaccoon/netperf-local.sock"),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		12865,
-		destination.TransportUNIX,
-		destination.NewTransportAddrUNIX("/tmp/tiaccoon/netperf-remote.sock"),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		22865,
-		destination.TransportUNIX,
-		destination.NewTransportAddrUNIX("/tmp/tiaccoon/netperf-local.sock"),
-	)
+type vipPort struct {
+	vip   string
+	vport uint16
 }
 
-func (m *Manager) netperfRDMALocal(ctx context.Context, yourVIP net.IP) {
-	// RDMA
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		yourVIP,
-		12865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{192, 168, 20, 21}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		yourVIP,
-		22865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{192, 168, 20, 21}, 22865),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		12865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{0, 0, 0, 0}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		22865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{0, 0, 0, 0}, 22865),
-	)
+func destinationsByVIPPort(entries []*destination.Entry) map[vipPort][]*destination.Entry {
+	m := make(map[vipPort][]*destination.Entry, len(entries))
+	for _, entry := range entries {
+		key := vipPort{entry.VIP.String(), entry.VPort}
+		m[key] = append(m[key], entry)
+	}
+	return m
 }
 
-func (m *Manager) netperfRDMARemote(ctx context.Context, yourVIP net.IP) {
-	// RDMA
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		yourVIP,
-		12865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{192, 168, 20, 30}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		yourVIP,
-		22865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{192, 168, 20, 30}, 22865),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		12865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{0, 0, 0, 0}, 12865),
-	)
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		22865,
-		destination.TransportRDMA,
-		destination.NewTransportAddrRDMA([4]byte{0, 0, 0, 0}, 22865),
-	)
+func entryKeys(entries []*destination.Entry) []string {
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, fmt.Sprintf("%s %s %d %s %s %v", entry.Transport, entry.Address, entry.Weight, entry.Balancer, entry.ConnectTimeout, entry.Transports))
+	}
+	slices.Sort(keys)
+	return keys
 }
 
-func (m *Manager) nginxTCPLocal(ctx context.Context, yourVIP net.IP) {
-	// TCP Local
-	// ClientEntry
-	m.dm.Upsert(ctx,
-		yourVIP,
-		80,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{127, 0, 0, 1}, 8080),
-	)
-	// ServerEntries
-	m.dm.Upsert(ctx,
-		m.myVIP,
-		80,
-		destination.TransportIPv4,
-		destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 8080),
-	)
+func (m *Manager) apply(ctx context.Context, cfg *config.Config) error {
+	for _, rule := range cfg.ClientRules {
+		if err := m.am.UpsertClient(ctx, rule); err != nil {
+			return err
+		}
+	}
+	for _, rule := range cfg.ServerRules {
+		if err := m.am.UpsertServer(ctx, rule); err != nil {
+			return err
+		}
+	}
+	for _, entry := range cfg.Destinations {
+		m.dm.Upsert(ctx, entry)
+	}
+	return nil
 }
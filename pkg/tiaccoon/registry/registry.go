@@ -0,0 +1,174 @@
+// Package registry keeps the containers registered by the CNI plugin.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+)
+
+// Registration is a container attached to the network by the CNI plugin.
+type Registration struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifName"`
+	Network     string `json:"network"` // name of the CNI network
+	Netns       string `json:"netns"`
+	VIP         net.IP `json:"vip"`
+}
+
+// Registry is safe for concurrent use.
+type Registry struct {
+	mu            sync.RWMutex
+	registrations map[string]*Registration // keyed by container ID
+
+	// path is the file the registrations are saved to, so that they survive restarts of tiaccoon.
+	// Empty keeps them only in memory.
+	path string
+}
+
+// New returns a registry saved to the file at path, or kept only in memory if path is empty.
+// The registrations saved before are read by Load.
+func New(path string) *Registry {
+	return &Registry{
+		registrations: make(map[string]*Registration),
+		path:          path,
+	}
+}
+
+// Load reads the registrations saved to the file. A missing file is an empty registry.
+func (r *Registry) Load(ctx context.Context) error {
+	if r.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Registration
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("invalid registry file %s: %w", r.path, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reg := range list {
+		if ip4 := reg.VIP.To4(); ip4 != nil {
+			reg.VIP = ip4
+		}
+		r.registrations[reg.ContainerID] = reg
+	}
+	log.FromContext(ctx).InfoContext(ctx, "registry loaded", "path", r.path, "containers", len(list))
+	return nil
+}
+
+// saveLocked writes all registrations to the file, replacing it atomically. r.mu must be held.
+func (r *Registry) saveLocked() error {
+	if r.path == "" {
+		return nil
+	}
+	list := make([]*Registration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		list = append(list, reg)
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), r.path)
+}
+
+// Register registers the container, replacing the registration of the same container ID.
+// The registration is kept unchanged if it cannot be saved.
+func (r *Registry) Register(ctx context.Context, reg *Registration) error {
+	r.mu.Lock()
+	prev, ok := r.registrations[reg.ContainerID]
+	r.registrations[reg.ContainerID] = reg
+	if err := r.saveLocked(); err != nil {
+		if ok {
+			r.registrations[reg.ContainerID] = prev
+		} else {
+			delete(r.registrations, reg.ContainerID)
+		}
+		r.mu.Unlock()
+		return fmt.Errorf("cannot save registry: %w", err)
+	}
+	r.mu.Unlock()
+	log.FromContext(ctx).InfoContext(ctx, "container registered", "containerID", reg.ContainerID, "vip", reg.VIP, "network", reg.Network, "ifName", reg.IfName)
+	return nil
+}
+
+// Unregister unregisters the container and returns its registration or nil if not registered.
+// The registration is kept if it cannot be saved.
+func (r *Registry) Unregister(ctx context.Context, containerID string) (*Registration, error) {
+	r.mu.Lock()
+	reg, ok := r.registrations[containerID]
+	if !ok {
+		r.mu.Unlock()
+		return nil, nil
+	}
+	delete(r.registrations, containerID)
+	if err := r.saveLocked(); err != nil {
+		r.registrations[containerID] = reg
+		r.mu.Unlock()
+		return nil, fmt.Errorf("cannot save registry: %w", err)
+	}
+	r.mu.Unlock()
+	log.FromContext(ctx).InfoContext(ctx, "container unregistered", "containerID", containerID, "vip", reg.VIP)
+	return reg, nil
+}
+
+// Get returns the registration of the container or nil.
+func (r *Registry) Get(containerID string) *Registration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.registrations[containerID]
+}
+
+// List returns all registrations ordered by container ID.
+func (r *Registry) List() []*Registration {
+	r.mu.RLock()
+	list := make([]*Registration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		list = append(list, reg)
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(list, func(x, y *Registration) int {
+		return strings.Compare(x.ContainerID, y.ContainerID)
+	})
+	return list
+}
+
+// HasVIP reports whether any container is registered with the VIP.
+func (r *Registry) HasVIP(vip net.IP) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.VIP.Equal(vip) {
+			return true
+		}
+	}
+	return false
+}
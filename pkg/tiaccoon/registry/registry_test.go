@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry.json")
+
+	r := New(path)
+	if err := r.Load(ctx); err != nil {
+		t.Fatalf("Load of a missing file: %v", err)
+	}
+	a := &Registration{ContainerID: "a", IfName: "eth0", Network: "test", Netns: "/var/run/netns/a", VIP: net.ParseIP("10.0.0.1").To4()}
+	b := &Registration{ContainerID: "b", IfName: "eth0", Network: "test", Netns: "/var/run/netns/b", VIP: net.ParseIP("10.0.0.2").To4()}
+	for _, reg := range []*Registration{a, b} {
+		if err := r.Register(ctx, reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reg, err := r.Unregister(ctx, "b"); err != nil || reg != b {
+		t.Fatalf("Unregister(b) = %v, %v", reg, err)
+	}
+	if reg, err := r.Unregister(ctx, "b"); err != nil || reg != nil {
+		t.Fatalf("Unregister(b) again = %v, %v", reg, err)
+	}
+
+	restarted := New(path)
+	if err := restarted.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.List(); !reflect.DeepEqual(got, []*Registration{a}) {
+		t.Errorf("List after restart = %v, want [%v]", got, a)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(path).Load(context.Background()); err == nil {
+		t.Error("Load of an invalid file succeeded")
+	}
+}
+
+func TestRegisterSaveError(t *testing.T) {
+	ctx := context.Background()
+	r := New(filepath.Join(t.TempDir(), "missing", "registry.json"))
+	if err := r.Register(ctx, &Registration{ContainerID: "a", VIP: net.ParseIP("10.0.0.1").To4()}); err == nil {
+		t.Fatal("Register succeeded without saving")
+	}
+	if r.Get("a") != nil {
+		t.Error("registration kept after the save failed")
+	}
+}
+
+func TestMemoryOnly(t *testing.T) {
+	ctx := context.Background()
+	r := New("")
+	if err := r.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(ctx, &Registration{ContainerID: "a", VIP: net.ParseIP("10.0.0.1").To4()}); err != nil {
+		t.Fatal(err)
+	}
+	if !r.HasVIP(net.ParseIP("10.0.0.1")) {
+		t.Error("HasVIP(10.0.0.1) = false")
+	}
+}
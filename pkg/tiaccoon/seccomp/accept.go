@@ -0,0 +1,485 @@
+package seccomp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+var errAcceptQueueClosed = errors.New("accept queue is closed")
+
+// vaddrTimeout bounds the time for an accepted connection to send its virtual address. It is dropped after that.
+const vaddrTimeout = 3 * time.Second
+
+// acceptQueue waits for the connections on the listening host sockets of a socket by epoll,
+// so that they are accepted only when the container calls accept(2) and stay in the backlog of the host sockets until then.
+// The accepted connections are watched by the same epoll until their virtual addresses arrive.
+type acceptQueue struct {
+	mu     sync.Mutex
+	epfd   int
+	wakeFd int // eventfd to wake up the waiters on close
+	closed bool
+	// waiters is the number of the requests in wait. The fds are closed after the last of them returns.
+	waiters int
+	// pending is the accepted connections waiting for their virtual addresses, keyed by the fd.
+	pending map[int]*pendingConn
+}
+
+// pendingConn is an accepted connection which has not sent its virtual address yet.
+type pendingConn struct {
+	hs       *hostSocket
+	deadline time.Time
+}
+
+func newAcceptQueue() (*acceptQueue, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create epoll: %w", err)
+	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, fmt.Errorf("failed to create eventfd: %w", err)
+	}
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wakeFd)})
+	if err != nil {
+		unix.Close(wakeFd)
+		unix.Close(epfd)
+		return nil, fmt.Errorf("failed to add eventfd to epoll: %w", err)
+	}
+	return &acceptQueue{epfd: epfd, wakeFd: wakeFd, pending: map[int]*pendingConn{}}, nil
+}
+
+// add watches the listening host socket, which is made non-blocking so that a connection taken by another request does not block.
+func (q *acceptQueue) add(sockfdOnHost int) error {
+	if err := syscall.SetNonblock(sockfdOnHost, true); err != nil {
+		return fmt.Errorf("failed to set O_NONBLOCK: %w", err)
+	}
+	err := unix.EpollCtl(q.epfd, unix.EPOLL_CTL_ADD, sockfdOnHost, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(sockfdOnHost)})
+	if err != nil {
+		return fmt.Errorf("failed to add host socket to epoll: %w", err)
+	}
+	return nil
+}
+
+// remove stops watching the host socket.
+func (q *acceptQueue) remove(sockfdOnHost int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		unix.EpollCtl(q.epfd, unix.EPOLL_CTL_DEL, sockfdOnHost, nil)
+	}
+}
+
+// addPending watches the accepted connection until its virtual address arrives or vaddrTimeout passes.
+func (q *acceptQueue) addPending(hs *hostSocket) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errAcceptQueueClosed
+	}
+	err := unix.EpollCtl(q.epfd, unix.EPOLL_CTL_ADD, hs.Sockfd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(hs.Sockfd)})
+	if err != nil {
+		return fmt.Errorf("failed to add accepted socket to epoll: %w", err)
+	}
+	q.pending[hs.Sockfd] = &pendingConn{hs: hs, deadline: time.Now().Add(vaddrTimeout)}
+	return nil
+}
+
+// takePending removes the pending connections from the queue, which are put back by putPending if still pending.
+// They are kept watched by epoll until done.
+func (q *acceptQueue) takePending() []*pendingConn {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	conns := make([]*pendingConn, 0, len(q.pending))
+	for fd, c := range q.pending {
+		conns = append(conns, c)
+		delete(q.pending, fd)
+	}
+	return conns
+}
+
+// putPending puts back the connection taken by takePending.
+func (q *acceptQueue) putPending(c *pendingConn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		syscall.Close(c.hs.Sockfd)
+		return
+	}
+	q.pending[c.hs.Sockfd] = c
+}
+
+// donePending stops watching the connection taken by takePending, which is handed over or closed by the caller.
+// It must be called before the fd is duplicated into the container, or epoll keeps watching the copy.
+func (q *acceptQueue) donePending(c *pendingConn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		unix.EpollCtl(q.epfd, unix.EPOLL_CTL_DEL, c.hs.Sockfd, nil)
+	}
+}
+
+// expire drops the pending connections past their deadlines. q.mu must be held.
+// It returns the timeout of epoll_wait(2) until the next deadline, or -1 if there are no pending connections.
+func (q *acceptQueue) expire(now time.Time) int {
+	timeout := -1
+	for fd, c := range q.pending {
+		if !now.Before(c.deadline) {
+			unix.EpollCtl(q.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+			syscall.Close(fd)
+			delete(q.pending, fd)
+			continue
+		}
+		ms := int(c.deadline.Sub(now).Milliseconds()) + 1
+		if timeout < 0 || ms < timeout {
+			timeout = ms
+		}
+	}
+	return timeout
+}
+
+// wait blocks until some host sockets have connections or some accepted connections have data, and returns them.
+// It returns errAcceptQueueClosed when the queue is closed.
+func (q *acceptQueue) wait() ([]int, error) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, errAcceptQueueClosed
+	}
+	q.waiters++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.waiters--
+		if q.closed && q.waiters == 0 {
+			q.release()
+		}
+		q.mu.Unlock()
+	}()
+
+	events := make([]unix.EpollEvent, 16)
+	for {
+		q.mu.Lock()
+		timeout := q.expire(time.Now())
+		q.mu.Unlock()
+		n, err := unix.EpollWait(q.epfd, events, timeout)
+		if err == unix.EINTR || (err == nil && n == 0) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait epoll: %w", err)
+		}
+		ready := []int{}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == q.wakeFd {
+				return nil, errAcceptQueueClosed
+			}
+			ready = append(ready, int(ev.Fd))
+		}
+		return ready, nil
+	}
+}
+
+// close wakes up the waiters. The eventfd stays readable, so every waiter returns.
+func (q *acceptQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	buf := make([]byte, 8)
+	binary.NativeEndian.PutUint64(buf, 1)
+	unix.Write(q.wakeFd, buf)
+	if q.waiters == 0 {
+		q.release()
+	}
+}
+
+// release closes the fds. q.mu must be held.
+func (q *acceptQueue) release() {
+	for fd := range q.pending {
+		syscall.Close(fd)
+		delete(q.pending, fd)
+	}
+	unix.Close(q.epfd)
+	unix.Close(q.wakeFd)
+}
+
+// acceptReady accepts a connection allowed by the server rules from the ready host sockets. s.mu must be held.
+// Only the connections whose virtual addresses have arrived are returned, and the others are left pending,
+// so it never blocks. It returns nil if no connection is left, which happens when another request has taken it.
+func (s *socketStatus) acceptReady(ctx context.Context, ready []int, sae *accesscontrol.View) *hostSocket {
+	logger := log.FromContext(ctx)
+	q := s.acceptQueue
+	if q == nil {
+		return nil
+	}
+
+	// Connections pending are checked regardless of ready since another request may have consumed their events.
+	var accepted *hostSocket
+	for _, c := range q.takePending() {
+		if accepted != nil {
+			q.putPending(c)
+			continue
+		}
+		err := s.recvVAddr(c.hs)
+		if errors.Is(err, syscall.EAGAIN) {
+			q.putPending(c)
+			continue
+		}
+		q.donePending(c)
+		if err != nil {
+			logger.DebugContext(ctx, "dropped accepted connection", "error", err, "acceptedHostSocket", c.hs)
+			syscall.Close(c.hs.Sockfd)
+			continue
+		}
+		if s.admit(ctx, c.hs, sae) {
+			accepted = c.hs
+		}
+	}
+	if accepted != nil {
+		return accepted
+	}
+
+	for _, sockfd := range ready {
+		v, ok := s.hostSockets.Load(sockfd)
+		if !ok {
+			continue
+		}
+		hs := v.(*hostSocket)
+		if hs.State != HostSocketListening {
+			continue
+		}
+		for {
+			as, err := s.transportAcceptOnce(ctx, hs)
+			if errors.Is(err, syscall.EAGAIN) {
+				break
+			}
+			if err != nil {
+				logger.ErrorContext(ctx, "failed to accept", "error", err, "hostSocket", hs)
+				hs.State = HostSocketError
+				q.remove(hs.Sockfd)
+				break
+			}
+
+			err = s.recvVAddr(as)
+			if errors.Is(err, syscall.EAGAIN) {
+				if err := q.addPending(as); err != nil {
+					logger.ErrorContext(ctx, "failed to wait for virtual address", "error", err, "acceptedHostSocket", as)
+					syscall.Close(as.Sockfd)
+				}
+				continue
+			}
+			if err != nil {
+				logger.DebugContext(ctx, "dropped accepted connection", "error", err, "acceptedHostSocket", as)
+				syscall.Close(as.Sockfd)
+				continue
+			}
+			if s.admit(ctx, as, sae) {
+				return as
+			}
+		}
+	}
+	return nil
+}
+
+// recvVAddr sets the virtual address of the peer to the accepted connection if it has arrived. It returns EAGAIN if not.
+func (s *socketStatus) recvVAddr(as *hostSocket) error {
+	vsa, err := recvDstVAddr(as.Sockfd)
+	if err != nil {
+		return err
+	}
+	as.Entry.VIP = vsa.IP
+	as.Entry.VPort = uint16(vsa.Port)
+	return nil
+}
+
+// admit applies the server rules to the accepted connection and closes it if denied.
+func (s *socketStatus) admit(ctx context.Context, as *hostSocket, sae *accesscontrol.View) bool {
+	logger := log.FromContext(ctx)
+	if s.localVAddr.Family == syscall.AF_INET && as.Entry.VIP.To4() == nil {
+		logger.ErrorContext(ctx, "IPv6 client cannot be accepted by AF_INET socket", "acceptedHostSocket", as)
+		syscall.Close(as.Sockfd)
+		return false
+	}
+	if !sae.Apply(ctx, as.Entry.VIP, s.localVAddr.Port, s.sockType) {
+		logger.ErrorContext(ctx, "access control denied", "acceptedHostSocket", as)
+		syscall.Close(as.Sockfd) // TODO: Close socket more precisely
+		return false
+	}
+	logger.InfoContext(ctx, "access control allowed", "acceptedHostSocket", as)
+	return true
+}
+
+// transportAcceptOnce accepts a connection on the listening host socket.
+func (s *socketStatus) transportAcceptOnce(ctx context.Context, hs *hostSocket) (*hostSocket, error) {
+	logger := log.FromContext(ctx).With("sockfdOnHost", hs.Sockfd)
+	ctx = log.ContextWithLogger(ctx, logger)
+	switch hs.Entry.Transport {
+	case destination.TransportUNIX:
+		return s.transportAcceptUNIX(ctx, hs.Sockfd)
+	case destination.TransportRDMA:
+		return nil, errors.New("UNEXPECTED: RDMA")
+	case destination.TransportIPv6:
+		return s.transportAcceptIPv6(ctx, hs.Sockfd)
+	case destination.TransportIPv4:
+		return s.transportAcceptIPv4(ctx, hs.Sockfd)
+	default:
+		return nil, errors.New("UNEXPECTED: Unknown transport")
+	}
+}
+
+// configureAccepted applies the flags of accept4(2) and the socket options of the listener to the accepted host socket.
+// As on Linux, file status flags such as O_NONBLOCK are not inherited from the listener but given by SOCK_NONBLOCK.
+func (s *socketStatus) configureAccepted(ctx context.Context, sockfdOnHost, flags int) error {
+	logger := log.FromContext(ctx)
+	for _, optVal := range s.socketOptions {
+		// The option may not be supported by the transport of the host socket.
+		if err := setsockopt(sockfdOnHost, optVal); err != nil {
+			logger.WarnContext(ctx, "failed to inherit socket option", "error", err)
+		}
+	}
+	if flags&syscall.SOCK_NONBLOCK != 0 {
+		if err := syscall.SetNonblock(sockfdOnHost, true); err != nil {
+			return fmt.Errorf("failed to set O_NONBLOCK: %w", err)
+		}
+	}
+	return nil
+}
+
+// acceptReadiness makes the listening fd of the container readable while connections are pending on the host sockets,
+// so that poll(2), select(2) and epoll(7) of event-loop servers wake up.
+// The fd of the container is replaced by an end of a socketpair, and the other end writes a byte to make it readable.
+type acceptReadiness struct {
+	mu       sync.Mutex
+	end      int // the copy of the end installed in the container
+	peer     int
+	readable bool
+	closed   bool
+	// rearm resumes watch after the container accepts.
+	rearm chan struct{}
+}
+
+func newAcceptReadiness() (*acceptReadiness, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socketpair: %w", err)
+	}
+	return &acceptReadiness{
+		end:   fds[0],
+		peer:  fds[1],
+		rearm: make(chan struct{}, 1),
+	}, nil
+}
+
+func (r *acceptReadiness) setReadable(readable bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.readable == readable {
+		return
+	}
+	buf := []byte{0}
+	if readable {
+		_, err := syscall.Write(r.peer, buf)
+		r.readable = err == nil
+	} else {
+		_, err := syscall.Read(r.end, buf)
+		r.readable = err != nil
+	}
+}
+
+// watch makes the end readable when connections are pending and waits for the container to accept them.
+func (r *acceptReadiness) watch(ctx context.Context, q *acceptQueue) {
+	for {
+		if _, err := q.wait(); err != nil {
+			return
+		}
+		r.setReadable(true)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.rearm:
+		}
+	}
+}
+
+// accepted clears the readiness after the container accepts. watch sets it again if more connections are pending.
+func (r *acceptReadiness) accepted() {
+	r.setReadable(false)
+	select {
+	case r.rearm <- struct{}{}:
+	default:
+	}
+}
+
+func (r *acceptReadiness) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	syscall.Close(r.end)
+	syscall.Close(r.peer)
+}
+
+// installAcceptReadiness replaces the listening fd of the container with the end of acceptReadiness.
+// The file status flags and FD_CLOEXEC of the fd are kept. It is installed only for non-blocking listening fds,
+// and options which the end does not support are applied to the listening host sockets by handleSysSetsockopt.
+func (s *socketStatus) installAcceptReadiness(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, handler *notifHandler, pid int) error {
+	flags, err := fileFlags(pid, s.sockfd)
+	if err != nil {
+		return err
+	}
+	r, err := newAcceptReadiness()
+	if err != nil {
+		return err
+	}
+	if flags&syscall.O_NONBLOCK != 0 {
+		if err := syscall.SetNonblock(r.end, true); err != nil {
+			r.close()
+			return fmt.Errorf("failed to set O_NONBLOCK: %w", err)
+		}
+	}
+	addfd := seccompNotifAddFd{
+		id:         req.ID,
+		flags:      SeccompAddFdFlagSetFd,
+		srcfd:      uint32(r.end),
+		newfd:      uint32(req.Data.Args[0]),
+		newfdFlags: uint32(flags & syscall.O_CLOEXEC),
+	}
+	if _, err := addfd.ioctlNotifAddFd(notifFd); err != nil {
+		r.close()
+		return fmt.Errorf("ioctl NotifAddFd failed: %w", err)
+	}
+	s.installAliases(ctx, notifFd, req, r.end)
+	s.acceptReadiness = r
+	go r.watch(s.Ctx, s.acceptQueue)
+	log.FromContext(ctx).DebugContext(ctx, "installed accept readiness", "nonblocking", flags&syscall.O_NONBLOCK != 0)
+	return nil
+}
+
+// acceptPending accepts a pending connection on the listening host sockets without blocking. s.mu must be held.
+// Connections whose virtual addresses have not arrived are left pending, as in acceptReady.
+func (s *socketStatus) acceptPending(ctx context.Context, sae *accesscontrol.View) *hostSocket {
+	ready := []int{}
+	s.hostSockets.Range(func(key, value any) bool {
+		if hs := value.(*hostSocket); hs.State == HostSocketListening {
+			ready = append(ready, hs.Sockfd)
+		}
+		return true
+	})
+	return s.acceptReady(ctx, ready, sae)
+}
@@ -0,0 +1,223 @@
+package seccomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+)
+
+// connectRelay is the socket of the container whose non-blocking connect(2) is in progress on the host.
+//
+// The fd of the container is replaced by an end of a socketpair, and the data is relayed between the other end
+// and the host socket once it is connected. The end is filled from itself before it is installed, so it is not writable
+// until the virtual address is sent and the filler is consumed, and the data of the container always follows the address.
+// If the connection fails, the other end is closed with the filler unread, which makes the end writable
+// with SO_ERROR ECONNRESET, as a failed connect(2) of a non-blocking socket reports its error.
+type connectRelay struct {
+	end  int // the copy of the end installed in the container, or -1 once installed
+	peer int
+	// filled is the size of the filler in the receive queue of peer.
+	filled int
+}
+
+func newConnectRelay() (*connectRelay, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socketpair: %w", err)
+	}
+	r := &connectRelay{end: fds[0], peer: fds[1]}
+	if err := syscall.SetNonblock(r.end, true); err != nil {
+		r.close()
+		return nil, fmt.Errorf("failed to set O_NONBLOCK: %w", err)
+	}
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Write(r.end, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("failed to fill socketpair: %w", err)
+		}
+		r.filled += n
+	}
+	return r, nil
+}
+
+// installed closes the copy of the end after the end is installed in the container,
+// so that peer sees EOF when the container closes it.
+func (r *connectRelay) installed() {
+	syscall.Close(r.end)
+	r.end = -1
+}
+
+// close closes the socketpair. The container sees ECONNRESET if the end is installed and the filler is not consumed.
+func (r *connectRelay) close() {
+	if r.end >= 0 {
+		syscall.Close(r.end)
+		r.end = -1
+	}
+	syscall.Close(r.peer)
+}
+
+// start sends the virtual address on the connected host socket, makes the end writable
+// and relays the data until both directions are closed. The host socket is closed afterwards.
+func (r *connectRelay) start(ctx context.Context, sockfdOnHost int, vaddr *sockaddr) error {
+	if vaddr != nil {
+		if err := sendVAddr(sockfdOnHost, vaddr); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 64<<10)
+	for remaining := r.filled; remaining > 0; {
+		n, err := syscall.Read(r.peer, buf[:min(remaining, len(buf))])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to consume filler: %w", err)
+		}
+		if n == 0 {
+			return errors.New("failed to consume filler: socketpair closed")
+		}
+		remaining -= n
+	}
+	r.filled = 0
+
+	host, err := fileConn(sockfdOnHost)
+	if err != nil {
+		return err
+	}
+	peer, err := fileConn(r.peer)
+	if err != nil {
+		host.Close()
+		return err
+	}
+	syscall.Close(sockfdOnHost)
+	syscall.Close(r.peer)
+	go relay(ctx, host, peer)
+	return nil
+}
+
+// fileConn returns a net.Conn of a copy of the fd, so that the relay uses the network poller instead of blocking threads.
+func fileConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "")
+	if f == nil {
+		return nil, fmt.Errorf("invalid fd %d", fd)
+	}
+	// f is not closed since fd is closed by the caller.
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conn: %w", err)
+	}
+	return c, nil
+}
+
+// relay copies the data in both directions. A direction closed by EOF is half-closed on the other side,
+// and an error closes both conns, which the container sees as ECONNRESET or EPIPE.
+func relay(ctx context.Context, host, peer net.Conn) {
+	logger := log.FromContext(ctx)
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		defer func() { done <- struct{}{} }()
+		if _, err := io.Copy(dst, src); err != nil {
+			logger.DebugContext(ctx, "relay closed with error", "error", err)
+			dst.Close()
+			src.Close()
+			return
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}
+	go pipe(host, peer)
+	go pipe(peer, host)
+	<-done
+	<-done
+	host.Close()
+	peer.Close()
+}
+
+// connectInProgress replaces the fd of the container with the end of a connectRelay and answers EINPROGRESS.
+// The connection to the entry is finished in the background, trying the next entries and then the groups after it
+// if it fails. The file status flags and FD_CLOEXEC of the fd are kept. s.mu must be held.
+func (s *socketStatus) connectInProgress(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, flags int, sockfdOnHost int, entry *destination.Entry, next []*destination.Entry, groups [][]*destination.Entry, vaddr *sockaddr) error {
+	r, err := newConnectRelay()
+	if err != nil {
+		return err
+	}
+	addfd := seccompNotifAddFd{
+		id:         req.ID,
+		flags:      SeccompAddFdFlagSetFd,
+		srcfd:      uint32(r.end),
+		newfd:      uint32(req.Data.Args[0]),
+		newfdFlags: uint32(flags & syscall.O_CLOEXEC),
+	}
+	if _, err := addfd.ioctlNotifAddFd(notifFd); err != nil {
+		r.close()
+		return fmt.Errorf("ioctl NotifAddFd failed: %w", err)
+	}
+	s.installAliases(ctx, notifFd, req, r.end)
+	r.installed()
+
+	s.state = Bypassed
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = int32(syscall.EINPROGRESS)
+	resp.Val = 0
+	go s.finishConnect(ctx, handler, r, sockfdOnHost, entry, next, groups, s.remoteVAddr, vaddr)
+	return nil
+}
+
+// finishConnect waits for the connection in progress and starts the relay, or tries the next entries if it fails.
+func (s *socketStatus) finishConnect(ctx context.Context, handler *notifHandler, r *connectRelay, sockfdOnHost int, entry *destination.Entry, next []*destination.Entry, groups [][]*destination.Entry, dstAddr, vaddr *sockaddr) {
+	logger := log.FromContext(ctx)
+
+	err := waitConnected(sockfdOnHost, handler.connectTimeoutOf(entry))
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+	}
+	for err != nil {
+		logger.WarnContext(ctx, "failed to connect", "error", err, "entry", entry)
+		for len(next) == 0 && len(groups) > 0 {
+			next = handler.de.Order(dstAddr.IP, dstAddr.Port, groups[0], handler.vip)
+			groups = groups[1:]
+		}
+		if len(next) == 0 {
+			logger.ErrorContext(ctx, "failed to connect to all destination")
+			r.close()
+			return
+		}
+		entry, next = next[0], next[1:]
+		// The socket of the container is already replaced, so RDMA, which rewrites its address, is not tried.
+		if entry.Transport == destination.TransportRDMA {
+			err = errors.New("RDMA is not available for a connection in progress")
+			continue
+		}
+		sockfdOnHost, err = s.transportConnect(ctx, entry, handler.connectTimeoutOf(entry))
+	}
+	logger.InfoContext(ctx, "connected on host asynchronously", "sockfdOnHost", sockfdOnHost, "entry", entry)
+
+	if err := r.start(ctx, sockfdOnHost, vaddr); err != nil {
+		logger.ErrorContext(ctx, "failed to start relay", "error", err)
+		syscall.Close(sockfdOnHost)
+		r.close()
+		return
+	}
+	s.mu.Lock()
+	if s.Ctx.Err() == nil {
+		s.releaseConn = handler.de.Connected(entry)
+	}
+	s.mu.Unlock()
+}
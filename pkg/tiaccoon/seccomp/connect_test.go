@@ -0,0 +1,169 @@
+package seccomp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// containerEnd returns a copy of the end of r standing for the fd installed in the container.
+func containerEnd(t *testing.T, r *connectRelay) int {
+	t.Helper()
+	fd, err := unix.FcntlInt(uintptr(r.end), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	r.installed()
+	return fd
+}
+
+func pollOut(t *testing.T, fd int, timeout time.Duration) int16 {
+	t.Helper()
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	for {
+		_, err := unix.Poll(fds, int(timeout.Milliseconds()))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fds[0].Revents
+	}
+}
+
+// TestConnectInProgress checks that the socket of the container in progress becomes writable with SO_ERROR 0
+// only after the virtual address is sent, and relays the data after it.
+func TestConnectInProgress(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	r, err := newConnectRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := containerEnd(t, r)
+
+	// EINPROGRESS → poll(POLLOUT) does not return until the connection is finished.
+	if ev := pollOut(t, fd, 100*time.Millisecond); ev != 0 {
+		t.Fatalf("revents = %#x before connected, want 0", ev)
+	}
+
+	sockfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = connectHost(sockfd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: port}, connectNoWait)
+	if err == syscall.EINPROGRESS {
+		err = waitConnected(sockfd, time.Second)
+	}
+	if err != nil {
+		syscall.Close(sockfd)
+		t.Fatal(err)
+	}
+	vaddr := testVAddr(t, 1)
+	if err := r.start(context.Background(), sockfd, vaddr); err != nil {
+		syscall.Close(sockfd)
+		t.Fatal(err)
+	}
+
+	if ev := pollOut(t, fd, time.Second); ev&unix.POLLOUT == 0 || ev&unix.POLLERR != 0 {
+		t.Fatalf("revents = %#x after connected, want POLLOUT", ev)
+	}
+	if soErr, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err != nil || soErr != 0 {
+		t.Fatalf("SO_ERROR = %d, %v, want 0", soErr, err)
+	}
+
+	if _, err := syscall.Write(fd, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept")
+	}
+	defer server.Close()
+	want, err := sockaddrToByte(vaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "hello"...)
+	got := make([]byte, len(want))
+	server.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("received %x, want the virtual address and the data %x", got, want)
+	}
+
+	if _, err := server.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := syscall.Read(fd, buf); err != nil || string(buf[:n]) != "world" {
+		t.Errorf("read %q, %v, want \"world\"", buf[:n], err)
+	}
+}
+
+// TestConnectInProgressFailed checks that the socket of the container becomes writable
+// with SO_ERROR ECONNRESET if the connection fails.
+func TestConnectInProgressFailed(t *testing.T) {
+	r, err := newConnectRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := containerEnd(t, r)
+	r.close()
+
+	if ev := pollOut(t, fd, time.Second); ev&unix.POLLOUT == 0 || ev&unix.POLLERR == 0 {
+		t.Fatalf("revents = %#x after failed, want POLLOUT|POLLERR", ev)
+	}
+	if soErr, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err != nil || syscall.Errno(soErr) != syscall.ECONNRESET {
+		t.Fatalf("SO_ERROR = %d, %v, want ECONNRESET", soErr, err)
+	}
+}
+
+func TestConnectHostNoWait(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	sockfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(sockfd)
+	err = connectHost(sockfd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: port}, connectNoWait)
+	if err == syscall.EINPROGRESS {
+		err = waitConnected(sockfd, time.Second)
+	}
+	if err != syscall.ECONNREFUSED {
+		t.Errorf("connect to a closed port = %v, want ECONNREFUSED", err)
+	}
+}
@@ -0,0 +1,66 @@
+package seccomp
+
+import (
+	"context"
+	"net"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// AnnotationVIP is the OCI annotation giving the VIP of the container.
+// Anyone creating the container can set it, so the containers registered by the CNI plugin ignore it
+// unless it matches their registrations, and the others accept it only if the handler allows it.
+const AnnotationVIP = "tiaccoon.io/vip"
+
+// sandboxIDAnnotations are the OCI annotations set by container runtimes to the ID of the pod sandbox.
+// The CNI plugin registers the sandbox, so the containers in the pod are looked up by it.
+var sandboxIDAnnotations = []string{
+	"io.kubernetes.cri.sandbox-id",  // containerd
+	"io.kubernetes.cri-o.SandboxID", // CRI-O
+}
+
+// containerVIP resolves the VIP of the container from the registration of the container or its sandbox,
+// AnnotationVIP if allowed, and then the VIP given to the handler. It returns nil if none of them is found.
+func (h *Handler) containerVIP(ctx context.Context, state *specs.ContainerProcessState) net.IP {
+	logger := log.FromContext(ctx)
+	if state == nil {
+		return h.defaultVIP
+	}
+
+	annotations := state.State.Annotations
+	var annotated net.IP
+	if s, ok := annotations[AnnotationVIP]; ok {
+		if annotated = net.ParseIP(s); annotated == nil {
+			logger.WarnContext(ctx, "ignoring invalid vip annotation", "annotation", AnnotationVIP, "value", s)
+		}
+	}
+
+	if h.registry != nil {
+		ids := []string{state.State.ID}
+		for _, key := range sandboxIDAnnotations {
+			if id, ok := annotations[key]; ok {
+				ids = append(ids, id)
+			}
+		}
+		for _, id := range ids {
+			if reg := h.registry.Get(id); reg != nil {
+				if annotated != nil && !annotated.Equal(reg.VIP) {
+					logger.WarnContext(ctx, "ignoring vip annotation not matching the registration", "annotation", AnnotationVIP, "value", annotated, "vip", reg.VIP, "containerID", id)
+				}
+				logger.DebugContext(ctx, "vip is given by registration", "vip", reg.VIP, "containerID", id)
+				return reg.VIP
+			}
+		}
+	}
+
+	if annotated != nil {
+		if h.vipAnnotation {
+			logger.DebugContext(ctx, "vip is given by annotation", "vip", annotated)
+			return annotated
+		}
+		logger.WarnContext(ctx, "ignoring vip annotation, which is not allowed", "annotation", AnnotationVIP, "value", annotated)
+	}
+
+	return h.defaultVIP
+}
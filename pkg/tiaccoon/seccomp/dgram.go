@@ -0,0 +1,892 @@
+package seccomp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+)
+
+const (
+	// maxDgramPeers is the number of peers kept for each UDP socket.
+	// The least recently used peer is removed if exceeded.
+	maxDgramPeers = 1024
+	// dgramBufSize is enough for a UDP datagram with the virtual address before it on the host.
+	dgramBufSize = 1<<16 + syscall.SizeofSockaddrInet6
+)
+
+// dgramSeq names the UNIX sockets of the UDP emulation.
+var dgramSeq atomic.Uint64
+
+// dgramStatus is the emulation of a bypassed UDP socket.
+//
+// The socket of the container is replaced by a UNIX datagram socket (the end) bound in the dgram directory,
+// so that poll(2), read(2) and write(2) work without tiaccoon. Datagrams from each peer are sent to the end
+// from a UNIX socket of the peer, and recvfrom(2) and recvmsg(2) tell the virtual address of the peer by its path.
+// A connected socket connects the end to the UNIX socket of the peer, which relays the written datagrams to the host.
+type dgramStatus struct {
+	dir     string
+	end     int
+	endPath string
+
+	mu sync.Mutex
+	// local is the virtual address seen by the peers, which has the VIP if the socket is not bound to an address.
+	local     *sockaddr
+	peers     map[string]*dgramPeer // keyed by the virtual address
+	paths     map[string]*dgramPeer // keyed by the path of the UNIX socket
+	connected *dgramPeer            // nil if not connected
+	clock     uint64
+	closed    bool
+}
+
+// dgramPeer is a peer of a UDP socket.
+type dgramPeer struct {
+	vaddr *sockaddr
+	// fd is the UNIX socket sending the datagrams of the peer to the end, or -1 if it is not created yet.
+	fd   int
+	path string
+	// hs and addr are the host socket and the address on the host to reach the peer, or nil if unknown.
+	hs   *hostSocket
+	addr syscall.Sockaddr
+	// sent is true if the container has sent datagrams to the peer, so its replies skip the server rules.
+	sent bool
+	used uint64
+}
+
+func newDgramStatus(dir string) (*dgramStatus, error) {
+	if dir == "" {
+		return nil, errors.New("directory of the UDP emulation is not available")
+	}
+	d := &dgramStatus{
+		dir:   dir,
+		peers: map[string]*dgramPeer{},
+		paths: map[string]*dgramPeer{},
+	}
+	fd, path, err := d.bindUnix()
+	if err != nil {
+		return nil, err
+	}
+	d.end = fd
+	d.endPath = path
+	return d, nil
+}
+
+// bindUnix creates a UNIX datagram socket bound to a new path in the directory.
+func (d *dgramStatus) bindUnix() (int, string, error) {
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", fmt.Errorf("failed to create socket: %w", err)
+	}
+	path := filepath.Join(d.dir, strconv.FormatUint(dgramSeq.Add(1), 10))
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		syscall.Close(fd)
+		return -1, "", fmt.Errorf("failed to bind %s: %w", path, err)
+	}
+	return fd, path, nil
+}
+
+// peerLocked returns the peer of the virtual address, adding it if not found. d.mu must be held.
+func (d *dgramStatus) peerLocked(vaddr *sockaddr) *dgramPeer {
+	d.clock++
+	key := vaddr.String()
+	if p, ok := d.peers[key]; ok {
+		p.used = d.clock
+		return p
+	}
+	if len(d.peers) >= maxDgramPeers {
+		var oldest *dgramPeer
+		for _, p := range d.peers {
+			if oldest == nil || p.used < oldest.used {
+				oldest = p
+			}
+		}
+		delete(d.peers, oldest.vaddr.String())
+		d.closePeerLocked(oldest)
+	}
+	p := &dgramPeer{vaddr: vaddr, fd: -1, used: d.clock}
+	d.peers[key] = p
+	return p
+}
+
+// openPeerLocked creates the UNIX socket of the peer if it is not created yet. d.mu must be held.
+func (d *dgramStatus) openPeerLocked(p *dgramPeer) error {
+	if p.fd >= 0 {
+		return nil
+	}
+	if d.closed {
+		return errors.New("socket is closed")
+	}
+	fd, path, err := d.bindUnix()
+	if err != nil {
+		return err
+	}
+	p.fd = fd
+	p.path = path
+	d.paths[path] = p
+	return nil
+}
+
+// closePeerLocked closes the UNIX socket of the peer. d.mu must be held.
+func (d *dgramStatus) closePeerLocked(p *dgramPeer) {
+	if p.fd < 0 {
+		return
+	}
+	syscall.Shutdown(p.fd, syscall.SHUT_RDWR)
+	syscall.Close(p.fd)
+	os.Remove(p.path)
+	delete(d.paths, p.path)
+	p.fd = -1
+}
+
+// peerAddr returns the virtual address of the peer which sent the datagram from the path in the family of the domain.
+func (d *dgramStatus) peerAddr(from syscall.Sockaddr, domain int) *sockaddr {
+	if u, ok := from.(*syscall.SockaddrUnix); ok {
+		d.mu.Lock()
+		p := d.paths[u.Name]
+		d.mu.Unlock()
+		if p != nil {
+			if sa, err := newSockAddrFromIPPort(uint16(domain), p.vaddr.IP, p.vaddr.Port, 0, 0); err == nil {
+				return sa
+			}
+		}
+	}
+	return zeroSockaddr(domain)
+}
+
+// connect connects the end to a new peer of the virtual address, which is reached by the connected host socket.
+func (d *dgramStatus) connect(vaddr *sockaddr, hs *hostSocket) (*dgramPeer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := &dgramPeer{vaddr: vaddr, fd: -1, hs: hs}
+	if err := d.openPeerLocked(p); err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(p.fd, &syscall.SockaddrUnix{Name: d.endPath}); err != nil {
+		d.closePeerLocked(p)
+		return nil, fmt.Errorf("failed to connect peer to end: %w", err)
+	}
+	if err := syscall.Connect(d.end, &syscall.SockaddrUnix{Name: p.path}); err != nil {
+		d.closePeerLocked(p)
+		return nil, fmt.Errorf("failed to connect end to peer: %w", err)
+	}
+	d.connected = p
+	return p, nil
+}
+
+// disconnect closes the connected peer and its host socket.
+func (d *dgramStatus) disconnect(ctx context.Context) {
+	logger := log.FromContext(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.connected
+	if p == nil {
+		return
+	}
+	d.connected = nil
+	p.hs.Cancel()
+	syscall.Shutdown(p.hs.Sockfd, syscall.SHUT_RDWR)
+	syscall.Close(p.hs.Sockfd)
+	d.closePeerLocked(p)
+	if err := connectUnspec(d.end); err != nil {
+		logger.WarnContext(ctx, "failed to disconnect end", "error", err)
+	}
+}
+
+// close closes the end and the peers. The end of the container is kept open until the container closes it.
+func (d *dgramStatus) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for _, p := range d.peers {
+		d.closePeerLocked(p)
+	}
+	if d.connected != nil {
+		d.closePeerLocked(d.connected)
+	}
+	// wake up a recvfrom(2) blocking on the end
+	syscall.Shutdown(d.end, syscall.SHUT_RDWR)
+	syscall.Close(d.end)
+	os.Remove(d.endPath)
+}
+
+func (d *dgramStatus) localVAddr() *sockaddr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.local
+}
+
+// connectUnspec dissolves the association of the socket by connect(2) with AF_UNSPEC.
+func connectUnspec(fd int) error {
+	sa := syscall.RawSockaddr{Family: syscall.AF_UNSPEC}
+	_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// nativeSockaddr returns the address in the family of its IP, so an IPv4-mapped address becomes AF_INET.
+func nativeSockaddr(sa *sockaddr) *sockaddr {
+	native, err := newSockAddrFromIPPort(familyOf(sa.IP), sa.IP, sa.Port, 0, 0)
+	if err != nil {
+		return sa
+	}
+	return native
+}
+
+// handleDgram handles the system calls of a UDP socket.
+// The socket is bypassed at bind(2), connect(2) or the first datagram sent, and then emulated until it is closed.
+func (s *socketStatus) handleDgram(ctx context.Context, syscallName string, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	if s.state == Error {
+		return
+	}
+	switch syscallName {
+	case "bind":
+		s.handleDgramBind(ctx, notifFd, req, resp, handler, pid)
+	case "connect":
+		s.handleDgramConnect(ctx, notifFd, req, resp, handler, pid)
+	case "sendto":
+		s.handleDgramSendto(ctx, notifFd, req, resp, handler, pid)
+	case "sendmsg":
+		s.handleDgramSendmsg(ctx, notifFd, req, resp, handler, pid)
+	case "recvfrom":
+		s.handleDgramRecvfrom(ctx, notifFd, req, resp, handler, pid)
+	case "recvmsg":
+		s.handleDgramRecvmsg(ctx, notifFd, req, resp, handler, pid)
+	case "setsockopt":
+		s.handleDgramSetsockopt(ctx, notifFd, req, resp, handler, pid)
+	case "fcntl":
+		s.handleSysFcntl(ctx, notifFd, req, resp, handler, pid)
+	case "getpeername":
+		s.handleDgramGetpeername(ctx, notifFd, req, resp, handler, pid)
+	case "getsockname":
+		if s.dgram != nil {
+			s.handleSysGetsockname(ctx, notifFd, req, resp, handler, pid)
+		}
+	default:
+		// listen(2) and accept(2) fail on the socket of the container.
+	}
+}
+
+// bypassDgram replaces the socket of the container with the end of the emulation.
+func (s *socketStatus) bypassDgram(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, handler *notifHandler) error {
+	if s.dgram != nil {
+		return nil
+	}
+	d, err := newDgramStatus(handler.dgramDir)
+	if err != nil {
+		return err
+	}
+	// O_NONBLOCK of the end is shared with the container.
+	for _, fcntlVal := range s.fcntlOptions {
+		if err := fcntl(d.end, fcntlVal); err != nil {
+			d.close()
+			return fmt.Errorf("failed to configure socket: %w", err)
+		}
+	}
+
+	addfd := seccompNotifAddFd{
+		id:         req.ID,
+		flags:      SeccompAddFdFlagSetFd,
+		srcfd:      uint32(d.end),
+		newfd:      uint32(req.Data.Args[0]),
+		newfdFlags: 0,
+	}
+	if _, err := addfd.ioctlNotifAddFd(notifFd); err != nil {
+		d.close()
+		return fmt.Errorf("ioctl NotifAddFd failed: %w", err)
+	}
+	s.installAliases(ctx, notifFd, req, d.end)
+
+	s.dgram = d
+	s.state = Bypassed
+	// The socket not bound to a port gets an ephemeral vport as the kernel does.
+	if s.localVAddr.Port == 0 {
+		if err := s.allocateVPort(ctx, handler); err != nil {
+			log.FromContext(ctx).WarnContext(ctx, "failed to allocate vport", "error", err)
+		}
+	}
+	s.setDgramLocal(handler)
+	log.FromContext(ctx).InfoContext(ctx, "bypassed udp socket", "end", d.endPath)
+	return nil
+}
+
+// setDgramLocal updates the virtual address seen by the peers after localVAddr is changed.
+func (s *socketStatus) setDgramLocal(handler *notifHandler) {
+	ip := s.localVAddr.IP
+	if ip.IsUnspecified() && handler.vip != nil {
+		ip = handler.vip
+	}
+	sa, err := newSockAddrFromIPPort(familyOf(ip), ip, s.localVAddr.Port, 0, 0)
+	if err != nil {
+		return
+	}
+	s.dgram.mu.Lock()
+	s.dgram.local = sa
+	s.dgram.mu.Unlock()
+}
+
+func (s *socketStatus) handleDgramBind(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	if s.state != NotBypassed {
+		logger.ErrorContext(ctx, "unexpected state", "state", s.state.String())
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EINVAL)
+		return
+	}
+
+	dstAddr, err := handler.readSockaddrFromProcess(ctx, pid, req.Data.Args[1], req.Data.Args[2])
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read sockaddr from process", "error", err)
+		s.state = Error
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+	s.localVAddr = dstAddr
+	logger = logger.With("dstAddr", dstAddr.String())
+
+	dynamic := dstAddr.Port == 0
+	var dEntries []*destination.Entry
+	if dynamic {
+		if err := s.allocateVPort(ctx, handler); err != nil {
+			logger.ErrorContext(ctx, "failed to allocate vport", "error", err)
+			resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+			resp.Error = int32(syscall.EADDRINUSE)
+			return
+		}
+		dEntries = handler.dynamicEntries(ctx, s.localVAddr.Port)
+	} else {
+		dEntries = handler.de.GetServer(ctx, handler.vip, dstAddr.Port)
+		if dEntries == nil {
+			logger.WarnContext(ctx, "destination not found, but virtual addr is recorded: peers cannot send datagrams first")
+		}
+	}
+	hostSockets := []*hostSocket{}
+	for _, entry := range dEntries {
+		hs, err := s.transportBindUDP(ctx, entry)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to bind", "error", err, "entry", entry)
+			continue
+		}
+		hostSockets = append(hostSockets, hs)
+	}
+	closeHostSockets := func() {
+		for _, hs := range hostSockets {
+			hs.Cancel()
+			syscall.Close(hs.Sockfd)
+		}
+	}
+	if dEntries != nil && len(hostSockets) == 0 {
+		logger.ErrorContext(ctx, "failed to bind on all entries", "entries", dEntries)
+		s.state = Error
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+
+	if err := s.bypassDgram(ctx, notifFd, req, handler); err != nil {
+		logger.ErrorContext(ctx, "failed to bypass udp socket", "error", err)
+		closeHostSockets()
+		s.state = Error
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+	boundEntries := []*destination.Entry{}
+	for _, hs := range hostSockets {
+		s.hostSockets.Store(hs.Sockfd, hs)
+		boundEntries = append(boundEntries, hs.Entry)
+		go s.dgramInbound(ctx, s.dgram, hs, handler.sae)
+		logger.InfoContext(ctx, "binded on host", "hostSocket", hs)
+	}
+	if dynamic {
+		s.registerVPort(ctx, handler, boundEntries)
+	}
+
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = 0
+	resp.Val = 0
+
+	logger.InfoContext(ctx, "binded udp socket", "localVAddr", s.localVAddr)
+}
+
+func (s *socketStatus) handleDgramConnect(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	if req.Data.Args[2] > syscall.SizeofSockaddrAny {
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EINVAL)
+		return
+	}
+	buf, err := handler.readProcMem(ctx, pid, req.Data.Args[1], req.Data.Args[2])
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to read sockaddr from process", "error", err)
+		return
+	}
+	// TODO: support big endian hosts
+	if len(buf) >= 2 && binary.LittleEndian.Uint16(buf) == syscall.AF_UNSPEC {
+		if s.dgram != nil {
+			s.dgram.disconnect(ctx)
+		}
+		s.remoteVAddr = zeroSockaddr(s.sockDomain)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = 0
+		resp.Val = 0
+		logger.InfoContext(ctx, "disconnected udp socket")
+		return
+	}
+	dstAddr, err := newSockaddr(buf)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to read sockaddr from process", "error", err)
+		return
+	}
+	logger = logger.With("dstAddr", dstAddr.String())
+
+	ok := handler.cae.Apply(ctx, dstAddr.IP, dstAddr.Port, s.sockType)
+	if !ok {
+		logger.ErrorContext(ctx, "access control denied")
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+	logger.InfoContext(ctx, "access control allowed")
+
+	if err := s.bypassDgram(ctx, notifFd, req, handler); err != nil {
+		logger.ErrorContext(ctx, "failed to bypass udp socket", "error", err)
+		s.state = Error
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+	s.dgram.disconnect(ctx)
+
+	vaddr := nativeSockaddr(dstAddr)
+	hs, err := s.connectDgramHost(ctx, handler, vaddr)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to connect to all destination", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+	p, err := s.dgram.connect(vaddr, hs)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to connect end", "error", err)
+		hs.Cancel()
+		syscall.Close(hs.Sockfd)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+	s.hostSockets.Store(hs.Sockfd, hs)
+	s.remoteVAddr = dstAddr
+	go s.dgramInbound(ctx, s.dgram, hs, handler.sae)
+	go s.dgramOutbound(ctx, s.dgram, p, hs)
+
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = 0
+	resp.Val = 0
+
+	logger.InfoContext(ctx, "connected udp socket", "hostSocket", hs)
+}
+
+// connectDgramHost connects a host socket to the peer by the address learned from its datagrams,
+// or by the destination entries otherwise.
+func (s *socketStatus) connectDgramHost(ctx context.Context, handler *notifHandler, vaddr *sockaddr) (*hostSocket, error) {
+	logger := log.FromContext(ctx)
+
+	s.dgram.mu.Lock()
+	p := s.dgram.peers[vaddr.String()]
+	var learned *destination.Entry
+	if p != nil && p.hs != nil {
+		learned = &destination.Entry{VIP: vaddr.IP, VPort: vaddr.Port, Transport: p.hs.Entry.Transport, Address: transportAddrOf(p.addr)}
+	}
+	s.dgram.mu.Unlock()
+	if learned != nil {
+		hs, err := s.transportConnectUDP(ctx, learned)
+		if err == nil {
+			return hs, nil
+		}
+		logger.WarnContext(ctx, "failed to connect to learned address", "error", err, "entry", learned)
+	}
+
+	var errs []error
+	for _, entries := range handler.de.GetClientAll(ctx, vaddr.IP, vaddr.Port) {
+		for _, entry := range handler.de.Order(vaddr.IP, vaddr.Port, entries, handler.vip) {
+			hs, err := s.transportConnectUDP(ctx, entry)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return hs, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("destination not found")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (s *socketStatus) handleDgramSendto(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	// send(2) without the address is relayed to the connected peer through the end.
+	if req.Data.Args[4] == 0 {
+		return
+	}
+	dstAddr, err := handler.readSockaddrFromProcess(ctx, pid, req.Data.Args[4], req.Data.Args[5])
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read sockaddr from process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EINVAL)
+		return
+	}
+	if req.Data.Args[2] > dgramBufSize {
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EMSGSIZE)
+		return
+	}
+	payload, err := handler.readProcMem(ctx, pid, req.Data.Args[1], req.Data.Args[2])
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read payload from process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+
+	errno := s.sendDgram(ctx, notifFd, req, handler, dstAddr, payload)
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = int32(errno)
+	if errno == 0 {
+		resp.Val = uint64(len(payload))
+	}
+}
+
+func (s *socketStatus) handleDgramSendmsg(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	msg, iovs, err := handler.readMsghdr(ctx, pid, req.Data.Args[1])
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read msghdr from process", "error", err)
+		return
+	}
+	// sendmsg(2) without the address is relayed to the connected peer through the end.
+	if msg.Name == 0 {
+		return
+	}
+	dstAddr, err := handler.readSockaddrFromProcess(ctx, pid, msg.Name, uint64(msg.Namelen))
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read sockaddr from process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EINVAL)
+		return
+	}
+	var size uint64
+	for _, iov := range iovs {
+		if size += iov.Len; size > dgramBufSize || iov.Len > dgramBufSize {
+			resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+			resp.Error = int32(syscall.EMSGSIZE)
+			return
+		}
+	}
+	payload, err := handler.readIovecs(ctx, pid, iovs)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read payload from process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+
+	// TODO: handle control messages
+	errno := s.sendDgram(ctx, notifFd, req, handler, dstAddr, payload)
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = int32(errno)
+	if errno == 0 {
+		resp.Val = uint64(len(payload))
+	}
+}
+
+// sendDgram sends the payload to the virtual address through a host socket and returns the errno for the container.
+// The client rules are applied to each datagram.
+func (s *socketStatus) sendDgram(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, handler *notifHandler, dstAddr *sockaddr, payload []byte) syscall.Errno {
+	logger := log.FromContext(ctx).With("dstAddr", dstAddr.String())
+
+	if s.sockDomain == syscall.AF_INET && dstAddr.Family != syscall.AF_INET {
+		return syscall.EAFNOSUPPORT
+	}
+	ok := handler.cae.Apply(ctx, dstAddr.IP, dstAddr.Port, s.sockType)
+	if !ok {
+		logger.ErrorContext(ctx, "access control denied")
+		return syscall.EACCES
+	}
+	if err := s.bypassDgram(ctx, notifFd, req, handler); err != nil {
+		logger.ErrorContext(ctx, "failed to bypass udp socket", "error", err)
+		return syscall.EACCES
+	}
+
+	d := s.dgram
+	vaddr := nativeSockaddr(dstAddr)
+	d.mu.Lock()
+	p := d.peerLocked(vaddr)
+	hs, addr := p.hs, p.addr
+	d.mu.Unlock()
+
+	// A peer which has sent datagrams is reached by the host socket and the address they came from.
+	if hs != nil {
+		err := s.sendDgramTo(d, hs, addr, payload)
+		if err == nil {
+			d.mu.Lock()
+			p.sent = true
+			d.mu.Unlock()
+			return 0
+		}
+		logger.WarnContext(ctx, "failed to send to learned address", "error", err, "hostSocket", hs)
+	}
+
+	for _, entries := range handler.de.GetClientAll(ctx, vaddr.IP, vaddr.Port) {
+		for _, entry := range handler.de.Order(vaddr.IP, vaddr.Port, entries, handler.vip) {
+			_, addr, err := udpSockaddr(entry.Address)
+			if err != nil {
+				continue
+			}
+			hs, err := s.dgramHostSocket(ctx, handler, entry.Transport)
+			if err != nil {
+				logger.WarnContext(ctx, "failed to create host socket", "error", err, "entry", entry)
+				continue
+			}
+			if err := s.sendDgramTo(d, hs, addr, payload); err != nil {
+				logger.WarnContext(ctx, "failed to send", "error", err, "entry", entry)
+				continue
+			}
+			d.mu.Lock()
+			p.hs, p.addr, p.sent = hs, addr, true
+			d.mu.Unlock()
+			return 0
+		}
+	}
+	logger.ErrorContext(ctx, "failed to send to all destination")
+	return syscall.EACCES
+}
+
+// dgramHostSocket returns the host socket of the transport to send datagrams from.
+// A host socket bound to an ephemeral port is created if the socket is not bound on the transport.
+func (s *socketStatus) dgramHostSocket(ctx context.Context, handler *notifHandler, transport destination.TransportType) (*hostSocket, error) {
+	var found *hostSocket
+	s.hostSockets.Range(func(key, value any) bool {
+		hs := value.(*hostSocket)
+		if hs.State == HostSocketBinded && hs.Entry.Transport == transport {
+			found = hs
+			return false
+		}
+		return true
+	})
+	if found != nil {
+		return found, nil
+	}
+
+	var addr destination.TransportAddr
+	switch transport {
+	case destination.TransportIPv6:
+		addr = destination.NewTransportAddrIPv6([16]byte{}, 0)
+	case destination.TransportIPv4:
+		addr = destination.NewTransportAddrIPv4([4]byte{}, 0)
+	default:
+		return nil, fmt.Errorf("transport %s is not supported for UDP", transport)
+	}
+	hs, err := s.transportBindUDP(ctx, &destination.Entry{VIP: handler.vip, VPort: s.localVAddr.Port, Transport: transport, Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	s.hostSockets.Store(hs.Sockfd, hs)
+	go s.dgramInbound(ctx, s.dgram, hs, handler.sae)
+	log.FromContext(ctx).InfoContext(ctx, "binded on host", "hostSocket", hs)
+	return hs, nil
+}
+
+func (s *socketStatus) handleDgramRecvfrom(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	// recv(2) without the address reads the end directly.
+	if s.dgram == nil || req.Data.Args[4] == 0 {
+		return
+	}
+
+	buf := make([]byte, min(req.Data.Args[2], dgramBufSize))
+	n, from, errno := s.recvDgram(buf, int(req.Data.Args[3]))
+	if handler.closing.Load() {
+		handler.fallback(resp)
+		return
+	}
+	if errno != 0 {
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(errno)
+		return
+	}
+	if err := handler.writeProcMem(ctx, pid, req.Data.Args[1], buf[:min(n, len(buf))]); err != nil {
+		logger.ErrorContext(ctx, "failed to write payload to process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+	srcAddr := s.dgram.peerAddr(from, s.sockDomain)
+	if err := handler.writeSockaddrWithLenToProcess(ctx, pid, req.Data.Args[4], req.Data.Args[5], srcAddr); err != nil {
+		logger.ErrorContext(ctx, "failed to write sockaddr to process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = 0
+	resp.Val = uint64(n)
+}
+
+func (s *socketStatus) handleDgramRecvmsg(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	if s.dgram == nil {
+		return
+	}
+	msg, iovs, err := handler.readMsghdr(ctx, pid, req.Data.Args[1])
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to read msghdr from process", "error", err)
+		return
+	}
+	// recvmsg(2) without the address reads the end directly.
+	if msg.Name == 0 {
+		return
+	}
+
+	var size uint64
+	for _, iov := range iovs {
+		size += iov.Len
+	}
+	if size > dgramBufSize {
+		size = dgramBufSize
+	}
+	buf := make([]byte, size)
+	flags := int(req.Data.Args[2])
+	n, from, errno := s.recvDgram(buf, flags|syscall.MSG_TRUNC)
+	if handler.closing.Load() {
+		handler.fallback(resp)
+		return
+	}
+	if errno != 0 {
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(errno)
+		return
+	}
+	copied := min(n, len(buf))
+	if err := handler.writeIovecs(ctx, pid, iovs, buf[:copied]); err != nil {
+		logger.ErrorContext(ctx, "failed to write payload to process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+
+	srcAddr := s.dgram.peerAddr(from, s.sockDomain)
+	name, err := sockaddrToByte(srcAddr)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to convert sockaddr to byte", "error", err)
+		return
+	}
+	if err := handler.writeProcMem(ctx, pid, msg.Name, name[:min(int(msg.Namelen), len(name))]); err != nil {
+		logger.ErrorContext(ctx, "failed to write sockaddr to process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+	var msgFlags int32
+	if n > copied {
+		msgFlags |= syscall.MSG_TRUNC
+	}
+	// TODO: handle control messages
+	if err := handler.writeMsghdrResult(ctx, pid, req.Data.Args[1], uint32(len(name)), 0, msgFlags); err != nil {
+		logger.ErrorContext(ctx, "failed to write msghdr to process", "error", err)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EFAULT)
+		return
+	}
+
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = 0
+	if flags&syscall.MSG_TRUNC != 0 {
+		resp.Val = uint64(n)
+	} else {
+		resp.Val = uint64(copied)
+	}
+}
+
+// recvDgram receives a datagram from the end on behalf of the container.
+// It blocks as the container does unless the end is non-blocking or MSG_DONTWAIT is given.
+func (s *socketStatus) recvDgram(buf []byte, flags int) (int, syscall.Sockaddr, syscall.Errno) {
+	// Release the lock while blocking so that the socket can be closed or inspected meanwhile.
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	for {
+		n, from, err := syscall.Recvfrom(s.dgram.end, buf, flags)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			var errno syscall.Errno
+			if errors.As(err, &errno) {
+				return 0, nil, errno
+			}
+			return 0, nil, syscall.EIO
+		}
+		return n, from, 0
+	}
+}
+
+func (s *socketStatus) handleDgramSetsockopt(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	logger := log.FromContext(ctx)
+
+	recorded := len(s.socketOptions)
+	s.handleSysSetsockopt(ctx, notifFd, req, resp, handler, pid)
+	if s.dgram == nil || len(s.socketOptions) == recorded {
+		return
+	}
+
+	opt := s.socketOptions[len(s.socketOptions)-1]
+	s.hostSockets.Range(func(key, value any) bool {
+		hs := value.(*hostSocket)
+		if err := setsockopt(hs.Sockfd, opt); err != nil {
+			logger.WarnContext(ctx, "failed to configure host socket", "error", err, "hostSocket", hs)
+		}
+		return true
+	})
+	// The end is a UNIX socket, which does not know the options of IP and UDP.
+	if opt.level != syscall.SOL_SOCKET {
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = 0
+		resp.Val = 0
+	}
+}
+
+func (s *socketStatus) handleDgramGetpeername(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
+	if s.dgram == nil {
+		return
+	}
+	s.dgram.mu.Lock()
+	connected := s.dgram.connected != nil
+	s.dgram.mu.Unlock()
+	if !connected {
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.ENOTCONN)
+		return
+	}
+	s.handleSysGetpeername(ctx, notifFd, req, resp, handler, pid)
+}
@@ -0,0 +1,87 @@
+package seccomp
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func testVAddr(t *testing.T, i int) *sockaddr {
+	t.Helper()
+	sa, err := newSockAddrFromIPPort(syscall.AF_INET, net.IPv4(10, 0, byte(i>>8), byte(i)), 53, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa
+}
+
+// TestPeerLockedEviction fills the peers of a UDP socket and checks that the least recently used peer
+// is removed and its UNIX socket is closed.
+func TestPeerLockedEviction(t *testing.T) {
+	d := &dgramStatus{
+		dir:   t.TempDir(),
+		peers: map[string]*dgramPeer{},
+		paths: map[string]*dgramPeer{},
+	}
+	t.Cleanup(func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, p := range d.peers {
+			d.closePeerLocked(p)
+		}
+	})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	first := d.peerLocked(testVAddr(t, 0))
+	second := d.peerLocked(testVAddr(t, 1))
+	if err := d.openPeerLocked(second); err != nil {
+		t.Fatal(err)
+	}
+	secondPath := second.path
+	for i := 2; i < maxDgramPeers; i++ {
+		d.peerLocked(testVAddr(t, i))
+	}
+	if len(d.peers) != maxDgramPeers {
+		t.Fatalf("len(peers) = %d, want %d", len(d.peers), maxDgramPeers)
+	}
+
+	// Looking up a peer returns the same peer and makes it the most recently used.
+	if p := d.peerLocked(testVAddr(t, 0)); p != first {
+		t.Fatal("peerLocked returned another peer of the same address")
+	}
+
+	// Adding a peer removes the least recently used one, which is second.
+	added := d.peerLocked(testVAddr(t, maxDgramPeers))
+	if len(d.peers) != maxDgramPeers {
+		t.Errorf("len(peers) = %d, want %d", len(d.peers), maxDgramPeers)
+	}
+	if _, ok := d.peers[testVAddr(t, 1).String()]; ok {
+		t.Error("least recently used peer is kept")
+	}
+	if d.peers[testVAddr(t, 0).String()] != first {
+		t.Error("recently used peer is removed")
+	}
+	if d.peers[testVAddr(t, maxDgramPeers).String()] != added {
+		t.Error("new peer is not added")
+	}
+	if second.fd != -1 {
+		t.Errorf("fd of the removed peer = %d, want -1", second.fd)
+	}
+	if _, ok := d.paths[secondPath]; ok {
+		t.Error("path of the removed peer is kept")
+	}
+	if _, err := os.Stat(secondPath); !os.IsNotExist(err) {
+		t.Errorf("UNIX socket of the removed peer is not removed: %v", err)
+	}
+
+	// The next one is the oldest remaining peer, i.e. the third added.
+	d.peerLocked(testVAddr(t, maxDgramPeers+1))
+	if _, ok := d.peers[testVAddr(t, 2).String()]; ok {
+		t.Error("least recently used peer is kept")
+	}
+	if d.peers[testVAddr(t, 0).String()] != first {
+		t.Error("recently used peer is removed")
+	}
+}
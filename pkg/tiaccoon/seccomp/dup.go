@@ -0,0 +1,231 @@
+package seccomp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+// isDup reports whether the request duplicates the fd.
+func isDup(syscallName string, req *libseccomp.ScmpNotifReq) bool {
+	switch syscallName {
+	case "dup", "dup2", "dup3":
+		return true
+	case "fcntl":
+		return req.Data.Args[1] == unix.F_DUPFD || req.Data.Args[1] == unix.F_DUPFD_CLOEXEC
+	default:
+		return false
+	}
+}
+
+// handleDup emulates dup(2), dup2(2), dup3(2) and fcntl(2) with F_DUPFD or F_DUPFD_CLOEXEC by installing the file at the new fd,
+// so that the new fd is an alias of the socket. The fds of NotBypassable sockets are duplicated natively.
+// F_DUPFD with a minimum above 0 is also duplicated natively, and the new fd is registered as an alias when it is used; see nativeDupOf.
+// sock.mu must not be held because the socket replaced at the new fd is removed.
+func (h *notifHandler) handleDup(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, pid int, sock *socketStatus, syscallName string) {
+	logger := log.FromContext(ctx)
+
+	oldfd := int(req.Data.Args[0])
+	newfd := -1 // the lowest free fd
+	newfdFlags := 0
+	switch syscallName {
+	case "dup2", "dup3":
+		newfd = int(req.Data.Args[1])
+		if newfd == oldfd {
+			// dup2(2) returns the fd and dup3(2) fails with EINVAL natively.
+			return
+		}
+		if syscallName == "dup3" {
+			flags := int(req.Data.Args[2])
+			if flags&^syscall.O_CLOEXEC != 0 {
+				resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+				resp.Error = int32(syscall.EINVAL)
+				resp.Val = 0
+				return
+			}
+			newfdFlags = flags
+		}
+	case "fcntl":
+		if req.Data.Args[1] == unix.F_DUPFD_CLOEXEC {
+			newfdFlags = syscall.O_CLOEXEC
+		}
+		minfd := int(int32(req.Data.Args[2]))
+		if minfd < 0 {
+			return // EINVAL
+		}
+		if minfd > 0 {
+			// NotifAddFd installs the file at the lowest free fd or replaces the given fd, so the lowest free fd
+			// not below the minimum cannot be chosen without racing with the other threads opening it.
+			sock.mu.Lock()
+			tracked := sock.state != NotBypassable && len(sock.fds) > 0
+			sock.mu.Unlock()
+			if tracked && !h.closing.Load() {
+				h.addNativeDup(pid, sock)
+			}
+			return
+		}
+		// The lowest free fd is not below the minimum 0, as NotifAddFd allocates without SeccompAddFdFlagSetFd.
+	}
+
+	sock.mu.Lock()
+	tracked := sock.state != NotBypassable
+	sock.mu.Unlock()
+	if !tracked || h.closing.Load() {
+		if newfd >= 0 {
+			// The file at the new fd is closed natively.
+			h.removeSocket(ctx, pid, newfd)
+		}
+		return
+	}
+
+	srcfd, err := h.getFdInProcess(ctx, pid, oldfd)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to get fd", "error", err)
+		return
+	}
+	defer syscall.Close(srcfd)
+
+	addfd := seccompNotifAddFd{
+		id:         req.ID,
+		flags:      0,
+		srcfd:      uint32(srcfd),
+		newfd:      0,
+		newfdFlags: uint32(newfdFlags),
+	}
+	if newfd >= 0 {
+		addfd.flags = SeccompAddFdFlagSetFd
+		addfd.newfd = uint32(newfd)
+	}
+	installed, err := addfd.ioctlNotifAddFd(notifFd)
+	if err != nil {
+		// The kernel returns the same error, such as EMFILE or EBADF.
+		logger.WarnContext(ctx, "ioctl NotifAddFd failed, duplicating natively", "error", err)
+		if newfd >= 0 {
+			h.removeSocket(ctx, pid, newfd)
+		}
+		return
+	}
+
+	// The socket replaced at the new fd is closed.
+	if replaced := h.getSocket(ctx, pid, installed); replaced != nil && replaced != sock {
+		h.removeSocket(ctx, pid, installed)
+	}
+	if !h.addAlias(pid, installed, sock) {
+		logger.WarnContext(ctx, "socket is removed while duplicating fd", "newfd", installed)
+	}
+
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = 0
+	resp.Val = uint64(installed)
+
+	logger.InfoContext(ctx, "duplicated socket fd", "newfd", installed)
+}
+
+// addAlias registers the fd of the process as an alias of the socket.
+// It returns false if the socket has been removed by closing all of its fds.
+func (h *notifHandler) addAlias(pid, fd int, sock *socketStatus) bool {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	if len(sock.fds) == 0 {
+		return false
+	}
+	sock.fds[fd] = struct{}{}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	proc, ok := h.processes[pid]
+	if !ok {
+		proc = newProcessStatus()
+		h.processes[pid] = proc
+	}
+	proc.sockets[fd] = sock
+	return true
+}
+
+// addNativeDup records that an fd of the socket has been duplicated natively by F_DUPFD.
+func (h *notifHandler) addNativeDup(pid int, sock *socketStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	proc, ok := h.processes[pid]
+	if !ok {
+		proc = newProcessStatus()
+		h.processes[pid] = proc
+	}
+	proc.nativeDups[sock] = struct{}{}
+}
+
+// nativeDupOf returns the socket whose fd has been duplicated natively to the fd and registers the fd as its alias,
+// or nil if the fd is not such a duplicate. The file of the fd is compared with the file of the socket in the process.
+func (h *notifHandler) nativeDupOf(ctx context.Context, pid, fd int) *socketStatus {
+	logger := log.FromContext(ctx)
+	h.mu.Lock()
+	var candidates []*socketStatus
+	if proc, ok := h.processes[pid]; ok {
+		for sock := range proc.nativeDups {
+			candidates = append(candidates, sock)
+		}
+	}
+	h.mu.Unlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	file, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil {
+		logger.DebugContext(ctx, "failed to read fd link", "error", err)
+		return nil
+	}
+	for _, sock := range candidates {
+		sock.mu.Lock()
+		removed := len(sock.fds) == 0
+		sockfd := sock.sockfd
+		sock.mu.Unlock()
+		if removed {
+			h.mu.Lock()
+			if proc, ok := h.processes[pid]; ok {
+				delete(proc.nativeDups, sock)
+			}
+			h.mu.Unlock()
+			continue
+		}
+		if other, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, sockfd)); err != nil || other != file {
+			continue
+		}
+		if h.addAlias(pid, fd, sock) {
+			logger.InfoContext(ctx, "registered fd duplicated natively", "sockfd", sockfd)
+			return sock
+		}
+	}
+	return nil
+}
+
+// installAliases installs srcfd at the fds of the socket other than the fd of the request,
+// which keep the replaced file of the container otherwise. FD_CLOEXEC of each fd is kept. s.mu must be held.
+func (s *socketStatus) installAliases(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, srcfd int) {
+	logger := log.FromContext(ctx)
+	for fd := range s.fds {
+		if fd == int(req.Data.Args[0]) {
+			continue
+		}
+		flags, err := fileFlags(s.pid, fd)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to get file flags of alias", "error", err, "alias", fd)
+			continue
+		}
+		addfd := seccompNotifAddFd{
+			id:         req.ID,
+			flags:      SeccompAddFdFlagSetFd,
+			srcfd:      uint32(srcfd),
+			newfd:      uint32(fd),
+			newfdFlags: uint32(flags & syscall.O_CLOEXEC),
+		}
+		if _, err := addfd.ioctlNotifAddFd(notifFd); err != nil {
+			logger.WarnContext(ctx, "ioctl NotifAddFd failed for alias", "error", err, "alias", fd)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package seccomp
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+func testSocket(t *testing.T) int {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	return fd
+}
+
+// TestNativeDupOf checks that an fd duplicated natively by F_DUPFD is registered as an alias of its socket.
+func TestNativeDupOf(t *testing.T) {
+	ctx := context.Background()
+	pid := os.Getpid()
+	h := &notifHandler{processes: map[int]*processStatus{}}
+	fd := testSocket(t)
+	other := testSocket(t)
+	sock := newSocketStatus(pid, fd, syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if !h.addAlias(pid, fd, sock) {
+		t.Fatal("failed to register socket")
+	}
+
+	dupfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(dupfd) })
+
+	// No fd is compared before a native duplicate is recorded.
+	if got := h.nativeDupOf(ctx, pid, dupfd); got != nil {
+		t.Fatal("fd is registered without a native duplicate")
+	}
+	h.addNativeDup(pid, sock)
+	if got := h.nativeDupOf(ctx, pid, other); got != nil {
+		t.Error("another socket is registered as an alias")
+	}
+	if got := h.nativeDupOf(ctx, pid, dupfd); got != sock {
+		t.Fatalf("nativeDupOf = %p, want %p", got, sock)
+	}
+	if _, ok := sock.fds[dupfd]; !ok {
+		t.Error("fd is not added to the fds of the socket")
+	}
+	if h.getSocket(ctx, pid, dupfd) != sock {
+		t.Error("fd is not registered in the process")
+	}
+
+	// A removed socket is forgotten.
+	h.removeSocket(ctx, pid, fd)
+	h.removeSocket(ctx, pid, dupfd)
+	if got := h.nativeDupOf(ctx, pid, dupfd); got != nil {
+		t.Error("removed socket is returned")
+	}
+	if len(h.processes[pid].nativeDups) != 0 {
+		t.Errorf("nativeDups = %v, want empty", h.processes[pid].nativeDups)
+	}
+}
+
+// TestHandleDup3InvalidFlags checks that dup3(2) with flags other than O_CLOEXEC fails with EINVAL.
+func TestHandleDup3InvalidFlags(t *testing.T) {
+	pid := os.Getpid()
+	h := &notifHandler{processes: map[int]*processStatus{}}
+	fd := testSocket(t)
+	sock := newSocketStatus(pid, fd, syscall.AF_INET, syscall.SOCK_STREAM, 0)
+
+	req := &libseccomp.ScmpNotifReq{}
+	req.Data.Args = []uint64{uint64(fd), 100, syscall.O_NONBLOCK}
+	resp := &libseccomp.ScmpNotifResp{Flags: SeccompUserNotifFlagContinue}
+	h.handleDup(context.Background(), -1, req, resp, pid, sock, "dup3")
+	if resp.Flags&SeccompUserNotifFlagContinue != 0 || resp.Error != int32(syscall.EINVAL) {
+		t.Errorf("resp = %+v, want EINVAL", resp)
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/registry"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/vip"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 )
@@ -20,34 +24,82 @@ type Handler struct {
 	sae *accesscontrol.Entries
 	cae *accesscontrol.Entries
 	de  *destination.Entries
+	dm  *destination.Manager
 
+	// mu guards l and closed so that no notifHandler is started after Close.
+	mu     sync.Mutex
 	l      net.Listener
 	closed bool
 
+	// key is seccomp notify fd
+	notifHandlers sync.Map
+	// wg waits for the notifHandlers to drain.
+	wg sync.WaitGroup
+
+	// registry resolves the VIP of each container. defaultVIP is used if it is not found.
+	registry    *registry.Registry
+	defaultVIP  net.IP
 	socketPath  string
-	myVIP       net.IP
 	featureRDMA bool
+
+	// vipAnnotation accepts AnnotationVIP of the containers not registered.
+	vipAnnotation bool
+
+	// vports allocates the ephemeral vports of all containers, since containers of a pod share the VIP.
+	vports *vip.Ports
+
+	// dgramDir has the UNIX sockets of the UDP emulation.
+	dgramDir string
+
+	// connectTimeout bounds connect(2) on the host for the entries without their own timeout. 0 is no timeout.
+	connectTimeout time.Duration
+
+	shutdownConfig ShutdownConfig
 }
 
-func NewHandler(sae, cae *accesscontrol.Entries, de *destination.Entries, socketPath string, myVIP net.IP, featureRDMA bool) *Handler {
+// NewHandler returns a handler serving the containers on the node.
+// defaultVIP may be nil if all containers are registered or annotated with their VIPs.
+// AnnotationVIP is ignored unless vipAnnotation is set.
+// Destination entries of the vports allocated by bind(2) are added to dm.
+func NewHandler(sae, cae *accesscontrol.Entries, dm *destination.Manager, reg *registry.Registry, socketPath string, defaultVIP net.IP, vipAnnotation bool, featureRDMA bool, connectTimeout time.Duration, shutdownConfig ShutdownConfig) *Handler {
 	return &Handler{
-		sae:         sae,
-		cae:         cae,
-		de:          de,
-		closed:      false,
-		socketPath:  socketPath,
-		myVIP:       myVIP,
-		featureRDMA: featureRDMA,
+		sae:            sae,
+		cae:            cae,
+		de:             dm.Entries,
+		dm:             dm,
+		vports:         vip.NewPorts(),
+		closed:         false,
+		registry:       reg,
+		defaultVIP:     defaultVIP,
+		vipAnnotation:  vipAnnotation,
+		socketPath:     socketPath,
+		featureRDMA:    featureRDMA,
+		connectTimeout: connectTimeout,
+		shutdownConfig: shutdownConfig,
 	}
 }
 
+// Close stops receiving new seccomp notify fds and waits for the containers being handled to drain.
 func (h *Handler) Close(ctx context.Context) {
 	logger := log.FromContext(ctx).With("component", "seccomp handler")
 	logger.DebugContext(ctx, "Closing seccomp handler")
+	h.mu.Lock()
 	h.closed = true
 	if h.l != nil {
 		h.l.Close()
 	}
+	h.mu.Unlock()
+
+	h.notifHandlers.Range(func(key, value any) bool {
+		value.(*notifHandler).shutdown()
+		return true
+	})
+	h.wg.Wait()
+	logger.DebugContext(ctx, "All seccomp notifications are drained")
+
+	if h.dgramDir != "" {
+		os.RemoveAll(h.dgramDir)
+	}
 }
 
 func (h *Handler) Start(ctx context.Context) {
@@ -62,6 +114,13 @@ func (h *Handler) Start(ctx context.Context) {
 		logger.ErrorContext(ctx, "Failed to create directory for seccomp notify socket", "error", err, "dir", dir)
 		return
 	}
+	dgramDir := filepath.Join(dir, fmt.Sprintf("tiaccoon-dgram-%d", os.Getpid()))
+	os.RemoveAll(dgramDir)
+	if err := os.MkdirAll(dgramDir, 0700); err != nil {
+		logger.ErrorContext(ctx, "Failed to create directory for UDP sockets", "error", err, "dir", dgramDir)
+	} else {
+		h.dgramDir = dgramDir
+	}
 
 	// This function is derived from:
 	//   https://github.com/rootless-containers/bypass4netns/blob/b9bca3046e413e80d9e556c22443e87d324de847/pkg/bypass4netns/bypass4netns.go#L762
@@ -70,17 +129,25 @@ func (h *Handler) Start(ctx context.Context) {
 	//   Copyright [yyyy] [name of copyright owner]
 	//
 	// Licensed under the Apache License, Version 2.0.
-	h.l, err = net.Listen("unix", h.socketPath)
+	l, err := net.Listen("unix", h.socketPath)
 	if err != nil {
 		logger.ErrorContext(ctx, "Failed to listen seccomp notify socket", "error", err, "socketPath", h.socketPath)
 		return // TODO: Fatal
 	}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		l.Close()
+		return
+	}
+	h.l = l
+	h.mu.Unlock()
 	logger.DebugContext(ctx, "Listening seccomp notify socket", "socketPath", h.socketPath)
 
 	for {
-		conn, err := h.l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			if h.closed {
+			if h.isClosed() {
 				logger.DebugContext(ctx, "Closing seccomp notify socket")
 				return
 			}
@@ -101,14 +168,45 @@ func (h *Handler) Start(ctx context.Context) {
 			continue
 		}
 
-		logger.InfoContext(ctx, "Received seccomp file descriptor", "fd", newFd)
-		notifHandler := h.newNotifHandler(newFd, state, h.sae, h.cae, h.de, h.myVIP, h.featureRDMA)
+		vip := h.containerVIP(ctx, state)
+		logger.InfoContext(ctx, "Received seccomp file descriptor", "fd", newFd, "containerID", state.State.ID, "vip", vip)
+		if vip == nil {
+			logger.WarnContext(ctx, "vip of the container is not found: bind and the virtual address of the client are not available", "containerID", state.State.ID)
+		}
+		notifHandler, err := h.newNotifHandler(newFd, state, h.sae, h.cae, h.de, vip, h.featureRDMA)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to create seccomp notif handler", "error", err, "fd", newFd)
+			unix.Close(int(newFd))
+			continue
+		}
+
+		h.mu.Lock()
+		if h.closed {
+			h.mu.Unlock()
+			logger.InfoContext(ctx, "Closing seccomp notify fd received while closing", "fd", newFd)
+			unix.Close(notifHandler.wakeFd)
+			unix.Close(int(newFd))
+			return
+		}
+		h.wg.Add(1)
+		h.notifHandlers.Store(newFd, notifHandler)
+		h.mu.Unlock()
 
 		logger.InfoContext(ctx, "Start to handle seccomp notif", "fd", newFd)
-		go notifHandler.handle(ctx)
+		go func() {
+			defer h.wg.Done()
+			defer h.notifHandlers.Delete(newFd)
+			notifHandler.handle(ctx)
+		}()
 	}
 }
 
+func (h *Handler) isClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
 // handleNewMessage is derived from:
 //   https://github.com/rootless-containers/bypass4netns/blob/b9bca3046e413e80d9e556c22443e87d324de847/pkg/bypass4netns/bypass4netns.go#L227
 //
@@ -0,0 +1,140 @@
+package seccomp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// msghdr is struct msghdr of x86_64.
+type msghdr struct {
+	Name       uint64
+	Namelen    uint32
+	_          uint32
+	Iov        uint64
+	Iovlen     uint64
+	Control    uint64
+	Controllen uint64
+	Flags      int32
+	_          int32
+}
+
+const (
+	sizeofMsghdr = 56
+	sizeofIovec  = 16
+
+	offsetofMsghdrNamelen    = 8
+	offsetofMsghdrControllen = 40
+	offsetofMsghdrFlags      = 48
+
+	// maxIovlen is UIO_MAXIOV.
+	maxIovlen = 1024
+)
+
+// iovec is struct iovec of x86_64.
+type iovec struct {
+	Base uint64
+	Len  uint64
+}
+
+func (h *notifHandler) readMsghdr(ctx context.Context, pid int, offset uint64) (*msghdr, []iovec, error) {
+	// TODO: support big endian hosts
+	endian := binary.LittleEndian
+
+	buf, err := h.readProcMem(ctx, pid, offset, sizeofMsghdr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read msghdr: %w", err)
+	}
+	msg := &msghdr{}
+	if err := binary.Read(bytes.NewReader(buf), endian, msg); err != nil {
+		return nil, nil, fmt.Errorf("cannot cast byte array to msghdr: %w", err)
+	}
+	if msg.Iovlen > maxIovlen {
+		return nil, nil, fmt.Errorf("too many iovecs: %d", msg.Iovlen)
+	}
+
+	iovs := make([]iovec, msg.Iovlen)
+	if msg.Iovlen > 0 {
+		buf, err = h.readProcMem(ctx, pid, msg.Iov, msg.Iovlen*sizeofIovec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read iovecs: %w", err)
+		}
+		if err := binary.Read(bytes.NewReader(buf), endian, iovs); err != nil {
+			return nil, nil, fmt.Errorf("cannot cast byte array to iovecs: %w", err)
+		}
+	}
+	return msg, iovs, nil
+}
+
+// readIovecs gathers the data of the iovecs.
+func (h *notifHandler) readIovecs(ctx context.Context, pid int, iovs []iovec) ([]byte, error) {
+	data := []byte{}
+	for _, iov := range iovs {
+		if iov.Len == 0 {
+			continue
+		}
+		buf, err := h.readProcMem(ctx, pid, iov.Base, iov.Len)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read iovec: %w", err)
+		}
+		data = append(data, buf...)
+	}
+	return data, nil
+}
+
+// writeIovecs scatters the data to the iovecs.
+func (h *notifHandler) writeIovecs(ctx context.Context, pid int, iovs []iovec, data []byte) error {
+	for _, iov := range iovs {
+		if len(data) == 0 {
+			break
+		}
+		n := min(uint64(len(data)), iov.Len)
+		if err := h.writeProcMem(ctx, pid, iov.Base, data[:n]); err != nil {
+			return fmt.Errorf("failed to write iovec: %w", err)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// writeMsghdrResult sets msg_namelen, msg_controllen and msg_flags of the msghdr as recvmsg(2) does.
+func (h *notifHandler) writeMsghdrResult(ctx context.Context, pid int, offset uint64, namelen uint32, controllen uint64, flags int32) error {
+	// TODO: support big endian hosts
+	endian := binary.LittleEndian
+
+	if err := h.writeProcMem(ctx, pid, offset+offsetofMsghdrNamelen, endian.AppendUint32(nil, namelen)); err != nil {
+		return fmt.Errorf("failed to write msg_namelen: %w", err)
+	}
+	if err := h.writeProcMem(ctx, pid, offset+offsetofMsghdrControllen, endian.AppendUint64(nil, controllen)); err != nil {
+		return fmt.Errorf("failed to write msg_controllen: %w", err)
+	}
+	if err := h.writeProcMem(ctx, pid, offset+offsetofMsghdrFlags, endian.AppendUint32(nil, uint32(flags))); err != nil {
+		return fmt.Errorf("failed to write msg_flags: %w", err)
+	}
+	return nil
+}
+
+// writeSockaddrWithLenToProcess writes sa truncated to the length at addrlenOffset
+// and sets the length to the size of sa, as recvfrom(2) does.
+func (h *notifHandler) writeSockaddrWithLenToProcess(ctx context.Context, pid int, offset, addrlenOffset uint64, sa *sockaddr) error {
+	// TODO: support big endian hosts
+	endian := binary.LittleEndian
+
+	buf, err := sockaddrToByte(sa)
+	if err != nil {
+		return fmt.Errorf("failed to sockaddrToByte sockaddr %v: %w", sa, err)
+	}
+	lenBuf, err := h.readProcMem(ctx, pid, addrlenOffset, 4)
+	if err != nil {
+		return fmt.Errorf("failed to read addrlen: %w", err)
+	}
+	if len(lenBuf) != 4 {
+		return fmt.Errorf("failed to read addrlen: %v", lenBuf)
+	}
+	addrlen := endian.Uint32(lenBuf)
+	if err := h.writeProcMem(ctx, pid, offset, buf[:min(int(addrlen), len(buf))]); err != nil {
+		return fmt.Errorf("failed to write sockaddr: %w", err)
+	}
+	return h.writeProcMem(ctx, pid, addrlenOffset, endian.AppendUint32(nil, uint32(len(buf))))
+}
@@ -0,0 +1,232 @@
+package seccomp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// testHandler returns a handler accessing the memory of the test process itself.
+func testHandler(t *testing.T) *notifHandler {
+	t.Helper()
+	h := &notifHandler{memfds: map[int]int{}}
+	t.Cleanup(func() {
+		for _, fd := range h.memfds {
+			syscall.Close(fd)
+		}
+	})
+	return h
+}
+
+// guardedPage returns a page followed by an unmapped page, so that reading past its end is truncated.
+func guardedPage(t *testing.T) []byte {
+	t.Helper()
+	size := os.Getpagesize()
+	mem, err := syscall.Mmap(-1, 0, 2*size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatalf("mmap: %v", err)
+	}
+	// munmap(2) of the whole mapping in the cleanup also succeeds with the second page unmapped.
+	t.Cleanup(func() { syscall.Munmap(mem) })
+	if _, _, errno := syscall.Syscall(syscall.SYS_MUNMAP, uintptr(addrOf(mem[size:])), uintptr(size), 0); errno != 0 {
+		t.Fatalf("munmap: %v", errno)
+	}
+	return mem[:size:size]
+}
+
+func addrOf(b []byte) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+func encode(t *testing.T, v any) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadMsghdr(t *testing.T) {
+	ctx := context.Background()
+	pid := os.Getpid()
+	h := testHandler(t)
+	page := guardedPage(t)
+	end := len(page)
+
+	iovs := []iovec{{Base: 0x1000, Len: 10}, {Base: 0x2000, Len: 20}}
+	iovBuf := encode(t, iovs)
+
+	tests := []struct {
+		name string
+		// msgOffset and iovOffset are the offsets in the page of the msghdr and the iovecs.
+		msgOffset int
+		iovOffset int
+		iovlen    uint64
+		wantErr   bool
+	}{
+		{name: "valid", msgOffset: 0, iovOffset: 512, iovlen: 2},
+		{name: "no iovecs", msgOffset: 0, iovOffset: 512, iovlen: 0},
+		{name: "msghdr at the end", msgOffset: end - sizeofMsghdr, iovOffset: 512, iovlen: 2},
+		{name: "truncated msghdr", msgOffset: end - sizeofMsghdr + 8, iovOffset: 512, iovlen: 2, wantErr: true},
+		{name: "truncated iovecs", msgOffset: 0, iovOffset: end - sizeofIovec, iovlen: 2, wantErr: true},
+		{name: "too many iovecs", msgOffset: 0, iovOffset: 512, iovlen: maxIovlen + 1, wantErr: true},
+		{name: "oversized iovlen", msgOffset: 0, iovOffset: 512, iovlen: 1 << 62, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(page)
+			msg := msghdr{Name: 0x3000, Namelen: 16, Iov: addrOf(page) + uint64(tt.iovOffset), Iovlen: tt.iovlen}
+			copy(page[tt.iovOffset:], iovBuf)
+			copy(page[tt.msgOffset:], encode(t, &msg))
+
+			got, gotIovs, err := h.readMsghdr(ctx, pid, addrOf(page)+uint64(tt.msgOffset))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readMsghdr succeeded: %+v %v", got, gotIovs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != msg {
+				t.Errorf("msghdr = %+v, want %+v", got, msg)
+			}
+			if want := iovs[:tt.iovlen]; len(gotIovs) != len(want) || (len(want) > 0 && !bytes.Equal(encode(t, gotIovs), encode(t, want))) {
+				t.Errorf("iovecs = %v, want %v", gotIovs, want)
+			}
+		})
+	}
+}
+
+func TestIovecs(t *testing.T) {
+	ctx := context.Background()
+	pid := os.Getpid()
+	h := testHandler(t)
+	a, b := make([]byte, 3), make([]byte, 4)
+	iovs := []iovec{{Base: addrOf(a), Len: 3}, {Base: 0, Len: 0}, {Base: addrOf(b), Len: 4}}
+
+	// The data longer than the iovecs is truncated like a datagram.
+	if err := h.writeIovecs(ctx, pid, iovs, []byte("abcdefghij")); err != nil {
+		t.Fatal(err)
+	}
+	if string(a) != "abc" || string(b) != "defg" {
+		t.Errorf("iovecs = %q %q, want \"abc\" \"defg\"", a, b)
+	}
+	got, err := h.readIovecs(ctx, pid, iovs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdefg" {
+		t.Errorf("readIovecs = %q, want \"abcdefg\"", got)
+	}
+
+	// The shorter data leaves the rest of the iovecs.
+	if err := h.writeIovecs(ctx, pid, iovs, []byte("xy")); err != nil {
+		t.Fatal(err)
+	}
+	if string(a) != "xyc" || string(b) != "defg" {
+		t.Errorf("iovecs = %q %q, want \"xyc\" \"defg\"", a, b)
+	}
+}
+
+func TestWriteMsghdrResult(t *testing.T) {
+	pid := os.Getpid()
+	h := testHandler(t)
+	buf := make([]byte, sizeofMsghdr)
+	copy(buf, encode(t, &msghdr{Name: 1, Namelen: 128, Iov: 2, Iovlen: 3, Control: 4, Controllen: 64}))
+
+	if err := h.writeMsghdrResult(context.Background(), pid, addrOf(buf), 16, 0, syscall.MSG_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+	var got msghdr
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := msghdr{Name: 1, Namelen: 16, Iov: 2, Iovlen: 3, Control: 4, Controllen: 0, Flags: syscall.MSG_TRUNC}
+	if got != want {
+		t.Errorf("msghdr = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteSockaddrWithLen(t *testing.T) {
+	ctx := context.Background()
+	pid := os.Getpid()
+	h := testHandler(t)
+	sa, err := newSockAddrFromIPPort(syscall.AF_INET, net.ParseIP("10.0.0.1"), 80, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := sockaddrToByte(sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addrlen := range []uint32{0, 4, uint32(len(full)), 128} {
+		buf := bytes.Repeat([]byte{0xff}, 128)
+		lenBuf := binary.LittleEndian.AppendUint32(nil, addrlen)
+		if err := h.writeSockaddrWithLenToProcess(ctx, pid, addrOf(buf), addrOf(lenBuf), sa); err != nil {
+			t.Fatal(err)
+		}
+		// The address is truncated to addrlen, and addrlen is set to the size of the address.
+		n := min(int(addrlen), len(full))
+		if !bytes.Equal(buf[:n], full[:n]) || !bytes.Equal(buf[n:], bytes.Repeat([]byte{0xff}, len(buf)-n)) {
+			t.Errorf("addrlen %d: sockaddr = %x, want %x", addrlen, buf[:len(full)], full[:n])
+		}
+		if got := binary.LittleEndian.Uint32(lenBuf); got != uint32(len(full)) {
+			t.Errorf("addrlen %d: addrlen = %d, want %d", addrlen, got, len(full))
+		}
+	}
+}
+
+// TestReadSockaddrNamelen reads msg_name of sendmsg(2) with the msg_namelen given by the container.
+func TestReadSockaddrNamelen(t *testing.T) {
+	ctx := context.Background()
+	pid := os.Getpid()
+	h := testHandler(t)
+	sa, err := newSockAddrFromIPPort(syscall.AF_INET, net.ParseIP("10.0.0.1"), 80, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := sockaddrToByte(sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, syscall.SizeofSockaddrAny+1)
+	copy(buf, full)
+
+	tests := []struct {
+		name    string
+		namelen uint64
+		wantErr bool
+	}{
+		{name: "exact", namelen: uint64(len(full))},
+		{name: "longer than the address", namelen: syscall.SizeofSockaddrAny},
+		{name: "truncated", namelen: uint64(len(full)) - 8, wantErr: true},
+		{name: "family only", namelen: 2, wantErr: true},
+		{name: "oversized", namelen: syscall.SizeofSockaddrAny + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.readSockaddrFromProcess(ctx, pid, addrOf(buf), tt.namelen)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readSockaddrFromProcess succeeded: %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.IP.Equal(sa.IP) || got.Port != sa.Port {
+				t.Errorf("sockaddr = %v, want %v", got, sa)
+			}
+		})
+	}
+}
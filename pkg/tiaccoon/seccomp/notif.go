@@ -9,11 +9,15 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/vip"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	libseccomp "github.com/seccomp/libseccomp-golang"
 	"golang.org/x/sys/unix"
@@ -36,6 +40,10 @@ type notifHandler struct {
 	fd    libseccomp.ScmpFd
 	state *specs.ContainerProcessState
 
+	// mu guards processes, memfds, pidInfos, users and exited. It is held only while accessing them because the requests are handled concurrently.
+	// socketStatus.mu must not be locked while holding it.
+	mu sync.Mutex
+
 	// key is pid
 	processes map[int]*processStatus
 
@@ -45,29 +53,70 @@ type notifHandler struct {
 	// cache pidfd to reduce latency, key is pid.
 	pidInfos map[int]pidInfo
 
-	sae *accesscontrol.Entries
-	cae *accesscontrol.Entries
+	// users is the number of the requests being handled for each tgid.
+	// The pidfds and memfd of an exited process are kept in exited until its requests finish, since they may be still in use.
+	users  map[int]int
+	exited map[int][]int
+
+	// sae and cae are the rules seen by the container with the VIP.
+	sae *accesscontrol.View
+	cae *accesscontrol.View
 	de  *destination.Entries
+	dm  *destination.Manager
 
-	myVIP       net.IP
+	// vports allocates the ephemeral vports of the VIP.
+	vports *vip.Ports
+
+	// vip is the VIP of the container, or nil if it is unknown.
+	vip         net.IP
 	featureRDMA bool
+
+	// dgramDir has the UNIX sockets of the UDP emulation, or is empty if UDP is not available.
+	dgramDir string
+
+	// connectTimeout is the default timeout of connect(2) on the host.
+	connectTimeout time.Duration
+
+	// shutdownConfig is how the requests are answered while shutting down.
+	shutdownConfig ShutdownConfig
+	// wakeFd is an eventfd to wake up handle for shutdown.
+	wakeFd       int
+	shutdownOnce sync.Once
+	// closing is set when the shutdown begins.
+	closing atomic.Bool
+	// inflight is the number of the requests being handled.
+	inflight atomic.Int64
+	// reqs waits for the goroutines handling the requests, which may use the pidfds, memfds and notification fd.
+	reqs sync.WaitGroup
 }
 
-func (h *Handler) newNotifHandler(fd uintptr, state *specs.ContainerProcessState, sae, cae *accesscontrol.Entries, de *destination.Entries, myVIP net.IP, featureRDMA bool) *notifHandler {
+func (h *Handler) newNotifHandler(fd uintptr, state *specs.ContainerProcessState, sae, cae *accesscontrol.Entries, de *destination.Entries, vip net.IP, featureRDMA bool) (*notifHandler, error) {
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create eventfd: %w", err)
+	}
 	notifHandler := notifHandler{
-		fd:          libseccomp.ScmpFd(fd),
-		state:       state,
-		processes:   map[int]*processStatus{},
-		memfds:      map[int]int{},
-		pidInfos:    map[int]pidInfo{},
-		sae:         sae,
-		cae:         cae,
-		de:          de,
-		myVIP:       myVIP,
-		featureRDMA: featureRDMA,
-	}
-
-	return &notifHandler
+		fd:             libseccomp.ScmpFd(fd),
+		state:          state,
+		processes:      map[int]*processStatus{},
+		memfds:         map[int]int{},
+		pidInfos:       map[int]pidInfo{},
+		users:          map[int]int{},
+		exited:         map[int][]int{},
+		sae:            sae.View(vip),
+		cae:            cae.View(vip),
+		de:             de,
+		vip:            vip,
+		featureRDMA:    featureRDMA,
+		dgramDir:       h.dgramDir,
+		dm:             h.dm,
+		vports:         h.vports,
+		connectTimeout: h.connectTimeout,
+		shutdownConfig: h.shutdownConfig,
+		wakeFd:         wakeFd,
+	}
+
+	return &notifHandler, nil
 }
 
 func (h *notifHandler) handle(ctx context.Context) {
@@ -83,34 +132,86 @@ func (h *notifHandler) handle(ctx context.Context) {
 	//
 	// Licensed under the Apache License, Version 2.0.
 	defer unix.Close(int(h.fd))
+	defer unix.Close(h.wakeFd)
+
+	// The requests are not canceled with ctx so that they finish while draining.
+	// drain cancels them if they are still in flight after the shutdown timeout.
+	reqCtx, cancelReqs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelReqs()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.shutdown()
+		case <-done:
+		}
+	}()
 
-	for { // TODO: handle ctx.Done()
-		req, err := libseccomp.NotifReceive(h.fd)
-		if err != nil {
-			logger.ErrorContext(ctx, "Error in NotifReceive()", "error", err)
+	fds := []unix.PollFd{
+		{Fd: int32(h.fd), Events: unix.POLLIN},
+		{Fd: int32(h.wakeFd), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
 			continue
 		}
-
-		resp := &libseccomp.ScmpNotifResp{
-			ID:    req.ID,
-			Error: 0,
-			Val:   0,
-			Flags: libseccomp.NotifRespFlagContinue,
+		if err != nil {
+			logger.ErrorContext(ctx, "Error in poll", "error", err)
+			break
 		}
-
-		// TOCTOU check
-		if err := libseccomp.NotifIDValid(h.fd, req.ID); err != nil {
-			logger.ErrorContext(ctx, "TOCTOU check failed: req.ID is no longer valid", "error", err)
+		if fds[1].Revents != 0 {
+			logger.InfoContext(ctx, "Shutting down seccomp notification")
+			break
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			h.receive(reqCtx)
 			continue
 		}
+		if fds[0].Revents&unix.POLLHUP != 0 {
+			logger.InfoContext(ctx, "All processes of the container exited")
+			break
+		}
+	}
+	h.drain(reqCtx, cancelReqs)
+}
 
-		h.handleReq(ctx, h.fd, req, resp)
+// receive receives a request and handles it in its own goroutine so that a blocking accept(2), connect(2) or recvfrom(2)
+// does not hold the other system calls of the container. The requests on a socket are serialized by socketStatus.mu.
+func (h *notifHandler) receive(ctx context.Context) {
+	logger := log.FromContext(ctx)
+
+	req, err := libseccomp.NotifReceive(h.fd)
+	if err != nil {
+		logger.ErrorContext(ctx, "Error in NotifReceive()", "error", err)
+		return
+	}
+
+	resp := &libseccomp.ScmpNotifResp{
+		ID:    req.ID,
+		Error: 0,
+		Val:   0,
+		Flags: libseccomp.NotifRespFlagContinue,
+	}
 
+	// TOCTOU check
+	if err := libseccomp.NotifIDValid(h.fd, req.ID); err != nil {
+		logger.ErrorContext(ctx, "TOCTOU check failed: req.ID is no longer valid", "error", err)
+		return
+	}
+
+	h.inflight.Add(1)
+	h.reqs.Add(1)
+	go func() {
+		defer h.reqs.Done()
+		defer h.inflight.Add(-1)
+		h.handleReq(ctx, h.fd, req, resp)
 		if err := libseccomp.NotifRespond(h.fd, resp); err != nil {
 			logger.ErrorContext(ctx, "Error in NotifRespond", "error", err)
-			continue
 		}
-	}
+	}()
 }
 
 func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp) {
@@ -144,6 +245,11 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 	pid := pidInfo.tgid
 	logger = logger.With("pid", pid)
 	ctx = log.ContextWithLogger(ctx, logger)
+	if !h.hold(int(req.Pid), pid) {
+		logger.DebugContext(ctx, "process has exited")
+		return
+	}
+	defer h.release(pid)
 
 	if pidInfo.pidType == THREAD {
 		logger.DebugContext(ctx, fmt.Sprintf("pid %d is thread. use process's tgid %d as pid", req.Pid, pid))
@@ -151,30 +257,34 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 
 	// cleanup sockets when the process exits
 	if syscallName == "_exit" || syscallName == "exit_group" {
+		h.mu.Lock()
 		if pidInfo, ok := h.pidInfos[int(req.Pid)]; ok {
-			err = syscall.Close(int(pidInfo.pidfd))
-			if err != nil {
-				logger.ErrorContext(ctx, "failed to close pidfd", "error", err, "pidInfo", pidInfo)
-			}
+			h.exited[pid] = append(h.exited[pid], pidInfo.pidfd)
 			delete(h.pidInfos, int(req.Pid))
 		}
 		if pidInfo.pidType == THREAD {
+			h.mu.Unlock()
 			logger.InfoContext(ctx, "thread is removed", "tgid", pid)
+			return
 		}
 
-		if pidInfo.pidType == PROCESS {
-			if proc, ok := h.processes[pid]; ok {
-				for _, sock := range proc.sockets {
-					sock.removeSocket(ctx)
-				}
-				delete(h.processes, pid)
-			}
-			if memfd, ok := h.memfds[pid]; ok {
-				syscall.Close(memfd)
-				delete(h.memfds, pid)
-			}
-			logger.InfoContext(ctx, "process is removed")
+		var sockets []*socketStatus
+		if proc, ok := h.processes[pid]; ok {
+			sockets = proc.uniqueSockets()
+			delete(h.processes, pid)
 		}
+		if memfd, ok := h.memfds[pid]; ok {
+			h.exited[pid] = append(h.exited[pid], memfd)
+			delete(h.memfds, pid)
+		}
+		h.mu.Unlock()
+
+		for _, sock := range sockets {
+			sock.mu.Lock()
+			sock.removeSocket(ctx)
+			sock.mu.Unlock()
+		}
+		logger.InfoContext(ctx, "process is removed")
 		return
 	}
 
@@ -182,7 +292,7 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 	logger = logger.With("sockfd", sockfd)
 	ctx = log.ContextWithLogger(ctx, logger)
 
-	// remove socket when closed
+	// remove socket when closed. The socket is kept until all of its fds are closed.
 	if syscallName == "close" { // TODO: handle shutdown(2)
 		h.removeSocket(ctx, pid, sockfd)
 		return
@@ -196,8 +306,25 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 			return
 		}
 	}
+	if isDup(syscallName, req) {
+		h.handleDup(ctx, notifFd, req, resp, pid, sock, syscallName)
+		return
+	}
+
+	sock.mu.Lock()
+	defer func() { sock.mu.Unlock() }()
 	logger = logger.With("state", sock.state.String())
 
+	// No socket is bypassed while shutting down. The other system calls continue natively.
+	if h.closing.Load() && sock.state != NotBypassable {
+		switch syscallName {
+		case "bind", "listen", "accept", "accept4", "connect", "sendto", "sendmsg":
+			logger.InfoContext(ctx, "not bypassed while shutting down")
+			h.fallback(resp)
+		}
+		return
+	}
+
 	if h.featureRDMA && syscallName == "connect" {
 		ok := h.initializeRsocket(ctx, notifFd, req, resp, pid, sock)
 		if ok {
@@ -211,12 +338,16 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 		// To handle such condition, re-register fd when connect or bind is called for not bypassable fd.
 		if syscallName == "connect" || syscallName == "bind" {
 			logger.DebugContext(ctx, "re-registering socket")
+			sock.mu.Unlock()
 			h.removeSocket(ctx, pid, sockfd)
-			sock, err = h.registerSocket(ctx, pid, sockfd)
+			reregistered, err := h.registerSocket(ctx, pid, sockfd)
 			if err != nil {
 				logger.ErrorContext(ctx, "failed to re-register socket", "error", err)
+				sock.mu.Lock() // unlocked by the deferred function
 				return
 			}
+			sock = reregistered
+			sock.mu.Lock()
 		}
 		if sock.state != NotBypassed {
 			return
@@ -224,7 +355,8 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 
 		// when sock.state == NotBypassed, continue
 	case Bypassed:
-		if syscallName != "getpeername" && syscallName != "getsockname" {
+		// UDP socket is emulated until closed.
+		if sock.dgram == nil && syscallName != "getpeername" && syscallName != "getsockname" {
 			return
 		}
 	default:
@@ -233,6 +365,10 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 	// TODO: resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
 
 	logger.DebugContext(ctx, "Handling syscall")
+	if sock.sockType == syscall.SOCK_DGRAM {
+		sock.handleDgram(ctx, syscallName, notifFd, req, resp, h, pid)
+		return
+	}
 	switch syscallName {
 	case "bind":
 		sock.handleSysBind(ctx, notifFd, req, resp, h, pid)
@@ -247,11 +383,13 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 	case "setsockopt":
 		sock.handleSysSetsockopt(ctx, notifFd, req, resp, h, pid)
 	case "fcntl":
-		sock.handleSysFcntl(ctx, notifFd, req, resp)
+		sock.handleSysFcntl(ctx, notifFd, req, resp, h, pid)
 	case "getpeername":
 		sock.handleSysGetpeername(ctx, notifFd, req, resp, h, pid)
 	case "getsockname":
 		sock.handleSysGetsockname(ctx, notifFd, req, resp, h, pid)
+	case "sendto", "sendmsg", "recvfrom", "recvmsg":
+		// TCP socket is not handled.
 	default:
 		logger.ErrorContext(ctx, "Unknown syscall")
 		// TODO: error handle
@@ -261,6 +399,9 @@ func (h *notifHandler) handleReq(ctx context.Context, notifFd libseccomp.ScmpFd,
 
 // getFdInProcess get the file descriptor in other process
 func (h *notifHandler) getFdInProcess(ctx context.Context, pid, targetFd int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	targetPidfd, err := h.getPidFdInfo(ctx, pid)
 	if err != nil {
 		return 0, fmt.Errorf("pidfd Open failed: %s", err)
@@ -274,6 +415,26 @@ func (h *notifHandler) getFdInProcess(ctx context.Context, pid, targetFd int) (i
 	return fd, nil
 }
 
+// fileFlags returns the flags of the fd in other process, which are the file status flags such as O_NONBLOCK and O_CLOEXEC.
+func fileFlags(pid, targetFd int) (int, error) {
+	fdinfo, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%d", pid, targetFd))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read fdinfo: %w", err)
+	}
+	for _, line := range strings.Split(string(fdinfo), "\n") {
+		value, ok := strings.CutPrefix(line, "flags:")
+		if !ok {
+			continue
+		}
+		flags, err := strconv.ParseInt(strings.TrimSpace(value), 8, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected flags in fdinfo %q: %w", line, err)
+		}
+		return int(flags), nil
+	}
+	return 0, fmt.Errorf("flags not found in fdinfo")
+}
+
 // getSocketArgs retrieves socket(2) arguments from fd.
 // return values are (sock_domain, sock_type, sock_protocol, error)
 func getSocketArgs(ctx context.Context, sockfd int) (int, int, int, error) {
@@ -306,25 +467,24 @@ func getSocketArgs(ctx context.Context, sockfd int) (int, int, int, error) {
 // Licensed under the Apache License, Version 2.0.
 func (h *notifHandler) registerSocket(ctx context.Context, pid int, sockfd int) (*socketStatus, error) {
 	logger := log.FromContext(ctx).With("func", "registerSocket")
-	proc, ok := h.processes[pid]
-	if !ok {
-		proc = newProcessStatus()
-		h.processes[pid] = proc
-		logger.DebugContext(ctx, "process is registered")
-	}
-
-	sock, ok := proc.sockets[sockfd]
-	if ok {
+	sock := h.getSocket(ctx, pid, sockfd)
+	if sock != nil {
 		logger.WarnContext(ctx, "socket is already registered")
 		return sock, nil
 	}
 
 	// If the pid is thread, its process can have corresponding socket
+	h.mu.Lock()
 	procInfo, ok := h.pidInfos[int(pid)]
+	h.mu.Unlock()
 	if ok && procInfo.pidType == THREAD {
 		return nil, fmt.Errorf("unexpected procInfo")
 	}
 
+	if sock := h.nativeDupOf(ctx, pid, sockfd); sock != nil {
+		return sock, nil
+	}
+
 	sockFdHost, err := h.getFdInProcess(ctx, int(pid), sockfd)
 	if err != nil {
 		return nil, err
@@ -342,9 +502,8 @@ func (h *notifHandler) registerSocket(ctx context.Context, pid int, sockfd int)
 			// non IP sockets are not handled.
 			sock.state = NotBypassable
 			logger.DebugContext(ctx, fmt.Sprintf("socket domain=0x%x", sockDomain))
-		} else if sockType != syscall.SOCK_STREAM {
-			// only accepting TCP socket
-			// TODO: datagram
+		} else if sockType != syscall.SOCK_STREAM && (sockType != syscall.SOCK_DGRAM || sockProtocol != syscall.IPPROTO_UDP) {
+			// only accepting TCP and UDP socket
 			sock.state = NotBypassable
 			logger.DebugContext(ctx, fmt.Sprintf("socket type=0x%x", sockType))
 		} else {
@@ -357,7 +516,21 @@ func (h *notifHandler) registerSocket(ctx context.Context, pid int, sockfd int)
 		}
 	}
 
+	h.mu.Lock()
+	proc, ok := h.processes[pid]
+	if !ok {
+		proc = newProcessStatus()
+		h.processes[pid] = proc
+		logger.DebugContext(ctx, "process is registered")
+	}
+	if registered, ok := proc.sockets[sockfd]; ok {
+		// registered by another request while inspecting the socket
+		h.mu.Unlock()
+		sock.Cancel()
+		return registered, nil
+	}
 	proc.sockets[sockfd] = sock
+	h.mu.Unlock()
 	if sock.state == NotBypassable {
 		logger.DebugContext(ctx, "socket is registered", "state", sock.state.String())
 	} else {
@@ -368,6 +541,8 @@ func (h *notifHandler) registerSocket(ctx context.Context, pid int, sockfd int)
 }
 
 func (h *notifHandler) getSocket(_ context.Context, pid int, sockfd int) *socketStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	proc, ok := h.processes[pid]
 	if !ok {
 		return nil
@@ -379,15 +554,28 @@ func (h *notifHandler) getSocket(_ context.Context, pid int, sockfd int) *socket
 func (h *notifHandler) removeSocket(ctx context.Context, pid int, sockfd int) {
 	logger := log.FromContext(ctx).With("func", "removeSocket")
 	defer logger.DebugContext(ctx, "socket is removed")
+	h.mu.Lock()
 	proc, ok := h.processes[pid]
 	if !ok {
+		h.mu.Unlock()
 		return
 	}
 	sock, ok := proc.sockets[sockfd]
+	delete(proc.sockets, sockfd)
+	h.mu.Unlock()
 	if ok {
-		sock.removeSocket(ctx)
+		sock.mu.Lock()
+		delete(sock.fds, sockfd)
+		if len(sock.fds) == 0 {
+			sock.removeSocket(ctx)
+		} else if sock.sockfd == sockfd {
+			for fd := range sock.fds {
+				sock.sockfd = fd
+				break
+			}
+		}
+		sock.mu.Unlock()
 	}
-	delete(proc.sockets, sockfd)
 }
 
 // getPidFdInfo is derived from:
@@ -401,7 +589,10 @@ func (h *notifHandler) getPidFdInfo(ctx context.Context, pid int) (*pidInfo, err
 	logger := log.FromContext(ctx).With("func", "getPidFdInfo", "pid", pid)
 
 	// retrieve pidfd from cache
-	if pidfd, ok := h.pidInfos[pid]; ok {
+	h.mu.Lock()
+	pidfd, ok := h.pidInfos[pid]
+	h.mu.Unlock()
+	if ok {
 		return &pidfd, nil
 	}
 
@@ -412,8 +603,7 @@ func (h *notifHandler) getPidFdInfo(ctx context.Context, pid int) (*pidInfo, err
 			pidfd:   targetPidfd,
 			tgid:    pid, // process's pid is equal to its tgid
 		}
-		h.pidInfos[pid] = info
-		return &info, nil
+		return h.storePidInfo(pid, info), nil
 	}
 
 	// pid can be thread and pidfd_open fails with thread's pid.
@@ -455,11 +645,51 @@ func (h *notifHandler) getPidFdInfo(ctx context.Context, pid int) (*pidInfo, err
 		pidfd:   targetPidfd,
 		tgid:    nextTgid,
 	}
+	return h.storePidInfo(pid, info), nil
+}
+
+// hold counts the request of the pid as a user of the pidfds and memfd of the tgid until release.
+// It returns false if the pid has exited meanwhile.
+func (h *notifHandler) hold(pid, tgid int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.pidInfos[pid]; !ok {
+		return false
+	}
+	h.users[tgid]++
+	return true
+}
+
+// release closes the fds of the tgid exited if no requests of it are being handled anymore.
+func (h *notifHandler) release(tgid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.users[tgid]--; h.users[tgid] > 0 {
+		return
+	}
+	delete(h.users, tgid)
+	for _, fd := range h.exited[tgid] {
+		syscall.Close(fd)
+	}
+	delete(h.exited, tgid)
+}
+
+// storePidInfo caches the pidInfo unless another request has cached one for the pid meanwhile.
+func (h *notifHandler) storePidInfo(pid int, info pidInfo) *pidInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cached, ok := h.pidInfos[pid]; ok {
+		syscall.Close(info.pidfd)
+		return &cached
+	}
 	h.pidInfos[pid] = info
-	return &info, nil
+	return &info
 }
 
 func (h *notifHandler) readSockaddrFromProcess(ctx context.Context, pid int, offset uint64, addrlen uint64) (*sockaddr, error) {
+	if addrlen > syscall.SizeofSockaddrAny {
+		return nil, fmt.Errorf("addrlen %d is too long", addrlen)
+	}
 	buf, err := h.readProcMem(ctx, pid, offset, addrlen)
 	if err != nil {
 		return nil, fmt.Errorf("failed to readProcMem pid %v offset 0x%x: %s", pid, offset, err)
@@ -512,8 +742,14 @@ func (h *notifHandler) writeProcMem(ctx context.Context, pid int, offset uint64,
 
 func (h *notifHandler) openMem(ctx context.Context, pid int) (int, error) {
 	logger := log.FromContext(ctx)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
-	if memfd, ok := h.memfds[pid]; ok {
+	h.mu.Lock()
+	memfd, ok := h.memfds[pid]
+	h.mu.Unlock()
+	if ok {
 		return memfd, nil
 	}
 	memfd, err := unix.Open(fmt.Sprintf("/proc/%d/mem", pid), unix.O_RDWR, 0o777)
@@ -526,6 +762,14 @@ func (h *notifHandler) openMem(ctx context.Context, pid int) (int, error) {
 		logger.InfoContext(ctx, "succeeded to open mem with agent. continue to process")
 		memfd = newMemfd
 	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cached, ok := h.memfds[pid]; ok {
+		// opened by another request meanwhile
+		syscall.Close(memfd)
+		return cached, nil
+	}
 	h.memfds[pid] = memfd
 
 	return memfd, nil
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"syscall"
 
@@ -85,7 +86,7 @@ func (h *notifHandler) handleRsocket(ctx context.Context, sockfd int) {
 		case <-ctx.Done():
 			return
 		default:
-			_, err := syscall.Read(sockfd, buf)
+			n, err := syscall.Read(sockfd, buf)
 			if err != nil {
 				logger.ErrorContext(ctx, "failed to read from rsocket control socket", "err", err)
 				continue
@@ -101,7 +102,7 @@ func (h *notifHandler) handleRsocket(ctx context.Context, sockfd int) {
 			case "MVIP": // get my VIP
 				resp, err = h.handleRsocketMYVIP(ctx)
 			case "ACON": // access control
-				resp, err = h.handleRsocketAccessControl(ctx, buf[4:20])
+				resp, err = h.handleRsocketAccessControl(ctx, buf[4:max(n, 4)])
 			default:
 				logger.ErrorContext(ctx, "unexpected command", "cmd", cmd, "buf", buf)
 				resp = []byte("ER")
@@ -121,7 +122,11 @@ func (h *notifHandler) handleRsocket(ctx context.Context, sockfd int) {
 }
 
 func (h *notifHandler) handleRsocketMYVIP(ctx context.Context) ([]byte, error) {
-	sa, err := newSockAddrFromIPPort(syscall.AF_INET, h.myVIP, 0, 0, 0) // ephemeral port
+	if h.vip == nil {
+		return nil, errors.New("vip of the container is unknown")
+	}
+	// The sockaddr is sockaddr_in or sockaddr_in6 by the family of the VIP.
+	sa, err := newSockAddrFromIPPort(familyOf(h.vip), h.vip, 0, 0, 0) // ephemeral port
 	if err != nil {
 		return nil, fmt.Errorf("failed to create sockaddr: %w", err)
 	}
@@ -132,17 +137,29 @@ func (h *notifHandler) handleRsocketMYVIP(ctx context.Context) ([]byte, error) {
 	return append([]byte("OK"), buf...), nil
 }
 
-func (h *notifHandler) handleRsocketAccessControl(ctx context.Context, addr []byte) ([]byte, error) {
-	if len(addr) != 16 {
-		return nil, fmt.Errorf("unexpected addr: %v", addr)
+// handleRsocketAccessControl applies the server rules to the remote addr at the beginning of buf.
+// The local addr may follow it to match the rules by the local vport. Otherwise the vport is regarded as 0.
+// Each addr is sockaddr_in or sockaddr_in6.
+func (h *notifHandler) handleRsocketAccessControl(ctx context.Context, buf []byte) ([]byte, error) {
+	size, err := sockaddrSize(buf)
+	if err != nil || len(buf) < size {
+		return nil, fmt.Errorf("unexpected addr: %v", buf)
 	}
 
-	rsa, err := newSockaddr(addr)
+	rsa, err := newSockaddr(buf[:size])
 	if err != nil {
 		return nil, fmt.Errorf("failed to create remote sockaddr: %w", err)
 	}
+	localAddr := buf[size:]
+
+	var localPort uint16
+	if size, err := sockaddrSize(localAddr); err == nil && len(localAddr) >= size {
+		if lsa, err := newSockaddr(localAddr[:size]); err == nil {
+			localPort = lsa.Port
+		}
+	}
 
-	ok := h.sae.Apply(ctx, rsa.IP)
+	ok := h.sae.Apply(ctx, rsa.IP, localPort, syscall.SOCK_STREAM)
 	if !ok {
 		return []byte("NO"), nil
 	}
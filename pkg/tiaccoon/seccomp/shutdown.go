@@ -0,0 +1,131 @@
+package seccomp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+// ShutdownConfig configures how the containers are served while tiaccoon shuts down.
+type ShutdownConfig struct {
+	// Timeout bounds the wait for the requests in flight.
+	Timeout time.Duration
+	// Errno fails the system calls which would be bypassed during the shutdown. 0 continues them natively.
+	Errno syscall.Errno
+}
+
+// ParseErrno parses the name of an errno such as ECONNREFUSED case-insensitively.
+func ParseErrno(s string) (syscall.Errno, error) {
+	name := strings.ToUpper(s)
+	for e := syscall.Errno(1); e < 256; e++ {
+		if unix.ErrnoName(e) == name {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown errno %q", s)
+}
+
+// drainPollInterval is the period to check the requests in flight while draining.
+const drainPollInterval = 50 * time.Millisecond
+
+// shutdown makes handle stop bypassing new sockets and drain the requests.
+func (h *notifHandler) shutdown() {
+	h.shutdownOnce.Do(func() {
+		h.closing.Store(true)
+		buf := make([]byte, 8)
+		binary.NativeEndian.PutUint64(buf, 1)
+		unix.Write(h.wakeFd, buf)
+	})
+}
+
+// fallback answers a request which is not bypassed because of the shutdown.
+func (h *notifHandler) fallback(resp *libseccomp.ScmpNotifResp) {
+	if h.shutdownConfig.Errno == 0 {
+		resp.Flags |= SeccompUserNotifFlagContinue
+		resp.Error = 0
+		resp.Val = 0
+		return
+	}
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = int32(h.shutdownConfig.Errno)
+	resp.Val = 0
+}
+
+// drain removes all sockets, which closes their host sockets and wakes up the blocking requests,
+// and keeps answering the requests until none is in flight or the timeout expires.
+// After the timeout, cancel cancels ctx of the requests and the fds are closed only after all of them return.
+// The system calls after that fail with ENOSYS because the notification fd is closed.
+func (h *notifHandler) drain(ctx context.Context, cancel context.CancelFunc) {
+	logger := log.FromContext(ctx)
+	// shutdown must not write to wakeFd after handle closes it.
+	h.shutdownOnce.Do(func() {})
+	h.closing.Store(true)
+	h.removeAllSockets(ctx)
+
+	deadline := time.Now().Add(h.shutdownConfig.Timeout)
+	fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(drainPollInterval.Milliseconds()))
+		if err != nil && err != unix.EINTR {
+			logger.ErrorContext(ctx, "Error in poll", "error", err)
+			break
+		}
+		if n > 0 && fds[0].Revents&unix.POLLIN != 0 {
+			h.receive(ctx)
+			continue
+		}
+		if h.inflight.Load() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.WarnContext(ctx, "requests are still in flight after the shutdown timeout, canceling them", "requests", h.inflight.Load())
+			cancel()
+			break
+		}
+	}
+	h.reqs.Wait()
+
+	// Sockets registered while draining are removed too.
+	h.removeAllSockets(ctx)
+	h.mu.Lock()
+	for pid, info := range h.pidInfos {
+		syscall.Close(info.pidfd)
+		delete(h.pidInfos, pid)
+	}
+	for pid, memfd := range h.memfds {
+		syscall.Close(memfd)
+		delete(h.memfds, pid)
+	}
+	for tgid, fds := range h.exited {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		delete(h.exited, tgid)
+	}
+	h.mu.Unlock()
+	logger.InfoContext(ctx, "seccomp notification is drained")
+}
+
+// removeAllSockets removes the sockets of all processes.
+func (h *notifHandler) removeAllSockets(ctx context.Context) {
+	var sockets []*socketStatus
+	h.mu.Lock()
+	for pid, proc := range h.processes {
+		sockets = append(sockets, proc.uniqueSockets()...)
+		delete(h.processes, pid)
+	}
+	h.mu.Unlock()
+
+	for _, sock := range sockets {
+		sock.mu.Lock()
+		sock.removeSocket(ctx)
+		sock.mu.Unlock()
+	}
+}
@@ -0,0 +1,70 @@
+package seccomp
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	"golang.org/x/sys/unix"
+)
+
+func fdOpen(fd int) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err == nil
+}
+
+// TestDrainWaitsForRequests checks that drain closes the fds only after the requests still in flight
+// after the shutdown timeout are canceled and return.
+func TestDrainWaitsForRequests(t *testing.T) {
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	// The read end stands for the notification fd, which never has requests.
+	t.Cleanup(func() {
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+	})
+	memfd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &notifHandler{
+		fd:             libseccomp.ScmpFd(p[0]),
+		processes:      map[int]*processStatus{},
+		memfds:         map[int]int{1: memfd},
+		pidInfos:       map[int]pidInfo{},
+		users:          map[int]int{},
+		exited:         map[int][]int{},
+		shutdownConfig: ShutdownConfig{Timeout: 50 * time.Millisecond},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A request blocking beyond the timeout, which keeps using the memfd until it returns.
+	openUntilDone := make(chan bool, 1)
+	h.inflight.Add(1)
+	h.reqs.Add(1)
+	go func() {
+		defer h.reqs.Done()
+		defer h.inflight.Add(-1)
+		<-ctx.Done()
+		time.Sleep(100 * time.Millisecond)
+		openUntilDone <- fdOpen(memfd)
+	}()
+
+	h.drain(ctx, cancel)
+
+	if !<-openUntilDone {
+		t.Error("memfd is closed while the request is still in flight")
+	}
+	if fdOpen(memfd) {
+		t.Error("memfd is not closed after drain")
+	}
+	if len(h.memfds) != 0 {
+		t.Errorf("memfds = %v, want empty", h.memfds)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"syscall"
 )
 
@@ -17,7 +18,7 @@ type sockaddr struct {
 }
 
 func (sa *sockaddr) String() string {
-	return fmt.Sprintf("%s:%d", sa.IP, sa.Port)
+	return net.JoinHostPort(sa.IP.String(), strconv.Itoa(int(sa.Port)))
 }
 
 func newSockaddr(buf []byte) (*sockaddr, error) {
@@ -68,6 +69,9 @@ func newSockAddrFromIPPort(domain uint16, ip net.IP, port uint16, flowinfo, scop
 	sa.Family = domain
 	switch sa.Family {
 	case syscall.AF_INET:
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("%s cannot be an AF_INET address", ip)
+		}
 		sa.IP = make(net.IP, len(ip.To4()))
 		copy(sa.IP, ip.To4())
 		sa.Port = port
@@ -115,12 +119,41 @@ func sockaddrToByte(sa *sockaddr) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func zeroSockaddr() *sockaddr {
+// zeroSockaddr returns the unspecified address of the domain, which is 0.0.0.0 for AF_INET and :: for AF_INET6.
+func zeroSockaddr(domain int) *sockaddr {
 	sa := &sockaddr{}
-	sa.Family = syscall.AF_INET // TODO: Set by handling the syscall socket
+	sa.Family = syscall.AF_INET
 	sa.IP = net.IPv4zero
+	if domain == syscall.AF_INET6 {
+		sa.Family = syscall.AF_INET6
+		sa.IP = net.IPv6unspecified
+	}
 	sa.Port = 0
 	sa.Flowinfo = 0
 	sa.ScopeID = 0
 	return sa
 }
+
+// familyOf returns AF_INET for IPv4 and IPv4-mapped IPv6 addresses, and AF_INET6 otherwise.
+func familyOf(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// sockaddrSize returns the size of the sockaddr_in or sockaddr_in6 at the beginning of buf by its family.
+func sockaddrSize(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, fmt.Errorf("too short sockaddr: %v", buf)
+	}
+	// TODO: support big endian hosts
+	switch family := binary.LittleEndian.Uint16(buf[:2]); family {
+	case syscall.AF_INET:
+		return syscall.SizeofSockaddrInet4, nil
+	case syscall.AF_INET6:
+		return syscall.SizeofSockaddrInet6, nil
+	default:
+		return 0, fmt.Errorf("expected AF_INET or AF_INET6, got %d", family)
+	}
+}
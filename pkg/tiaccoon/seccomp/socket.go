@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"slices"
 	"sync"
 	"syscall"
 
@@ -14,11 +14,6 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const (
-	AcceptedSocketQueueCapacity = 1<<16 - 1
-	VirtualSockAddrSize         = syscall.SizeofSockaddrInet4
-)
-
 type socketOption struct {
 	level   uint64
 	optname uint64
@@ -41,6 +36,8 @@ const (
 	HostSocketListening
 	// HostSocketAccepted means that the socket is accepted and not bypassed yet
 	HostSocketAccepted
+	// HostSocketConnected means that the UDP socket is connected to the peer
+	HostSocketConnected
 	// HostSocketError happened after bypass. Nothing can be done to recover from this state.
 	HostSocketError
 )
@@ -53,6 +50,8 @@ func (hs hostSocketState) String() string {
 		return "HostSocketListening"
 	case HostSocketAccepted:
 		return "HostSocketAccepted"
+	case HostSocketConnected:
+		return "HostSocketConnected"
 	case HostSocketError:
 		return "HostSocketError"
 	default:
@@ -106,18 +105,39 @@ func (ss socketState) String() string {
 
 type processStatus struct {
 	sockets map[int]*socketStatus
+	// nativeDups are the sockets whose fds have been duplicated natively by F_DUPFD and may have unregistered fds.
+	nativeDups map[*socketStatus]struct{}
 }
 
 func newProcessStatus() *processStatus {
 	return &processStatus{
-		sockets: map[int]*socketStatus{},
+		sockets:    map[int]*socketStatus{},
+		nativeDups: map[*socketStatus]struct{}{},
 	}
 }
 
+// uniqueSockets returns the sockets of the process, each once even if it has several fds.
+func (p *processStatus) uniqueSockets() []*socketStatus {
+	sockets := []*socketStatus{}
+	seen := map[*socketStatus]struct{}{}
+	for _, sock := range p.sockets {
+		if _, ok := seen[sock]; ok {
+			continue
+		}
+		seen[sock] = struct{}{}
+		sockets = append(sockets, sock)
+	}
+	return sockets
+}
+
 type socketStatus struct {
+	// mu serializes the requests on the socket. It is released while a request blocks for a peer.
+	mu sync.Mutex
+
 	state           socketState
 	pid             int
-	sockfd          int
+	sockfd          int              // one of fds
+	fds             map[int]struct{} // the fds of the socket in the process, which dup(2) adds
 	sockDomain      int
 	sockType        int
 	sockProto       int
@@ -126,7 +146,11 @@ type socketStatus struct {
 	socketOptions   []socketOption
 	fcntlOptions    []fcntlOption
 	hostSockets     sync.Map
-	acceptedSockets chan *hostSocket
+	acceptQueue     *acceptQueue          // nil if not listening
+	acceptReadiness *acceptReadiness      // nil if not listening or not installed
+	dgram           *dgramStatus          // nil if not UDP socket or not bypassed
+	releaseVPort    func(context.Context) // nil if no vport is allocated
+	releaseConn     func()                // nil if not connected by a destination entry
 	Ctx             context.Context
 	Cancel          context.CancelFunc
 }
@@ -134,19 +158,19 @@ type socketStatus struct {
 func newSocketStatus(pid int, sockfd int, sockDomain, sockType, sockProto int) *socketStatus {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &socketStatus{
-		state:           NotBypassed,
-		pid:             pid,
-		sockfd:          sockfd,
-		sockDomain:      sockDomain,
-		sockType:        sockType,
-		sockProto:       sockProto,
-		localVAddr:      zeroSockaddr(),
-		remoteVAddr:     zeroSockaddr(),
-		socketOptions:   []socketOption{},
-		fcntlOptions:    []fcntlOption{},
-		acceptedSockets: make(chan *hostSocket, AcceptedSocketQueueCapacity),
-		Ctx:             ctx,
-		Cancel:          cancel,
+		state:         NotBypassed,
+		pid:           pid,
+		sockfd:        sockfd,
+		fds:           map[int]struct{}{sockfd: {}},
+		sockDomain:    sockDomain,
+		sockType:      sockType,
+		sockProto:     sockProto,
+		localVAddr:    zeroSockaddr(sockDomain),
+		remoteVAddr:   zeroSockaddr(sockDomain),
+		socketOptions: []socketOption{},
+		fcntlOptions:  []fcntlOption{},
+		Ctx:           ctx,
+		Cancel:        cancel,
 	}
 }
 
@@ -176,7 +200,15 @@ func (s *socketStatus) handleSysGetpeername(ctx context.Context, notifFd libsecc
 func (s *socketStatus) handleSysGetsockname(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
 	logger := log.FromContext(ctx)
 
-	err := handler.writeSockaddrToProcess(ctx, pid, req.Data.Args[1], req.Data.Args[2], s.localVAddr)
+	sa := s.localVAddr
+	// The peer sees the VIP of the container if the bypassed socket is not bound to an address.
+	if s.state == Bypassed && sa.IP.IsUnspecified() && handler.vip != nil {
+		if vsa, err := newSockAddrFromIPPort(sa.Family, handler.vip, sa.Port, sa.Flowinfo, sa.ScopeID); err == nil {
+			sa = vsa
+		}
+	}
+
+	err := handler.writeSockaddrToProcess(ctx, pid, req.Data.Args[1], req.Data.Args[2], sa)
 	if err != nil {
 		logger.ErrorContext(ctx, "failed to write sockaddr to process", "error", err)
 		return
@@ -186,7 +218,7 @@ func (s *socketStatus) handleSysGetsockname(ctx context.Context, notifFd libsecc
 	resp.Error = 0
 	resp.Val = 0
 
-	logger.InfoContext(ctx, "set sockaddr", "sockaddr", s.localVAddr)
+	logger.InfoContext(ctx, "set sockaddr", "sockaddr", sa)
 }
 
 // handleSysBind is derived from:
@@ -217,6 +249,16 @@ func (s *socketStatus) handleSysBind(ctx context.Context, notifFd libseccomp.Scm
 	s.localVAddr = dstAddr
 	logger = logger.With("dstAddr", dstAddr.String())
 
+	dynamic := dstAddr.Port == 0
+	if dynamic {
+		if err := s.allocateVPort(ctx, handler); err != nil {
+			logger.ErrorContext(ctx, "failed to allocate vport", "error", err)
+			resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+			resp.Error = int32(syscall.EADDRINUSE)
+			return
+		}
+	}
+
 	// TODO: check whether the destination is bypassed or not.
 	// TODO: handle loopback address
 	// TODO: handle interface's address as loopback
@@ -230,7 +272,12 @@ func (s *socketStatus) handleSysBind(ctx context.Context, notifFd libseccomp.Scm
 	// TODO: check whether the destination container socket is bypassed or not.
 	// https://github.com/rootless-containers/bypass4netns/blob/b9bca3046e413e80d9e556c22443e87d324de847/pkg/bypass4netns/socket.go#L229
 
-	dEntries := handler.de.GetServer(ctx, dstAddr.Port)
+	var dEntries []*destination.Entry
+	if dynamic {
+		dEntries = handler.dynamicEntries(ctx, s.localVAddr.Port)
+	} else {
+		dEntries = handler.de.GetServer(ctx, handler.vip, dstAddr.Port)
+	}
 	if dEntries == nil {
 		// TODO: Set NotBypassable when the destination is not found
 		logger.WarnContext(ctx, "destination not found, but virtual addr is recorded: (maybe called before connect)")
@@ -242,6 +289,7 @@ func (s *socketStatus) handleSysBind(ctx context.Context, notifFd libseccomp.Scm
 
 	ok := false
 	rdma := false
+	boundEntries := []*destination.Entry{}
 	for _, entry := range dEntries {
 		sockfdOnHost, err := s.transportBind(ctx, entry)
 		if err != nil {
@@ -269,6 +317,10 @@ func (s *socketStatus) handleSysBind(ctx context.Context, notifFd libseccomp.Scm
 			continue
 		}
 		ok = true
+		if dynamic {
+			entry = boundEntry(entry, sockfdOnHost)
+			boundEntries = append(boundEntries, entry)
+		}
 		hsCtx, hsCancel := context.WithCancel(context.Background())
 		hs := &hostSocket{
 			Sockfd: sockfdOnHost,
@@ -290,6 +342,7 @@ func (s *socketStatus) handleSysBind(ctx context.Context, notifFd libseccomp.Scm
 	}
 
 	s.state = Binded
+	s.registerVPort(ctx, handler, boundEntries)
 	if !rdma {
 		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
 		resp.Error = 0
@@ -320,9 +373,18 @@ func (s *socketStatus) handleSysListen(ctx context.Context, notifFd libseccomp.S
 		return
 	}
 
-	// Set bigger value if on-demand accept.
+	// The connections stay in the backlog of the host sockets until the container accepts them.
 	backlog := int(req.Data.Args[1])
 
+	q, err := newAcceptQueue()
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to create accept queue", "error", err)
+		s.state = Error
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EACCES)
+		return
+	}
+
 	ok := false
 	s.hostSockets.Range(func(key, value any) bool {
 		hs := value.(*hostSocket)
@@ -334,17 +396,17 @@ func (s *socketStatus) handleSysListen(ctx context.Context, notifFd libseccomp.S
 			logger.WarnContext(ctx, "failed to listen", "error", err, "hostSocket", hs)
 			return true
 		}
-		// Go cannot cancel blocking syscall such as accept. ( https://github.com/golang/go/issues/41054 )
-		// Tiaccoon can't use only an accepted host socket and cancel no-accepted host sockets when container calls accept (called on-demand accept).
-		// So, Tiaccoon calls accept on host socket when container calls listen.
-		// Tiaccoon expects applications to call accept immediately after calling listen.
-		//
-		// TODO: We may cancel accept by setsockopt(SO_ACCEPTCONN, 0).
-		go s.transportAccept(ctx, hs, handler.sae)
+		// Connections are accepted on demand when the container calls accept(2).
+		err = q.add(hs.Sockfd)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to watch host socket", "error", err, "hostSocket", hs)
+			return true
+		}
 		ok = true
-		logger.InfoContext(ctx, "listening and accepting on host", "hostSocket", hs)
+		logger.InfoContext(ctx, "listening on host", "hostSocket", hs)
 		return true
 	})
+	s.acceptQueue = q
 
 	if !handler.featureRDMA && !ok {
 		logger.ErrorContext(ctx, "failed to listen on all binded socket or binded socket not found")
@@ -355,6 +417,14 @@ func (s *socketStatus) handleSysListen(ctx context.Context, notifFd libseccomp.S
 	}
 
 	s.state = Listening
+	// Only event-loop servers poll the listening fd, which is non-blocking. A blocking fd keeps the socket of the container.
+	if flags, err := fileFlags(pid, s.sockfd); err != nil {
+		logger.WarnContext(ctx, "failed to get file flags", "error", err)
+	} else if ok && flags&syscall.O_NONBLOCK != 0 {
+		if err := s.installAcceptReadiness(ctx, notifFd, req, handler, pid); err != nil {
+			logger.WarnContext(ctx, "failed to install accept readiness: poll(2) on the socket is not available", "error", err)
+		}
+	}
 	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
 	resp.Error = 0
 	resp.Val = 0
@@ -387,68 +457,131 @@ func (s *socketStatus) handleSysAcceptWithFlags(ctx context.Context, notifFd lib
 		return
 	}
 
-	// TODO: handle flags with fcntl and setsockopt
-	// Cannot set flags when accepting a host socket because Tiaccoon does not do on-demand accept.
-
-	logger.InfoContext(ctx, "Waiting accept")
-	select {
-	case <-s.Ctx.Done():
+	if flags&^(syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC) != 0 {
+		logger.ErrorContext(ctx, "invalid accept4 flags", "flags", flags)
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(syscall.EINVAL)
 		return
-	case hs := <-s.acceptedSockets:
-		if hs.State != HostSocketAccepted {
-			logger.InfoContext(ctx, "unexpected status", "hostSocket", hs)
-			s.state = NotBypassable
-			return
-		}
-		logger.InfoContext(ctx, "accepted", "acceptedSockfd", hs.Sockfd)
-
-		defer syscall.Close(hs.Sockfd)
+	}
 
-		addfd := seccompNotifAddFd{
-			id:         req.ID,
-			flags:      0,
-			srcfd:      uint32(hs.Sockfd),
-			newfd:      0,
-			newfdFlags: 0,
-		}
+	nonblocking := false
+	if status, err := fileFlags(pid, s.sockfd); err != nil {
+		logger.WarnContext(ctx, "failed to get file flags", "error", err)
+	} else {
+		nonblocking = status&syscall.O_NONBLOCK != 0
+	}
+	if s.acceptReadiness != nil {
+		defer s.acceptReadiness.accepted()
+	}
 
-		newfd, err := addfd.ioctlNotifAddFd(notifFd)
-		if err != nil {
-			logger.ErrorContext(ctx, "ioctl NotifAddFd failed", "error", err)
-			s.state = NotBypassable
+	var hs *hostSocket
+	if nonblocking && s.acceptQueue != nil {
+		hs = s.acceptPending(ctx, handler.sae)
+		if hs == nil {
+			resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+			resp.Error = int32(syscall.EAGAIN)
 			return
 		}
+	}
 
-		asock, err := handler.registerSocket(ctx, pid, newfd)
+	if hs == nil {
+		logger.InfoContext(ctx, "Waiting accept")
+	}
+	for hs == nil && s.acceptQueue != nil {
+		q := s.acceptQueue
+		// Release the lock while blocking so that the socket can be closed or inspected meanwhile.
+		s.mu.Unlock()
+		ready, err := q.wait()
+		s.mu.Lock()
 		if err != nil {
-			logger.ErrorContext(ctx, "failed to register accepted socket", "error", err)
+			if !errors.Is(err, errAcceptQueueClosed) {
+				logger.ErrorContext(ctx, "failed to wait for connections", "error", err)
+			}
+			break
 		}
-		asock.state = Bypassed
-		asock.localVAddr = s.localVAddr // We may need to copy sockaddr
-		copy(asock.socketOptions, s.socketOptions)
-
-		// TODO: rewrite src address to virtual src address
-		// https://github.com/rootless-containers/bypass4netns/blob/b9bca3046e413e80d9e556c22443e87d324de847/pkg/bypass4netns/socket.go#L267
-
-		srcAddr, err := newSockAddrFromIPPort(s.localVAddr.Family, hs.Entry.VIP, hs.Entry.VPort, s.localVAddr.Flowinfo, s.localVAddr.ScopeID)
-		if err != nil {
-			logger.WarnContext(ctx, "failed to create sockaddr", "error", err)
+		// The host sockets are valid unless the socket has been removed meanwhile.
+		if s.Ctx.Err() != nil {
+			break
 		}
-		err = handler.writeSockaddrToProcess(ctx, pid, req.Data.Args[1], req.Data.Args[2], srcAddr)
-		if err != nil {
-			logger.WarnContext(ctx, "failed to write sockaddr to process", "error", err)
+		hs = s.acceptReady(ctx, ready, handler.sae)
+	}
+
+	if hs == nil {
+		if handler.closing.Load() {
+			handler.fallback(resp)
 		}
-		asock.remoteVAddr = srcAddr
+		return
+	}
+
+	if hs.State != HostSocketAccepted {
+		logger.InfoContext(ctx, "unexpected status", "hostSocket", hs)
+		s.state = NotBypassable
+		return
+	}
+	logger.InfoContext(ctx, "accepted", "acceptedSockfd", hs.Sockfd)
 
-		s.hostSockets.Delete(hs.Sockfd)
+	defer syscall.Close(hs.Sockfd)
 
+	if err := s.configureAccepted(ctx, hs.Sockfd, flags); err != nil {
+		logger.ErrorContext(ctx, "failed to configure accepted socket", "error", err)
 		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
-		resp.Error = 0
-		resp.Val = uint64(newfd)
+		resp.Error = int32(syscall.ECONNABORTED)
+		return
+	}
+
+	addfd := seccompNotifAddFd{
+		id:         req.ID,
+		flags:      0,
+		srcfd:      uint32(hs.Sockfd),
+		newfd:      0,
+		newfdFlags: 0,
+	}
+	if flags&syscall.SOCK_CLOEXEC != 0 {
+		addfd.newfdFlags = syscall.O_CLOEXEC
+	}
 
-		logger.InfoContext(ctx, "bypassed accepted socket", "hostSocket", hs, "newfd", newfd)
+	newfd, err := addfd.ioctlNotifAddFd(notifFd)
+	if err != nil {
+		logger.ErrorContext(ctx, "ioctl NotifAddFd failed", "error", err)
+		s.state = NotBypassable
 		return
 	}
+
+	asock, err := handler.registerSocket(ctx, pid, newfd)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to register accepted socket", "error", err)
+		return
+	}
+	asock.mu.Lock()
+	defer asock.mu.Unlock()
+	asock.state = Bypassed
+	asock.sockDomain = s.sockDomain // The accepted fd is the socket of the transport on the host.
+	asock.localVAddr = s.localVAddr // We may need to copy sockaddr
+	asock.socketOptions = slices.Clone(s.socketOptions)
+	if flags&syscall.SOCK_NONBLOCK != 0 {
+		asock.fcntlOptions = append(asock.fcntlOptions, fcntlOption{cmd: unix.F_SETFL, value: syscall.O_NONBLOCK})
+	}
+
+	// TODO: rewrite src address to virtual src address
+	// https://github.com/rootless-containers/bypass4netns/blob/b9bca3046e413e80d9e556c22443e87d324de847/pkg/bypass4netns/socket.go#L267
+
+	// An IPv4 client is seen as the IPv4-mapped address by an AF_INET6 socket.
+	srcAddr, err := newSockAddrFromIPPort(s.localVAddr.Family, hs.Entry.VIP, hs.Entry.VPort, s.localVAddr.Flowinfo, s.localVAddr.ScopeID)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to create sockaddr", "error", err)
+		srcAddr = zeroSockaddr(int(s.localVAddr.Family))
+	}
+	err = handler.writeSockaddrToProcess(ctx, pid, req.Data.Args[1], req.Data.Args[2], srcAddr)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to write sockaddr to process", "error", err)
+	}
+	asock.remoteVAddr = srcAddr
+
+	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+	resp.Error = 0
+	resp.Val = uint64(newfd)
+
+	logger.InfoContext(ctx, "bypassed accepted socket", "hostSocket", hs, "newfd", newfd)
 }
 
 // handleSysConnect is derived from:
@@ -462,19 +595,6 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 	var err error
 	logger := log.FromContext(ctx)
 
-	// if s.localVAddr.Port == 0 {
-	// 	s.localVAddr, err = newSockAddrFromIPPort(
-	// 		syscall.AF_INET,
-	// 		net.IPv4(0, 0, 0, 0), // TODO: handler.myVIP
-	// 		0,                    // TODO: ephemeral port
-	// 		0, 0,
-	// 	)
-	// 	if err != nil {
-	// 		logger.WarnContext(ctx, "failed to create localVAddr", "error", err)
-	// 		s.localVAddr = zeroSockaddr()
-	// 	}
-	// }
-
 	// TODO: s.pid and pid may be the same
 	dstAddr, err := handler.readSockaddrFromProcess(ctx, s.pid, req.Data.Args[1], req.Data.Args[2])
 	if err != nil {
@@ -485,7 +605,7 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 	s.remoteVAddr = dstAddr
 	logger = logger.With("dstAddr", dstAddr.String())
 
-	ok := handler.cae.Apply(ctx, dstAddr.IP)
+	ok := handler.cae.Apply(ctx, dstAddr.IP, dstAddr.Port, s.sockType)
 	if !ok {
 		logger.ErrorContext(ctx, "access control denied")
 		s.state = Error
@@ -495,6 +615,17 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 	}
 	logger.InfoContext(ctx, "access control allowed")
 
+	// The client socket not bound to a port gets an ephemeral vport as the kernel does.
+	if s.localVAddr.Port == 0 {
+		if err := s.allocateVPort(ctx, handler); err != nil {
+			logger.ErrorContext(ctx, "failed to allocate vport", "error", err)
+			s.state = Error
+			resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+			resp.Error = int32(syscall.EADDRNOTAVAIL)
+			return
+		}
+	}
+
 	// TODO: check whether the destination is bypassed or not.
 	// TODO: handle loopback address
 	// TODO: handle interface's address as loopback
@@ -518,23 +649,38 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 		return
 	}
 
+	// connect(2) of a non-blocking socket fails with EINPROGRESS unless the connection completes immediately as UNIX does.
+	// The flags are read from the fd because fcntlOptions does not have SOCK_NONBLOCK of socket(2).
+	flags, err := fileFlags(pid, s.sockfd)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to get file flags", "error", err)
+	}
+	nonblocking := flags&syscall.O_NONBLOCK != 0
+
 	var sockfdOnHost int
+	var connected *destination.Entry
+	// next and groups are the entries tried after the entry in progress.
+	var next []*destination.Entry
+	var groups [][]*destination.Entry
+	inProgress := false
 	ok = false
-	for _, entries := range dEntries { // Prioritize the first transport type
-		tried := make(map[int]bool, len(entries))
-		cnt := 0
-		for {
-			if cnt >= len(entries) {
-				break
+	for i, entries := range dEntries { // Prioritize the first transport type
+		ordered := handler.de.Order(dstAddr.IP, dstAddr.Port, entries, handler.vip)
+		for j, entry := range ordered {
+			timeout := handler.connectTimeoutOf(entry)
+			if nonblocking {
+				timeout = connectNoWait
 			}
-			n := rand.Intn(len(entries)) // TODO: round-robin
-			if tried[n] {
-				continue
+			sockfdOnHost, err = s.transportConnect(ctx, entry, timeout)
+			if err == syscall.EINPROGRESS {
+				logger.InfoContext(ctx, "connecting on host", "sockfdOnHost", sockfdOnHost, "entry", entry)
+				connected = entry
+				next = ordered[j+1:]
+				groups = dEntries[i+1:]
+				inProgress = true
+				ok = true
+				break
 			}
-			tried[n] = true
-			cnt++
-			entry := entries[n]
-			sockfdOnHost, err = s.transportConnect(ctx, entry)
 			if err != nil {
 				if handler.featureRDMA && errors.Is(err, ErrTryRDMA) { // RDMA
 					logger.InfoContext(ctx, "try RDMA", "entry", entry, "sockfdOnHost(new addrlen)", sockfdOnHost)
@@ -550,6 +696,7 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 						continue
 					}
 					s.state = Bypassed
+					s.releaseConn = handler.de.Connected(entry)
 					resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
 					resp.Error = 0
 					resp.Val = uint64(ErrTryRDMA) + uint64(sockfdOnHost) // 999 + new addrlen
@@ -560,6 +707,7 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 			}
 			defer syscall.Close(sockfdOnHost)
 			logger.InfoContext(ctx, "connected on host", "sockfdOnHost", sockfdOnHost, "entry", entry)
+			connected = entry
 			ok = true
 			break
 		}
@@ -575,18 +723,32 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 		return
 	}
 
-	localVAddrByte, err := sockaddrToByte(s.localVAddr)
-	if err == nil {
-		if len(localVAddrByte) == VirtualSockAddrSize {
-			err = syscall.Sendto(sockfdOnHost, localVAddrByte, 0, nil)
-			if err != nil {
-				logger.ErrorContext(ctx, "failed to sendto", "error", err)
-			}
-		} else {
-			logger.ErrorContext(ctx, "unexpected sockaddr size", "size", len(localVAddrByte))
+	// Notify the VIP of the container as the client address if the socket is not bound to an address.
+	// The address is sent in the family of the IP, so an IPv4-mapped address is notified as AF_INET.
+	notifiedIP := s.localVAddr.IP
+	if notifiedIP.IsUnspecified() && handler.vip != nil {
+		notifiedIP = handler.vip
+	}
+	notifiedVAddr, err := newSockAddrFromIPPort(familyOf(notifiedIP), notifiedIP, s.localVAddr.Port, 0, 0)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to create virtual address", "error", err)
+		notifiedVAddr = nil
+	}
+
+	if inProgress {
+		if err := s.connectInProgress(ctx, notifFd, req, resp, handler, flags, sockfdOnHost, connected, next, groups, notifiedVAddr); err != nil {
+			logger.ErrorContext(ctx, "failed to connect in progress", "error", err)
+			syscall.Close(sockfdOnHost)
+			s.state = NotBypassable
+			return
+		}
+		logger.InfoContext(ctx, "bypassed connect socket in progress")
+		return
+	}
+	if notifiedVAddr != nil {
+		if err := sendVAddr(sockfdOnHost, notifiedVAddr); err != nil {
+			logger.ErrorContext(ctx, "failed to send virtual address", "error", err)
 		}
-	} else {
-		logger.ErrorContext(ctx, "failed to convert sockaddr to byte", "error", err)
 	}
 
 	addfd := seccompNotifAddFd{
@@ -603,8 +765,10 @@ func (s *socketStatus) handleSysConnect(ctx context.Context, notifFd libseccomp.
 		s.state = NotBypassable
 		return
 	}
+	s.installAliases(ctx, notifFd, req, sockfdOnHost)
 
 	s.state = Bypassed
+	s.releaseConn = handler.de.Connected(connected)
 	resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
 	resp.Error = 0
 	resp.Val = 0
@@ -643,6 +807,20 @@ func (s *socketStatus) handleSysSetsockopt(ctx context.Context, notifFd libsecco
 		optval:  optval,
 		optlen:  optlen,
 	}
+
+	// The fd of the container is not an IP socket with accept readiness.
+	// The option is applied to the listening host sockets instead and its result is returned.
+	if s.acceptReadiness != nil {
+		errno := s.setsockoptListening(value)
+		if errno == 0 {
+			s.socketOptions = append(s.socketOptions, value)
+		}
+		resp.Flags &= (^uint32(SeccompUserNotifFlagContinue))
+		resp.Error = int32(errno)
+		resp.Val = 0
+		logger.DebugContext(ctx, "setsockopt was applied to listening host sockets", "level", level, "optname", optname, "errno", errno)
+		return
+	}
 	s.socketOptions = append(s.socketOptions, value)
 
 	if s.state == Binded || s.state == Listening {
@@ -667,7 +845,7 @@ func (s *socketStatus) handleSysSetsockopt(ctx context.Context, notifFd libsecco
 //   Copyright [yyyy] [name of copyright owner]
 //
 // Licensed under the Apache License, Version 2.0.
-func (s *socketStatus) handleSysFcntl(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp) {
+func (s *socketStatus) handleSysFcntl(ctx context.Context, notifFd libseccomp.ScmpFd, req *libseccomp.ScmpNotifReq, resp *libseccomp.ScmpNotifResp, handler *notifHandler, pid int) {
 	logger := log.FromContext(ctx)
 
 	fcntlCmd := req.Data.Args[1]
@@ -681,6 +859,13 @@ func (s *socketStatus) handleSysFcntl(ctx context.Context, notifFd libseccomp.Sc
 		}
 		s.fcntlOptions = append(s.fcntlOptions, opt)
 		logger.DebugContext(ctx, fmt.Sprintf("fcntl cmd=0x%x value=%d was recorded.", fcntlCmd, opt.value))
+		// The listening fd made non-blocking after listen(2) is polled too.
+		// fcntl(2) continues on the end installed, so the end becomes non-blocking.
+		if s.state == Listening && s.acceptQueue != nil && s.acceptReadiness == nil && opt.value&syscall.O_NONBLOCK != 0 {
+			if err := s.installAcceptReadiness(ctx, notifFd, req, handler, pid); err != nil {
+				logger.WarnContext(ctx, "failed to install accept readiness: poll(2) on the socket is not available", "error", err)
+			}
+		}
 	case unix.F_GETFL: // 0x3
 		// ignore these
 	default:
@@ -696,15 +881,47 @@ func (s *socketStatus) handleSysFcntl(ctx context.Context, notifFd libseccomp.Sc
 	}
 }
 
+// setsockoptListening applies the socket option to the listening host sockets.
+// It succeeds if any of them accepts the option, since some options are not supported by all transports.
+func (s *socketStatus) setsockoptListening(v socketOption) syscall.Errno {
+	errno := syscall.EINVAL
+	s.hostSockets.Range(func(key, value any) bool {
+		hs := value.(*hostSocket)
+		if hs.State != HostSocketListening {
+			return true
+		}
+		err := setsockopt(hs.Sockfd, v)
+		if err == nil {
+			errno = 0
+			return true
+		}
+		if errno != 0 && !errors.As(err, &errno) {
+			errno = syscall.EINVAL
+		}
+		return true
+	})
+	return errno
+}
+
 func (s *socketStatus) removeSocket(ctx context.Context) {
 	logger := log.FromContext(ctx)
+	if s.acceptQueue != nil {
+		// wake up the requests waiting for connections before closing the host sockets
+		s.acceptQueue.close()
+		s.acceptQueue = nil
+	}
+	if s.acceptReadiness != nil {
+		s.acceptReadiness.close()
+		s.acceptReadiness = nil
+	}
 	s.hostSockets.Range(func(key, value any) bool {
 		hs := value.(*hostSocket)
 		if hs.Cancel != nil {
 			hs.Cancel()
 		}
 		err := syscall.Shutdown(hs.Sockfd, syscall.SHUT_RDWR)
-		if err != nil {
+		// unconnected UDP socket fails with ENOTCONN but its receivers are woken up.
+		if err != nil && !(s.sockType == syscall.SOCK_DGRAM && err == syscall.ENOTCONN) {
 			logger.ErrorContext(ctx, "failed to shutdown host socket", "error", err, "hostSocket", hs)
 		} else {
 			logger.DebugContext(ctx, "shutdowned host socket", "hostSocket", hs)
@@ -717,5 +934,18 @@ func (s *socketStatus) removeSocket(ctx context.Context) {
 		}
 		return true
 	})
+	if s.dgram != nil {
+		s.dgram.close()
+	}
+	if s.releaseVPort != nil {
+		s.releaseVPort(ctx)
+		s.releaseVPort = nil
+	}
+	if s.releaseConn != nil {
+		s.releaseConn()
+		s.releaseConn = nil
+	}
+	// No fd is added to the removed socket.
+	clear(s.fds)
 	s.Cancel()
 }
@@ -0,0 +1,93 @@
+package seccomp
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+)
+
+// Containers returns the status of the containers handled by the handler.
+func (h *Handler) Containers(ctx context.Context) []*api.Container {
+	containers := []*api.Container{}
+	h.notifHandlers.Range(func(key, value any) bool {
+		containers = append(containers, value.(*notifHandler).status())
+		return true
+	})
+	slices.SortFunc(containers, func(x, y *api.Container) int {
+		return cmp.Compare(x.NotifFd, y.NotifFd)
+	})
+	return containers
+}
+
+func (h *notifHandler) status() *api.Container {
+	c := &api.Container{
+		NotifFd:   int(h.fd),
+		Processes: []*api.Process{},
+	}
+	if h.state != nil {
+		c.ID = h.state.State.ID
+		c.Pid = h.state.State.Pid
+	}
+	if h.vip != nil {
+		c.VIP = h.vip.String()
+	}
+
+	// The sockets are collected first because socketStatus.mu must not be locked while holding h.mu.
+	// A socket with several fds is shown for each fd.
+	sockets := map[int]map[int]*socketStatus{}
+	h.mu.Lock()
+	for pid, proc := range h.processes {
+		sockets[pid] = maps.Clone(proc.sockets)
+	}
+	h.mu.Unlock()
+
+	for pid, socks := range sockets {
+		p := &api.Process{
+			Pid:     pid,
+			Sockets: []*api.Socket{},
+		}
+		for fd, sock := range socks {
+			p.Sockets = append(p.Sockets, sock.status(fd))
+		}
+		slices.SortFunc(p.Sockets, func(x, y *api.Socket) int {
+			return cmp.Compare(x.Fd, y.Fd)
+		})
+		c.Processes = append(c.Processes, p)
+	}
+	slices.SortFunc(c.Processes, func(x, y *api.Process) int {
+		return cmp.Compare(x.Pid, y.Pid)
+	})
+	return c
+}
+
+func (s *socketStatus) status(fd int) *api.Socket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sock := &api.Socket{
+		Fd:          fd,
+		State:       s.state.String(),
+		Domain:      s.sockDomain,
+		Type:        s.sockType,
+		Protocol:    s.sockProto,
+		LocalVAddr:  s.localVAddr.String(),
+		RemoteVAddr: s.remoteVAddr.String(),
+		HostSockets: []*api.HostSocket{},
+	}
+	s.hostSockets.Range(func(key, value any) bool {
+		hs := value.(*hostSocket)
+		sock.HostSockets = append(sock.HostSockets, &api.HostSocket{
+			Sockfd: hs.Sockfd,
+			State:  hs.State.String(),
+			Entry:  hs.Entry,
+		})
+		return true
+	})
+	slices.SortFunc(sock.HostSockets, func(x, y *api.HostSocket) int {
+		return cmp.Compare(x.Sockfd, y.Sockfd)
+	})
+	return sock
+}
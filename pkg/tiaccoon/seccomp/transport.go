@@ -5,30 +5,103 @@ import (
 	"errors"
 	"fmt"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
-	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+	"golang.org/x/sys/unix"
 )
 
-func (s *socketStatus) transportConnect(ctx context.Context, entry *destination.Entry) (int, error) {
+// transportConnect connects a socket on the host to the entry within the timeout. 0 is no timeout.
+// With connectNoWait, the socket is returned with EINPROGRESS if the connection is in progress; see waitConnected.
+func (s *socketStatus) transportConnect(ctx context.Context, entry *destination.Entry, timeout time.Duration) (int, error) {
 	logger := log.FromContext(ctx).With("entry", entry)
 	ctx = log.ContextWithLogger(ctx, logger)
 	switch entry.Transport {
 	case destination.TransportUNIX:
-		return s.transportConnectUNIX(ctx, entry)
+		return s.transportConnectUNIX(ctx, entry, timeout)
 	case destination.TransportRDMA:
-		return s.transportConnectRDMA(ctx, entry)
+		return s.transportConnectRDMA(ctx, entry, timeout)
 	case destination.TransportIPv6:
-		return 0, errors.New("NOT IMPLEMENTED: IPv6")
+		return s.transportConnectIPv6(ctx, entry, timeout)
 	case destination.TransportIPv4:
-		return s.transportConnectIPv4(ctx, entry)
+		return s.transportConnectIPv4(ctx, entry, timeout)
 	default:
 		return 0, errors.New("UNEXPECTED: Unknown transport")
 	}
 }
 
+// connectTimeoutOf returns the timeout of connect(2) to the entry, which is the default of the handler if not set.
+func (h *notifHandler) connectTimeoutOf(entry *destination.Entry) time.Duration {
+	if entry.ConnectTimeout > 0 {
+		return entry.ConnectTimeout
+	}
+	return h.connectTimeout
+}
+
+// connectNoWait is the timeout of connectHost to return EINPROGRESS without waiting for the connection.
+const connectNoWait time.Duration = -1
+
+// connectHost connects the socket on the host to the address within the timeout. 0 is no timeout.
+// The socket is non-blocking during connect(2), so an unreachable address does not hold the handler longer than the timeout.
+// The flags of the socket are restored afterwards.
+func connectHost(sockfd int, sa syscall.Sockaddr, timeout time.Duration) error {
+	if timeout == 0 {
+		return syscall.Connect(sockfd, sa)
+	}
+	flags, err := unix.FcntlInt(uintptr(sockfd), unix.F_GETFL, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get flags: %w", err)
+	}
+	if _, err := unix.FcntlInt(uintptr(sockfd), unix.F_SETFL, flags|unix.O_NONBLOCK); err != nil {
+		return fmt.Errorf("failed to set O_NONBLOCK: %w", err)
+	}
+	defer unix.FcntlInt(uintptr(sockfd), unix.F_SETFL, flags)
+
+	err = syscall.Connect(sockfd, sa)
+	if err != syscall.EINPROGRESS || timeout == connectNoWait {
+		// A UNIX socket is connected or fails immediately, with EAGAIN if the backlog is full.
+		return err
+	}
+	return waitConnected(sockfd, timeout)
+}
+
+// waitConnected waits for the connection in progress on the socket within the timeout and returns its result.
+// 0 is no timeout.
+func waitConnected(sockfd int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ms := -1
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return syscall.ETIMEDOUT
+			}
+			ms = int(remaining.Milliseconds()) + 1
+		}
+		fds := []unix.PollFd{{Fd: int32(sockfd), Events: unix.POLLOUT}}
+		n, err := unix.Poll(fds, ms)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to poll: %w", err)
+		}
+		if n > 0 {
+			break
+		}
+	}
+	soErr, err := syscall.GetsockoptInt(sockfd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return fmt.Errorf("failed to get SO_ERROR: %w", err)
+	}
+	if soErr != 0 {
+		return syscall.Errno(soErr)
+	}
+	return nil
+}
+
 func (s *socketStatus) transportBind(ctx context.Context, entry *destination.Entry) (int, error) {
 	logger := log.FromContext(ctx).With("entry", entry)
 	ctx = log.ContextWithLogger(ctx, logger)
@@ -38,7 +111,7 @@ func (s *socketStatus) transportBind(ctx context.Context, entry *destination.Ent
 	case destination.TransportRDMA:
 		return s.transportBindRDMA(ctx, entry)
 	case destination.TransportIPv6:
-		return 0, errors.New("NOT IMPLEMENTED: IPv6")
+		return s.transportBindIPv6(ctx, entry)
 	case destination.TransportIPv4:
 		return s.transportBindIPv4(ctx, entry)
 	default:
@@ -74,50 +147,6 @@ func (s *socketStatus) transportListenSocket(ctx context.Context, sockfdOnHost,
 	return nil
 }
 
-func (s *socketStatus) transportAccept(ctx context.Context, hs *hostSocket, sae *accesscontrol.Entries) {
-	logger := log.FromContext(ctx).With("sockfdOnHost", hs.Sockfd)
-	ctx = log.ContextWithLogger(ctx, logger)
-	var err error
-	var as *hostSocket
-	for {
-		select {
-		case <-hs.Ctx.Done():
-			return
-		default:
-			switch hs.Entry.Transport {
-			case destination.TransportUNIX:
-				as, err = s.transportAcceptUNIX(ctx, hs.Sockfd)
-			case destination.TransportRDMA:
-				err = errors.New("UNEXPECTED: RDMA")
-			case destination.TransportIPv6:
-				err = errors.New("NOT IMPLEMENTED: IPv6")
-			case destination.TransportIPv4:
-				as, err = s.transportAcceptIPv4(ctx, hs.Sockfd)
-			default:
-				err = errors.New("UNEXPECTED: Unknown transport")
-			}
-			if err != nil {
-				logger.ErrorContext(ctx, "failed to accept", "error", err)
-				// TODO: Cleanup hostSocket if changed to HostSocketError
-				hs.State = HostSocketError
-				hs.Cancel()
-				return
-			}
-
-			ok := sae.Apply(ctx, as.Entry.VIP)
-			if !ok {
-				logger.ErrorContext(ctx, "access control denied", "acceptedHostSocket", as)
-				syscall.Close(as.Sockfd) // TODO: Close socket more precisely
-				continue
-			}
-			logger.InfoContext(ctx, "access control allowed", "acceptedHostSocket", as)
-
-			s.hostSockets.Store(as.Sockfd, as)
-			s.acceptedSockets <- as
-		}
-	}
-}
-
 func (s *socketStatus) configureSocket(ctx context.Context, sockfd int) error {
 	logger := log.FromContext(ctx)
 
@@ -140,19 +169,70 @@ func (s *socketStatus) configureSocket(ctx context.Context, sockfd int) error {
 	return nil
 }
 
+// sendVAddr sends the virtual address of the client at the beginning of the connection on the host
+// as the raw sockaddr_in or sockaddr_in6. recvDstVAddr reads the family first to know its size.
+func sendVAddr(sockfd int, sa *sockaddr) error {
+	buf, err := sockaddrToByte(sa)
+	if err != nil {
+		return fmt.Errorf("failed to convert sockaddr to byte: %w", err)
+	}
+	for len(buf) > 0 {
+		n, err := syscall.Write(sockfd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write virtual address: %w", err)
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// errNoVAddr is returned when the accepted connection does not send the virtual address,
+// such as a probe of the health checker. Only the connection is dropped.
+var errNoVAddr = errors.New("failed to receive destination virtual address")
+
+// recvDstVAddr receives the virtual address sent first on the accepted connection without blocking.
+// It returns EAGAIN until the whole address has arrived, so the address is consumed at once and the connection is
+// handed over to the container only after it.
 func recvDstVAddr(sockfd int) (*sockaddr, error) {
-	buf := make([]byte, VirtualSockAddrSize)
-	n, _, err := syscall.Recvfrom(sockfd, buf, 0)
-	if err != nil || n != VirtualSockAddrSize {
-		return nil, fmt.Errorf("failed to recvfrom %d: %w", n, err)
+	buf := make([]byte, syscall.SizeofSockaddrInet6)
+	n, _, err := unix.Recvfrom(sockfd, buf, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	if err == unix.EAGAIN || err == unix.EINTR {
+		return nil, syscall.EAGAIN
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNoVAddr, err)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%w: connection closed", errNoVAddr)
+	}
+	if n < 2 {
+		return nil, syscall.EAGAIN
+	}
+	size, err := sockaddrSize(buf[:2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: unexpected virtual address: %w", errNoVAddr, err)
+	}
+	if n < size {
+		return nil, syscall.EAGAIN
+	}
+	// The peeked bytes are read without blocking.
+	n, err = syscall.Read(sockfd, buf[:size])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNoVAddr, err)
+	}
+	if n != size {
+		return nil, fmt.Errorf("%w: short read of %d bytes", errNoVAddr, n)
 	}
-	return newSockaddr(buf)
+	return newSockaddr(buf[:size])
 }
 
 func setsockopt(sockfd int, v socketOption) error {
 	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(sockfd), uintptr(v.level), uintptr(v.optname), uintptr(unsafe.Pointer(&v.optval[0])), uintptr(v.optlen), 0)
 	if errno != 0 {
-		return fmt.Errorf("setsockopt failed(%v): %s", v, errno)
+		return fmt.Errorf("setsockopt failed(%v): %w", v, errno)
 	}
 	return nil
 }
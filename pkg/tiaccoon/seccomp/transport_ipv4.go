@@ -5,12 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"syscall"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
 )
 
-func (s *socketStatus) transportConnectIPv4(ctx context.Context, entry *destination.Entry) (int, error) {
+func (s *socketStatus) transportConnectIPv4(ctx context.Context, entry *destination.Entry, timeout time.Duration) (int, error) {
 	logger := log.FromContext(ctx).With("func", "transportConnectIPv4")
 
 	sockfdOnHost, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
@@ -39,20 +40,26 @@ func (s *socketStatus) transportConnectIPv4(ctx context.Context, entry *destinat
 
 	err = s.configureSocket(ctx, sockfdOnHost)
 	if err != nil {
+		syscall.Close(sockfdOnHost)
 		return 0, fmt.Errorf("failed to configure socket: %w", err)
 	}
 	logger.DebugContext(ctx, "configured socket", "sockfdOnHost", sockfdOnHost)
 
 	addr, ok := entry.Address.(destination.TransportAddrIPv4)
 	if !ok {
+		syscall.Close(sockfdOnHost)
 		return 0, errors.New("UNEXPECTED: Address is not TransportAddrIPv4")
 	}
 
-	err = syscall.Connect(sockfdOnHost, &syscall.SockaddrInet4{
+	err = connectHost(sockfdOnHost, &syscall.SockaddrInet4{
 		Addr: addr.IP(),
 		Port: addr.Port(),
-	})
+	}, timeout)
+	if err == syscall.EINPROGRESS {
+		return sockfdOnHost, err
+	}
 	if err != nil {
+		syscall.Close(sockfdOnHost)
 		return 0, fmt.Errorf("failed to connect: %w", err)
 	}
 
@@ -101,17 +108,10 @@ func (s *socketStatus) transportAcceptIPv4(ctx context.Context, sockfdOnHost int
 		return nil, fmt.Errorf("failed to cast srcAddr to srcAddr4: %v", srcAddr)
 	}
 
-	vsa, err := recvDstVAddr(acceptedSockfd)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive destination virtual address: %w", err)
-	}
-
 	hsCtx, hsCancel := context.WithCancel(context.Background())
 	as := &hostSocket{
 		Sockfd: acceptedSockfd,
 		Entry: &destination.Entry{
-			VIP:       vsa.IP,
-			VPort:     uint16(vsa.Port),
 			Transport: destination.TransportIPv4,
 			Address:   destination.NewTransportAddrIPv4(srcAddr4.Addr, int(srcAddr4.Port)),
 		},
@@ -0,0 +1,114 @@
+package seccomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+)
+
+func (s *socketStatus) transportConnectIPv6(ctx context.Context, entry *destination.Entry, timeout time.Duration) (int, error) {
+	logger := log.FromContext(ctx).With("func", "transportConnectIPv6")
+
+	addr, ok := entry.Address.(destination.TransportAddrIPv6)
+	if !ok {
+		return 0, errors.New("UNEXPECTED: Address is not TransportAddrIPv6")
+	}
+
+	sockfdOnHost, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create socket: %w", err)
+	}
+	logger.InfoContext(ctx, "created socket", "sockfdOnHost", sockfdOnHost, "localVAddr", s.localVAddr)
+
+	err = s.configureSocket(ctx, sockfdOnHost)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return 0, fmt.Errorf("failed to configure socket: %w", err)
+	}
+	logger.DebugContext(ctx, "configured socket", "sockfdOnHost", sockfdOnHost)
+
+	err = connectHost(sockfdOnHost, &syscall.SockaddrInet6{
+		Addr: addr.IP(),
+		Port: addr.Port(),
+	}, timeout)
+	if err == syscall.EINPROGRESS {
+		return sockfdOnHost, err
+	}
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return 0, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	return sockfdOnHost, nil
+}
+
+func (s *socketStatus) transportBindIPv6(ctx context.Context, entry *destination.Entry) (int, error) {
+	logger := log.FromContext(ctx).With("func", "transportBindIPv6")
+
+	addr, ok := entry.Address.(destination.TransportAddrIPv6)
+	if !ok {
+		return 0, errors.New("UNEXPECTED: Address is not TransportAddrIPv6")
+	}
+
+	sockfdOnHost, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create socket: %w", err)
+	}
+	logger.DebugContext(ctx, "created socket", "sockfdOnHost", sockfdOnHost)
+
+	err = s.configureSocket(ctx, sockfdOnHost)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return 0, fmt.Errorf("failed to configure socket: %w", err)
+	}
+	logger.DebugContext(ctx, "configured socket", "sockfdOnHost", sockfdOnHost)
+
+	// IPv4 is served by the IPv4 entries, so [::] must not take the port of 0.0.0.0.
+	err = syscall.SetsockoptInt(sockfdOnHost, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return 0, fmt.Errorf("failed to set IPV6_V6ONLY: %w", err)
+	}
+
+	err = syscall.Bind(sockfdOnHost, &syscall.SockaddrInet6{
+		Addr: addr.IP(),
+		Port: addr.Port(),
+	})
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return 0, fmt.Errorf("failed to bind: %w", err)
+	}
+
+	return sockfdOnHost, nil
+}
+
+func (s *socketStatus) transportAcceptIPv6(ctx context.Context, sockfdOnHost int) (*hostSocket, error) {
+	acceptedSockfd, srcAddr, err := syscall.Accept(sockfdOnHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept: %w", err)
+	}
+
+	srcAddr6, ok := srcAddr.(*syscall.SockaddrInet6)
+	if !ok {
+		syscall.Close(acceptedSockfd)
+		return nil, fmt.Errorf("failed to cast srcAddr to srcAddr6: %v", srcAddr)
+	}
+
+	hsCtx, hsCancel := context.WithCancel(context.Background())
+	as := &hostSocket{
+		Sockfd: acceptedSockfd,
+		Entry: &destination.Entry{
+			Transport: destination.TransportIPv6,
+			Address:   destination.NewTransportAddrIPv6(srcAddr6.Addr, srcAddr6.Port),
+		},
+		State:  HostSocketAccepted,
+		Ctx:    hsCtx,
+		Cancel: hsCancel,
+	}
+	return as, nil
+}
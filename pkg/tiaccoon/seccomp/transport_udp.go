@@ -0,0 +1,265 @@
+package seccomp
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/accesscontrol"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+)
+
+// udpSockaddr converts the address of an IPv4 or IPv6 entry to the address of the UDP socket on the host.
+// UDP is not supported by the other transports.
+func udpSockaddr(addr destination.TransportAddr) (int, syscall.Sockaddr, error) {
+	switch addr := addr.(type) {
+	case destination.TransportAddrIPv4:
+		return syscall.AF_INET, &syscall.SockaddrInet4{Addr: addr.IP(), Port: addr.Port()}, nil
+	case destination.TransportAddrIPv6:
+		return syscall.AF_INET6, &syscall.SockaddrInet6{Addr: addr.IP(), Port: addr.Port()}, nil
+	default:
+		return 0, nil, fmt.Errorf("transport address %s is not supported for UDP", addr)
+	}
+}
+
+// transportAddrOf converts the address of the UDP socket on the host to the address of the entry.
+func transportAddrOf(sa syscall.Sockaddr) destination.TransportAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return destination.NewTransportAddrIPv4(sa.Addr, sa.Port)
+	case *syscall.SockaddrInet6:
+		return destination.NewTransportAddrIPv6(sa.Addr, sa.Port)
+	default:
+		return nil
+	}
+}
+
+// newUDPSocket creates a UDP socket on the host configured by the options of the socket.
+// Options which the host socket does not accept are skipped, since they may be specific to the family.
+func (s *socketStatus) newUDPSocket(ctx context.Context, domain int) (int, error) {
+	logger := log.FromContext(ctx)
+
+	sockfdOnHost, err := syscall.Socket(domain, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create socket: %w", err)
+	}
+	for _, optVal := range s.socketOptions {
+		if err := setsockopt(sockfdOnHost, optVal); err != nil {
+			logger.WarnContext(ctx, "failed to configure socket", "error", err, "sockfdOnHost", sockfdOnHost)
+		}
+	}
+	if domain == syscall.AF_INET6 {
+		// IPv4 is served by the IPv4 entries, so [::] must not take the port of 0.0.0.0.
+		if err := syscall.SetsockoptInt(sockfdOnHost, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+			syscall.Close(sockfdOnHost)
+			return 0, fmt.Errorf("failed to set IPV6_V6ONLY: %w", err)
+		}
+	}
+	return sockfdOnHost, nil
+}
+
+// transportBindUDP binds a UDP socket on the host to the address of the entry.
+// The entry of the host socket has the bound address, so the ephemeral port is known.
+func (s *socketStatus) transportBindUDP(ctx context.Context, entry *destination.Entry) (*hostSocket, error) {
+	domain, addr, err := udpSockaddr(entry.Address)
+	if err != nil {
+		return nil, err
+	}
+	sockfdOnHost, err := s.newUDPSocket(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(sockfdOnHost, addr); err != nil {
+		syscall.Close(sockfdOnHost)
+		return nil, fmt.Errorf("failed to bind: %w", err)
+	}
+	bound, err := syscall.Getsockname(sockfdOnHost)
+	if err != nil {
+		syscall.Close(sockfdOnHost)
+		return nil, fmt.Errorf("failed to get bound address: %w", err)
+	}
+
+	hsCtx, hsCancel := context.WithCancel(context.Background())
+	return &hostSocket{
+		Sockfd: sockfdOnHost,
+		Entry: &destination.Entry{
+			VIP:       entry.VIP,
+			VPort:     entry.VPort,
+			Transport: entry.Transport,
+			Address:   transportAddrOf(bound),
+		},
+		State:  HostSocketBinded,
+		Ctx:    hsCtx,
+		Cancel: hsCancel,
+	}, nil
+}
+
+// transportConnectUDP connects a UDP socket on the host to the address of the entry.
+func (s *socketStatus) transportConnectUDP(ctx context.Context, entry *destination.Entry) (*hostSocket, error) {
+	domain, addr, err := udpSockaddr(entry.Address)
+	if err != nil {
+		return nil, err
+	}
+	sockfdOnHost, err := s.newUDPSocket(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(sockfdOnHost, addr); err != nil {
+		syscall.Close(sockfdOnHost)
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	hsCtx, hsCancel := context.WithCancel(context.Background())
+	return &hostSocket{
+		Sockfd: sockfdOnHost,
+		Entry:  entry,
+		State:  HostSocketConnected,
+		Ctx:    hsCtx,
+		Cancel: hsCancel,
+	}, nil
+}
+
+// encodeDgram puts the virtual address of the source before the payload of a datagram on the host.
+func encodeDgram(src *sockaddr, payload []byte) ([]byte, error) {
+	buf, err := sockaddrToByte(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert sockaddr to byte: %w", err)
+	}
+	return append(buf, payload...), nil
+}
+
+// decodeDgram splits a datagram on the host into the virtual address of the source and the payload.
+func decodeDgram(buf []byte) (*sockaddr, []byte, error) {
+	size, err := sockaddrSize(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unexpected virtual address: %w", err)
+	}
+	if len(buf) < size {
+		return nil, nil, fmt.Errorf("datagram is too short: %d bytes", len(buf))
+	}
+	sa, err := newSockaddr(buf[:size])
+	if err != nil {
+		return nil, nil, err
+	}
+	return sa, buf[size:], nil
+}
+
+// sendDgramTo sends the payload from the socket to the address through the host socket.
+func (s *socketStatus) sendDgramTo(d *dgramStatus, hs *hostSocket, addr syscall.Sockaddr, payload []byte) error {
+	buf, err := encodeDgram(d.localVAddr(), payload)
+	if err != nil {
+		return err
+	}
+	for {
+		err = syscall.Sendto(hs.Sockfd, buf, 0, addr)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// dgramInbound delivers the datagrams received by the host socket to the end until the host socket is canceled.
+// The server rules are applied to the peers which the socket has not sent datagrams to.
+func (s *socketStatus) dgramInbound(ctx context.Context, d *dgramStatus, hs *hostSocket, sae *accesscontrol.View) {
+	logger := log.FromContext(ctx).With("func", "dgramInbound", "hostSocket", hs)
+
+	buf := make([]byte, dgramBufSize)
+	for {
+		n, from, err := syscall.Recvfrom(hs.Sockfd, buf, 0)
+		if hs.Ctx.Err() != nil {
+			return
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to receive datagram", "error", err)
+			return
+		}
+		vaddr, payload, err := decodeDgram(buf[:n])
+		if err != nil {
+			logger.WarnContext(ctx, "dropped datagram", "error", err, "from", transportAddrOf(from))
+			continue
+		}
+		vaddr = nativeSockaddr(vaddr)
+		if s.sockDomain == syscall.AF_INET && vaddr.Family != syscall.AF_INET {
+			logger.DebugContext(ctx, "dropped datagram from IPv6 peer", "vaddr", vaddr)
+			continue
+		}
+
+		d.mu.Lock()
+		var sent bool
+		if p, ok := d.peers[vaddr.String()]; ok {
+			sent = p.sent
+		}
+		connected := d.connected
+		var localPort uint16
+		if d.local != nil {
+			localPort = d.local.Port
+		}
+		d.mu.Unlock()
+
+		var p *dgramPeer
+		if connected != nil {
+			// The connected host socket receives only from the peer.
+			if connected.hs != hs {
+				continue
+			}
+			p = connected
+		} else {
+			if !sent && !sae.Apply(ctx, vaddr.IP, localPort, syscall.SOCK_DGRAM) {
+				logger.DebugContext(ctx, "access control denied", "vaddr", vaddr)
+				continue
+			}
+		}
+
+		d.mu.Lock()
+		if p == nil {
+			p = d.peerLocked(vaddr)
+			p.hs, p.addr = hs, from
+			if err := d.openPeerLocked(p); err != nil {
+				d.mu.Unlock()
+				logger.ErrorContext(ctx, "failed to open peer", "error", err, "vaddr", vaddr)
+				continue
+			}
+			err = syscall.Sendto(p.fd, payload, syscall.MSG_DONTWAIT, &syscall.SockaddrUnix{Name: d.endPath})
+		} else {
+			err = syscall.Sendto(p.fd, payload, syscall.MSG_DONTWAIT, nil)
+		}
+		d.mu.Unlock()
+		if err != nil {
+			// The datagram is dropped as the receive buffer of UDP overflows.
+			logger.DebugContext(ctx, "dropped datagram", "error", err, "vaddr", vaddr)
+		}
+	}
+}
+
+// dgramOutbound sends the datagrams written to the connected end to the host socket until the host socket is canceled.
+func (s *socketStatus) dgramOutbound(ctx context.Context, d *dgramStatus, p *dgramPeer, hs *hostSocket) {
+	logger := log.FromContext(ctx).With("func", "dgramOutbound", "hostSocket", hs)
+
+	buf := make([]byte, dgramBufSize)
+	for {
+		n, err := syscall.Read(p.fd, buf)
+		if hs.Ctx.Err() != nil {
+			return
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to read datagram", "error", err)
+			return
+		}
+		msg, err := encodeDgram(d.localVAddr(), buf[:n])
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to encode datagram", "error", err)
+			continue
+		}
+		if _, err := syscall.Write(hs.Sockfd, msg); err != nil && hs.Ctx.Err() == nil {
+			// ECONNREFUSED and the like are not reported to the container, as the host socket is not its own.
+			logger.DebugContext(ctx, "failed to send datagram", "error", err)
+		}
+	}
+}
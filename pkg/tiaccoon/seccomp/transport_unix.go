@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
 )
 
-func (s *socketStatus) transportConnectUNIX(ctx context.Context, entry *destination.Entry) (int, error) {
+func (s *socketStatus) transportConnectUNIX(ctx context.Context, entry *destination.Entry, timeout time.Duration) (int, error) {
 	logger := log.FromContext(ctx).With("func", "transportConnectUNIX")
 
 	sockfdOnHost, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
@@ -22,19 +23,25 @@ func (s *socketStatus) transportConnectUNIX(ctx context.Context, entry *destinat
 
 	err = s.configureSocket(ctx, sockfdOnHost)
 	if err != nil {
+		syscall.Close(sockfdOnHost)
 		return 0, fmt.Errorf("failed to configure socket: %w", err)
 	}
 	logger.DebugContext(ctx, "configured socket", "sockfdOnHost", sockfdOnHost)
 
 	addr, ok := entry.Address.(destination.TransportAddrUNIX)
 	if !ok {
+		syscall.Close(sockfdOnHost)
 		return 0, errors.New("UNEXPECTED: Address is not TransportAddrUNIX")
 	}
 
-	err = syscall.Connect(sockfdOnHost, &syscall.SockaddrUnix{
+	err = connectHost(sockfdOnHost, &syscall.SockaddrUnix{
 		Name: addr.Path(),
-	})
+	}, timeout)
+	if err == syscall.EINPROGRESS {
+		return sockfdOnHost, err
+	}
 	if err != nil {
+		syscall.Close(sockfdOnHost)
 		return 0, fmt.Errorf("failed to connect: %w", err)
 	}
 
@@ -89,17 +96,10 @@ func (s *socketStatus) transportAcceptUNIX(ctx context.Context, sockfdOnHost int
 		return nil, fmt.Errorf("failed to cast srcAddr to srcAddr4: %v", srcAddr)
 	}
 
-	vsa, err := recvDstVAddr(acceptedSockfd)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive destination virtual address: %w", err)
-	}
-
 	hsCtx, hsCancel := context.WithCancel(context.Background())
 	as := &hostSocket{
 		Sockfd: acceptedSockfd,
 		Entry: &destination.Entry{
-			VIP:       vsa.IP,
-			VPort:     uint16(vsa.Port),
 			Transport: destination.TransportUNIX,
 			Address:   destination.NewTransportAddrUNIX(srcAddrUn.Name),
 		},
@@ -3,6 +3,7 @@ package seccomp
 import (
 	"context"
 	"syscall"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
 )
@@ -11,7 +12,7 @@ var (
 	ErrTryRDMA = syscall.Errno(999)
 )
 
-func (s *socketStatus) transportConnectRDMA(ctx context.Context, entry *destination.Entry) (int, error) {
+func (s *socketStatus) transportConnectRDMA(ctx context.Context, entry *destination.Entry, timeout time.Duration) (int, error) {
 	return syscall.SizeofSockaddrInet4, ErrTryRDMA
 }
 
@@ -0,0 +1,122 @@
+package seccomp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
+)
+
+// allocateVPort gives the socket an ephemeral vport of the VIP, which is released when the socket is closed.
+// The vports of the destination entries of the VIP are not allocated.
+func (s *socketStatus) allocateVPort(ctx context.Context, handler *notifHandler) error {
+	port, err := handler.vports.Allocate(handler.vip, func(port uint16) bool {
+		return handler.de.GetServer(ctx, handler.vip, port) != nil
+	})
+	if err != nil {
+		return err
+	}
+	sa, err := newSockAddrFromIPPort(s.localVAddr.Family, s.localVAddr.IP, port, s.localVAddr.Flowinfo, s.localVAddr.ScopeID)
+	if err != nil {
+		handler.vports.Release(handler.vip, port)
+		return err
+	}
+	s.localVAddr = sa
+	s.releaseVPort = func(ctx context.Context) {
+		handler.vports.Release(handler.vip, port)
+		log.FromContext(ctx).DebugContext(ctx, "released vport", "vport", port)
+	}
+	log.FromContext(ctx).InfoContext(ctx, "allocated vport", "vport", port)
+	return nil
+}
+
+// dynamicEntries returns the entries to bind for the vport allocated by bind(2) with port 0.
+// The entries of vport 0 are the templates: IPv4 and IPv6 addresses are bound with an ephemeral port of the host,
+// and a socket named by the VIP and the vport is created in the directory of a UNIX address.
+// 0.0.0.0 is bound if there are no templates.
+func (h *notifHandler) dynamicEntries(ctx context.Context, vport uint16) []*destination.Entry {
+	templates := h.de.GetServer(ctx, h.vip, 0)
+	if templates == nil {
+		templates = []*destination.Entry{{
+			Transport: destination.TransportIPv4,
+			Address:   destination.NewTransportAddrIPv4([4]byte{0, 0, 0, 0}, 0),
+		}}
+	}
+
+	entries := []*destination.Entry{}
+	for _, t := range templates {
+		var address destination.TransportAddr
+		switch addr := t.Address.(type) {
+		case destination.TransportAddrIPv4:
+			address = destination.NewTransportAddrIPv4(addr.IP(), 0)
+		case destination.TransportAddrIPv6:
+			address = destination.NewTransportAddrIPv6(addr.IP(), 0)
+		case destination.TransportAddrUNIX:
+			address = destination.NewTransportAddrUNIX(filepath.Join(addr.Path(), fmt.Sprintf("%s_%d.sock", h.vip, vport)))
+		default:
+			log.FromContext(ctx).WarnContext(ctx, "transport is not supported for dynamic port", "entry", t)
+			continue
+		}
+		entries = append(entries, &destination.Entry{
+			VIP:       h.vip,
+			VPort:     vport,
+			Transport: t.Transport,
+			Address:   address,
+		})
+	}
+	return entries
+}
+
+// boundEntry returns the entry with the address which the host socket is actually bound to.
+func boundEntry(entry *destination.Entry, sockfdOnHost int) *destination.Entry {
+	if entry.Transport != destination.TransportIPv4 && entry.Transport != destination.TransportIPv6 {
+		return entry
+	}
+	sa, err := syscall.Getsockname(sockfdOnHost)
+	if err != nil {
+		return entry
+	}
+	address := transportAddrOf(sa)
+	if address == nil {
+		return entry
+	}
+	return &destination.Entry{
+		VIP:       entry.VIP,
+		VPort:     entry.VPort,
+		Transport: entry.Transport,
+		Address:   address,
+	}
+}
+
+// registerVPort adds the entries bound for the allocated vport, so that other containers reach the socket by the vport.
+// They are removed when the socket is closed.
+func (s *socketStatus) registerVPort(ctx context.Context, handler *notifHandler, entries []*destination.Entry) {
+	if handler.vip == nil || len(entries) == 0 {
+		return
+	}
+	vport := entries[0].VPort
+	registered := make([]*destination.Entry, 0, len(entries))
+	for _, entry := range entries {
+		e := *entry
+		e.Origin = destination.OriginBind
+		registered = append(registered, &e)
+	}
+	handler.dm.Replace(ctx, handler.vip, vport, registered)
+
+	release := s.releaseVPort
+	s.releaseVPort = func(ctx context.Context) {
+		handler.dm.Remove(ctx, handler.vip, vport)
+		for _, entry := range entries {
+			if addr, ok := entry.Address.(destination.TransportAddrUNIX); ok {
+				os.Remove(addr.Path())
+			}
+		}
+		if release != nil {
+			release(ctx)
+		}
+	}
+}
@@ -3,25 +3,51 @@ package tiaccoon
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/hiroyaonoe/tiaccoon/pkg/log"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/api"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/destination"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/manage"
+	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/registry"
 	"github.com/hiroyaonoe/tiaccoon/pkg/tiaccoon/seccomp"
 )
 
-func Start(ctx context.Context, socketPath string, defaultPolicy bool, myVIP net.IP, featureRDMA bool) {
+func Start(ctx context.Context, socketPath, apiSocketPath string, defaultPolicy bool, myVIP net.IP, vipAnnotation bool, featureRDMA bool, configPath, registryPath string, healthCheck destination.HealthCheckConfig, connectTimeout time.Duration, shutdown seccomp.ShutdownConfig) error {
 	logger := log.FromContext(ctx)
 
 	logger.InfoContext(ctx, "Starting tiaccoon")
 
-	manager := manage.NewManager(defaultPolicy, myVIP, featureRDMA)
-	sae, cae, de := manager.Start(ctx)
+	manager := manage.NewManager(defaultPolicy, featureRDMA, configPath)
+	sae, cae, _, err := manager.Start(ctx)
+	if err != nil {
+		return err
+	}
 	defer manager.Close(ctx)
 
-	sHandler := seccomp.NewHandler(sae, cae, de, socketPath, myVIP, featureRDMA)
+	healthChecker := destination.NewHealthChecker(manager.Destination().Entries, healthCheck)
+	go healthChecker.Start(ctx)
+	defer healthChecker.Close(ctx)
+
+	// The registry is shared with the api server, where the CNI plugin registers the containers.
+	// It is saved to the file so that the containers registered before a restart keep their VIPs.
+	reg := registry.New(registryPath)
+	if err := reg.Load(ctx); err != nil {
+		return err
+	}
+	sHandler := seccomp.NewHandler(sae, cae, manager.Destination(), reg, socketPath, myVIP, vipAnnotation, featureRDMA, connectTimeout, shutdown)
 
 	go sHandler.Start(ctx)
 	defer sHandler.Close(ctx)
 
+	if apiSocketPath != "" {
+		apiServer := api.NewServer(manager.AccessControl(), manager.Destination(), sHandler, reg, apiSocketPath)
+
+		go apiServer.Start(ctx)
+		defer apiServer.Close(ctx)
+	}
+
 	<-ctx.Done()
+	logger.InfoContext(ctx, "Shutting down tiaccoon")
+	return nil
 }
@@ -0,0 +1,85 @@
+package vip
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// The range of ephemeral vports, which is the default ip_local_port_range of Linux.
+const (
+	EphemeralPortMin = 32768
+	EphemeralPortMax = 60999
+)
+
+var ErrNoPort = errors.New("no ephemeral vport is available")
+
+// Ports allocates the ephemeral vports of the VIPs. It is safe for concurrent use.
+type Ports struct {
+	mu   sync.Mutex
+	vips map[[2]uint64]*ports
+}
+
+type ports struct {
+	next uint16
+	used map[uint16]struct{}
+}
+
+func NewPorts() *Ports {
+	return &Ports{
+		vips: map[[2]uint64]*ports{},
+	}
+}
+
+func key(ip net.IP) [2]uint64 {
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	upper, lower := IP2Int(ip)
+	return [2]uint64{upper, lower}
+}
+
+// Allocate returns an ephemeral vport of the VIP which is neither allocated nor reserved.
+// reserved reports the vports taken by others, such as the destination entries.
+func (p *Ports) Allocate(ip net.IP, reserved func(port uint16) bool) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := key(ip)
+	v, ok := p.vips[k]
+	if !ok {
+		v = &ports{next: EphemeralPortMin, used: map[uint16]struct{}{}}
+		p.vips[k] = v
+	}
+	for range EphemeralPortMax - EphemeralPortMin + 1 {
+		port := v.next
+		if v.next == EphemeralPortMax {
+			v.next = EphemeralPortMin
+		} else {
+			v.next++
+		}
+		if _, ok := v.used[port]; ok {
+			continue
+		}
+		if reserved != nil && reserved(port) {
+			continue
+		}
+		v.used[port] = struct{}{}
+		return port, nil
+	}
+	return 0, ErrNoPort
+}
+
+// Release makes the vport of the VIP available again.
+func (p *Ports) Release(ip net.IP, port uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := key(ip)
+	v, ok := p.vips[k]
+	if !ok {
+		return
+	}
+	// next is kept so that the vport is not reused soon.
+	delete(v.used, port)
+}
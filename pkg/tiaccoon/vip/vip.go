@@ -5,7 +5,7 @@ import "net"
 func IP2Int(ip net.IP) (upper uint64, lower uint64) {
 	if len(ip) == 16 {
 		upper = uint64(ip[0])<<56 | uint64(ip[1])<<48 | uint64(ip[2])<<40 | uint64(ip[3])<<32 | uint64(ip[4])<<24 | uint64(ip[5])<<16 | uint64(ip[6])<<8 | uint64(ip[7])
-		if upper == 0 && ip[10] == 0xff && ip[11] == 0xff { // IPv4-mapped IPv6 address
+		if upper == 0 && ip[8] == 0 && ip[9] == 0 && ip[10] == 0xff && ip[11] == 0xff { // IPv4-mapped IPv6 address
 			lower = uint64(ip[12])<<24 | uint64(ip[13])<<16 | uint64(ip[14])<<8 | uint64(ip[15])
 		} else {
 			lower = uint64(ip[8])<<56 | uint64(ip[9])<<48 | uint64(ip[10])<<40 | uint64(ip[11])<<32 | uint64(ip[12])<<24 | uint64(ip[13])<<16 | uint64(ip[14])<<8 | uint64(ip[15])
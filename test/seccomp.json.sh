@@ -12,6 +12,8 @@
 # $ nerdctl run -it --rm --security-opt seccomp=$HOME/seccomp.json alpine
 
 # TODO: support non-x86
+# sendmsg and recvmsg are notified for UDP, which costs TCP sockets calling them a round trip to tiaccoon.
+# sendto and recvfrom are notified only with the address.
 # TODO: inherit the default seccomp profile (https://github.com/containerd/containerd/blob/v1.6.0-rc.1/contrib/seccomp/seccomp_default.go#L52)
 
 SOCKET_NAME=$1
@@ -37,12 +39,31 @@ cat <<EOF
         "connect",
         "setsockopt",
         "fcntl",
+        "dup",
+        "dup2",
+        "dup3",
         "_exit",
         "exit_group",
         "getpeername",
-        "getsockname"
+        "getsockname",
+        "sendmsg",
+        "recvmsg"
       ],
       "action": "SCMP_ACT_NOTIFY"
+    },
+    {
+      "names": [
+        "sendto",
+        "recvfrom"
+      ],
+      "action": "SCMP_ACT_NOTIFY",
+      "args": [
+        {
+          "index": 4,
+          "value": 0,
+          "op": "SCMP_CMP_NE"
+        }
+      ]
     }
   ]
 }